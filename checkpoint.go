@@ -0,0 +1,73 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointStore persists where the update mode resumes fetching events
+// after a run whose events were all posted to globomap.
+type checkpointStore interface {
+	Load() (*time.Time, error)
+	Save(time.Time) error
+}
+
+type fileCheckpointStore struct {
+	path string
+}
+
+type checkpoint struct {
+	Since time.Time `json:"since"`
+}
+
+func (s *fileCheckpointStore) Load() (*time.Time, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Since.IsZero() {
+		return nil, nil
+	}
+	return &cp.Since, nil
+}
+
+func (s *fileCheckpointStore) Save(t time.Time) error {
+	data, err := json.Marshal(checkpoint{Since: t})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it, so a
+// failure while writing never leaves a corrupted state file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
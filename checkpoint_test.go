@@ -0,0 +1,49 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestFileCheckpointStore(c *check.C) {
+	store := &fileCheckpointStore{path: filepath.Join(c.MkDir(), "state.json")}
+	last, err := store.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last, check.IsNil)
+
+	t1 := time.Date(2017, 10, 1, 12, 30, 0, 0, time.UTC)
+	err = store.Save(t1)
+	c.Assert(err, check.IsNil)
+	last, err = store.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last, check.NotNil)
+	c.Assert(last.Equal(t1), check.Equals, true)
+
+	t2 := t1.Add(time.Hour)
+	err = store.Save(t2)
+	c.Assert(err, check.IsNil)
+	last, err = store.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last.Equal(t2), check.Equals, true)
+
+	files, err := ioutil.ReadDir(filepath.Dir(store.path))
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.HasLen, 1)
+}
+
+func (s *S) TestFileCheckpointStoreInvalidFile(c *check.C) {
+	path := filepath.Join(c.MkDir(), "state.json")
+	err := ioutil.WriteFile(path, []byte("invalid"), 0644)
+	c.Assert(err, check.IsNil)
+	store := &fileCheckpointStore{path: path}
+	last, err := store.Load()
+	c.Assert(err, check.NotNil)
+	c.Assert(last, check.IsNil)
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
+)
+
+const compUnitCollection = "comp_unit"
+
+// compUnitMatcher is a strategy used to find the globomap comp_unit of a
+// tsuru node. Matchers return a nil result when the node doesn't match.
+type compUnitMatcher interface {
+	name() string
+	match(n *node) (*globomap.QueryResult, error)
+}
+
+// nameMatcher looks up the comp_unit named after the node IaaS ID, using
+// the node IP to pick one of them when there are many.
+type nameMatcher struct{}
+
+func (m *nameMatcher) name() string { return "name" }
+
+func (m *nameMatcher) match(n *node) (*globomap.QueryResult, error) {
+	if n.Name() == "" {
+		return nil, nil
+	}
+	return env.globomap.Query(globomap.QueryFields{
+		Collection: compUnitCollection,
+		Name:       n.Name(),
+		IP:         n.IP(),
+	})
+}
+
+// ipMatcher looks up the only comp_unit that has the node IP, regardless of
+// its name.
+type ipMatcher struct{}
+
+func (m *ipMatcher) name() string { return "ip" }
+
+func (m *ipMatcher) match(n *node) (*globomap.QueryResult, error) {
+	ip := n.IP()
+	if ip == "" {
+		return nil, nil
+	}
+	results, err := env.globomap.QueryAll(globomap.NewQuery(compUnitCollection).
+		And(globomap.Cond(globomap.PropertyField("ips"), globomap.OpIn, ip)))
+	if err != nil {
+		return nil, err
+	}
+	var found []globomap.QueryResult
+	for _, r := range results {
+		for _, resultIP := range r.Properties.IPs {
+			if resultIP == ip {
+				found = append(found, r)
+				break
+			}
+		}
+	}
+	if len(found) != 1 {
+		return nil, nil
+	}
+	return &found[0], nil
+}
+
+// metadataMatcher looks up the comp_unit named after the value of one of
+// the node metadata keys, like a hostname label.
+type metadataMatcher struct {
+	keys []string
+}
+
+func (m *metadataMatcher) name() string { return "metadata" }
+
+func (m *metadataMatcher) match(n *node) (*globomap.QueryResult, error) {
+	for _, key := range m.keys {
+		value := n.Metadata[key]
+		if value == "" {
+			continue
+		}
+		result, err := env.globomap.Query(globomap.QueryFields{
+			Collection: compUnitCollection,
+			Name:       value,
+			IP:         n.IP(),
+		})
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+	return nil, nil
+}
+
+// hostsMatcher resolves the node IP to its host names using a local hosts
+// map and looks up the comp_unit named after any of them, trying both the
+// FQDN and the short name.
+type hostsMatcher struct {
+	hosts map[string][]string
+}
+
+func (m *hostsMatcher) name() string { return "hosts" }
+
+func (m *hostsMatcher) match(n *node) (*globomap.QueryResult, error) {
+	for _, host := range m.hosts[n.IP()] {
+		names := []string{host}
+		if i := strings.Index(host, "."); i > 0 {
+			names = append(names, host[:i])
+		}
+		for _, name := range names {
+			result, err := env.globomap.Query(globomap.QueryFields{
+				Collection: compUnitCollection,
+				Name:       name,
+				IP:         n.IP(),
+			})
+			if err != nil || result != nil {
+				return result, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// readHostsFile parses a file in the /etc/hosts format, returning the host
+// names of each IP.
+func readHostsFile(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hosts := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		hosts[fields[0]] = append(hosts[fields[0]], fields[1:]...)
+	}
+	return hosts, scanner.Err()
+}
+
+// newCompUnitMatchers builds the matcher chain with the strategies listed
+// in the configuration.
+func newCompUnitMatchers(c configParams) ([]compUnitMatcher, error) {
+	var matchers []compUnitMatcher
+	for _, strategy := range c.compUnitMatchers {
+		switch strategy {
+		case "name":
+			matchers = append(matchers, &nameMatcher{})
+		case "ip":
+			matchers = append(matchers, &ipMatcher{})
+		case "metadata":
+			matchers = append(matchers, &metadataMatcher{keys: c.compUnitMetadataKeys})
+		case "hosts":
+			if c.compUnitHostsFile == "" {
+				return nil, fmt.Errorf("COMP_UNIT_HOSTS_FILE is required by the hosts matcher")
+			}
+			hosts, err := readHostsFile(c.compUnitHostsFile)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, &hostsMatcher{hosts: hosts})
+		default:
+			return nil, fmt.Errorf("Invalid comp_unit matcher: %s", strategy)
+		}
+	}
+	return matchers, nil
+}
+
+// compUnitReport records which matcher found the comp_unit of each node.
+type compUnitReport struct {
+	mu      sync.Mutex
+	matches map[string]string
+}
+
+func (r *compUnitReport) record(nodeName, strategy string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.matches == nil {
+		r.matches = make(map[string]string)
+	}
+	r.matches[nodeName] = strategy
+}
+
+// reset forgets the matches recorded, so each run reports only its nodes.
+func (r *compUnitReport) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.matches = nil
+}
+
+// log writes the matches recorded at the end of a load or update run.
+func (r *compUnitReport) log() {
+	if report := r.String(); report != "" {
+		env.log.Debugf("comp_unit matches:\n%s", report)
+	}
+}
+
+func (r *compUnitReport) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.matches))
+	for name := range r.matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		strategy := r.matches[name]
+		if strategy == "" {
+			strategy = "no match"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, strategy))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// queryCompUnit looks up the globomap comp_unit that matches the given
+// tsuru node, trying each configured matcher in order.
+func queryCompUnit(n *node) (*globomap.QueryResult, error) {
+	matchers := env.compUnitMatchers
+	if len(matchers) == 0 {
+		matchers = []compUnitMatcher{&nameMatcher{}}
+	}
+	nodeName := n.Name()
+	if nodeName == "" {
+		nodeName = n.IP()
+	}
+	var lastErr error
+	for _, m := range matchers {
+		result, err := m.match(n)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if result != nil {
+			compUnitQueries.inc("hit")
+			env.compUnitReport.record(nodeName, m.name())
+			env.log.With(logger.Fields{"entity": "node", "target": nodeName, "comp_unit": result.Id}).Debugf("node matched comp_unit by %s", m.name())
+			return result, nil
+		}
+	}
+	compUnitQueries.inc("miss")
+	env.compUnitReport.record(nodeName, "")
+	env.status.recordError(subsystemGlobomapAPI, lastErr)
+	return nil, lastErr
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"gopkg.in/check.v1"
+)
+
+// compUnitServer answers comp_unit queries by name or by IP using the given
+// documents.
+func compUnitServer(c *check.C, docs []globomap.QueryResult) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, check.Equals, "/v1/collections/comp_unit/")
+		var groups [][]globomap.Condition
+		err := json.Unmarshal([]byte(r.FormValue("query")), &groups)
+		c.Assert(err, check.IsNil)
+		cond := groups[0][0]
+		var result []globomap.QueryResult
+		for _, d := range docs {
+			switch cond.Field {
+			case "name":
+				if d.Name == cond.Value {
+					result = append(result, d)
+				}
+			case "properties.ips":
+				for _, ip := range d.Properties.IPs {
+					if ip == cond.Value {
+						result = append(result, d)
+					}
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(struct{ Documents []globomap.QueryResult }{result})
+	}))
+}
+
+func (s *S) TestQueryCompUnitMatcherChain(c *check.C) {
+	server := compUnitServer(c, []globomap.QueryResult{
+		{Id: "comp_unit/vm1", Name: "vm1", Properties: globomap.Properties{IPs: []string{"10.0.0.1"}}},
+		{Id: "comp_unit/vm2", Name: "vm2", Properties: globomap.Properties{IPs: []string{"10.0.0.2"}}},
+	})
+	defer server.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", server.URL)
+	os.Setenv("COMP_UNIT_MATCHERS", "name, ip")
+	defer os.Unsetenv("COMP_UNIT_MATCHERS")
+	setup(nil)
+	c.Assert(env.compUnitMatchers, check.DeepEquals, []compUnitMatcher{&nameMatcher{}, &ipMatcher{}})
+
+	n1 := &node{Iaasid: "vm1", Address: "https://10.0.0.1:2376"}
+	result, err := queryCompUnit(n1)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Id, check.Equals, "comp_unit/vm1")
+
+	n2 := &node{Iaasid: "i-1234", Address: "https://10.0.0.2:2376"}
+	result, err = queryCompUnit(n2)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Id, check.Equals, "comp_unit/vm2")
+
+	n3 := &node{Iaasid: "i-5678", Address: "https://10.0.0.3:2376"}
+	result, err = queryCompUnit(n3)
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.IsNil)
+
+	c.Assert(env.compUnitReport.String(), check.Equals, "i-1234: ip\ni-5678: no match\nvm1: name")
+
+	env.compUnitReport.reset()
+	c.Assert(env.compUnitReport.String(), check.Equals, "")
+}
+
+func (s *S) TestMetadataMatcher(c *check.C) {
+	server := compUnitServer(c, []globomap.QueryResult{
+		{Id: "comp_unit/host1", Name: "host1", Properties: globomap.Properties{IPs: []string{"10.0.0.1"}}},
+	})
+	defer server.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", server.URL)
+	setup(nil)
+
+	m := &metadataMatcher{keys: []string{"label", "hostname"}}
+	result, err := m.match(&node{Address: "10.0.0.1", Metadata: map[string]string{"hostname": "host1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Id, check.Equals, "comp_unit/host1")
+
+	result, err = m.match(&node{Address: "10.0.0.1", Metadata: map[string]string{"pool": "host1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.IsNil)
+}
+
+func (s *S) TestHostsMatcher(c *check.C) {
+	server := compUnitServer(c, []globomap.QueryResult{
+		{Id: "comp_unit/host1", Name: "host1", Properties: globomap.Properties{IPs: []string{"10.0.0.1"}}},
+	})
+	defer server.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", server.URL)
+	setup(nil)
+
+	m := &hostsMatcher{hosts: map[string][]string{"10.0.0.1": {"host1.example.com"}}}
+	result, err := m.match(&node{Address: "https://10.0.0.1:2376"})
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Id, check.Equals, "comp_unit/host1")
+
+	result, err = m.match(&node{Address: "https://10.0.0.2:2376"})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.IsNil)
+}
+
+func (s *S) TestReadHostsFile(c *check.C) {
+	path := filepath.Join(c.MkDir(), "hosts")
+	data := "# comment\n10.0.0.1 host1.example.com host1\n\n10.0.0.2\thost2.example.com # another\n10.0.0.1 alias1\n"
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	c.Assert(err, check.IsNil)
+
+	hosts, err := readHostsFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(hosts, check.DeepEquals, map[string][]string{
+		"10.0.0.1": {"host1.example.com", "host1", "alias1"},
+		"10.0.0.2": {"host2.example.com"},
+	})
+}
+
+func (s *S) TestNewCompUnitMatchers(c *check.C) {
+	path := filepath.Join(c.MkDir(), "hosts")
+	err := ioutil.WriteFile(path, []byte("10.0.0.1 host1\n"), 0644)
+	c.Assert(err, check.IsNil)
+	config := NewConfig()
+	config.compUnitMatchers = []string{"metadata", "hosts"}
+	config.compUnitHostsFile = path
+
+	matchers, err := newCompUnitMatchers(config)
+	c.Assert(err, check.IsNil)
+	c.Assert(matchers, check.DeepEquals, []compUnitMatcher{
+		&metadataMatcher{keys: []string{"hostname"}},
+		&hostsMatcher{hosts: map[string][]string{"10.0.0.1": {"host1"}}},
+	})
+
+	config.compUnitHostsFile = ""
+	_, err = newCompUnitMatchers(config)
+	c.Assert(err, check.NotNil)
+
+	config.compUnitMatchers = []string{"invalid"}
+	_, err = newCompUnitMatchers(config)
+	c.Assert(err, check.ErrorMatches, "Invalid comp_unit matcher: invalid")
+}
@@ -10,13 +10,21 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
 	"github.com/tsuru/gnuflag"
 )
 
 type configParams struct {
 	dry                    bool
+	diff                   bool
+	diffFormat             globomap.DiffFormat
+	exportFile             string
+	exportGraphFile        string
+	exportFormat           exportFormat
 	verbose                bool
 	tsuruHostname          string
 	tsuruToken             string
@@ -28,16 +36,50 @@ type configParams struct {
 	repeat                 *time.Duration
 	retrySleepTime         time.Duration
 	maxRetries             int
+	retryWorkers           int
+	retryQueueSize         int
+	retryQueueFile         string
 	sleepTimeBetweenChunks time.Duration
+	maxDeletePercent       float64
+	checkpointFile         string
+	hashStateFile          string
+	hashMaxAge             time.Duration
+	listenAddress          string
+	webhookTeamOwner       string
+	webhookSecret          string
+	webhookPath            string
+	metricsAddress         string
+	healthcheckTimeout     time.Duration
+	shutdownTimeout        time.Duration
+	leaderElection         string
+	leaderLockFile         string
+	leaderLeaseURL         string
+	leaderLeaseTTL         time.Duration
+	leaderID               string
+	logLevel               logger.Level
+	logFormat              logger.Format
+	jobTimeout             time.Duration
+	postRetry              globomap.RetryPolicy
+	compUnitMatchers       []string
+	compUnitMetadataKeys   []string
+	compUnitHostsFile      string
 }
 
 type flags struct {
-	fs      *gnuflag.FlagSet
-	dry     bool
-	verbose bool
-	start   string
-	load    bool
-	repeat  string
+	fs           *gnuflag.FlagSet
+	dry          bool
+	diff         bool
+	diffFormat   string
+	export       string
+	exportGraph  string
+	exportFormat string
+	verbose      bool
+	start        string
+	load         bool
+	reconcile    bool
+	repeat       string
+	serve        bool
+	webhook      string
 }
 
 func NewConfig() configParams {
@@ -48,11 +90,49 @@ func NewConfig() configParams {
 		globomapLoaderHostname: os.Getenv("GLOBOMAP_LOADER_HOSTNAME"),
 		globomapUsername:       os.Getenv("GLOBOMAP_USERNAME"),
 		globomapPassword:       os.Getenv("GLOBOMAP_PASSWORD"),
+		checkpointFile:         os.Getenv("CHECKPOINT_FILE"),
+		hashStateFile:          os.Getenv("HASH_STATE_FILE"),
+		hashMaxAge:             24 * time.Hour,
+		listenAddress:          ":8080",
+		compUnitMatchers:       []string{"name"},
+		compUnitMetadataKeys:   []string{"hostname"},
+		compUnitHostsFile:      os.Getenv("COMP_UNIT_HOSTS_FILE"),
+		postRetry: globomap.RetryPolicy{
+			MaxAttempts:          3,
+			InitialBackoff:       time.Second,
+			MaxBackoff:           30 * time.Second,
+			Jitter:               0.2,
+			RetryableStatusCodes: globomap.DefaultRetryableStatusCodes,
+		},
+		webhookTeamOwner:       os.Getenv("WEBHOOK_TEAM_OWNER"),
+		webhookSecret:          os.Getenv("WEBHOOK_SECRET"),
+		webhookPath:            "/",
+		metricsAddress:         os.Getenv("METRICS_ADDRESS"),
+		logLevel:               logger.Info,
+		logFormat:              logger.Text,
 		retrySleepTime:         5 * time.Minute,
 		maxRetries:             20,
+		retryWorkers:           4,
+		retryQueueSize:         1000,
+		retryQueueFile:         os.Getenv("RETRY_QUEUE_FILE"),
 		sleepTimeBetweenChunks: 10 * time.Second,
+		maxDeletePercent:       10,
+		shutdownTimeout:        30 * time.Second,
+		leaderElection:         os.Getenv("LEADER_ELECTION"),
+		leaderLockFile:         os.Getenv("LEADER_LOCK_FILE"),
+		leaderLeaseURL:         os.Getenv("LEADER_LEASE_URL"),
+		leaderLeaseTTL:         30 * time.Second,
+		leaderID:               os.Getenv("LEADER_ID"),
 	}
 	config.processRetryArguments()
+	config.processReconcileArguments()
+	config.processServeArguments()
+	config.processPostRetryArguments()
+	config.processCompUnitArguments()
+	config.processLogArguments()
+	config.processHealthArguments()
+	config.processLeaderArguments()
+	config.processHashArguments()
 	return config
 }
 
@@ -69,25 +149,207 @@ func (c *configParams) processRetryArguments() {
 			c.maxRetries = maxInt
 		}
 	}
+
+	if workers := os.Getenv("RETRY_WORKERS"); workers != "" {
+		workersInt, err := strconv.Atoi(workers)
+		if err == nil && workersInt > 0 {
+			c.retryWorkers = workersInt
+		}
+	}
+
+	if size := os.Getenv("RETRY_QUEUE_SIZE"); size != "" {
+		sizeInt, err := strconv.Atoi(size)
+		if err == nil && sizeInt > 0 {
+			c.retryQueueSize = sizeInt
+		}
+	}
+}
+
+func (c *configParams) processReconcileArguments() {
+	max := os.Getenv("RECONCILE_MAX_DELETE_PERCENT")
+	if max != "" {
+		maxFloat, err := strconv.ParseFloat(max, 64)
+		if err == nil && maxFloat >= 0 && maxFloat <= 100 {
+			c.maxDeletePercent = maxFloat
+		}
+	}
+}
+
+func (c *configParams) processJobArguments() error {
+	value := os.Getenv("GLOBOMAP_JOB_TIMEOUT")
+	if value == "" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < 0 {
+		return fmt.Errorf("Invalid GLOBOMAP_JOB_TIMEOUT: %s", value)
+	}
+	c.jobTimeout = timeout
+	return nil
+}
+
+func (c *configParams) processPostRetryArguments() {
+	if max := os.Getenv("GLOBOMAP_POST_MAX_ATTEMPTS"); max != "" {
+		maxInt, err := strconv.Atoi(max)
+		if err == nil && maxInt > 0 {
+			c.postRetry.MaxAttempts = maxInt
+		}
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("GLOBOMAP_POST_BACKOFF")); err == nil && backoff > 0 {
+		c.postRetry.InitialBackoff = backoff
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("GLOBOMAP_POST_MAX_BACKOFF")); err == nil && backoff > 0 {
+		c.postRetry.MaxBackoff = backoff
+	}
+	if jitter := os.Getenv("GLOBOMAP_POST_BACKOFF_JITTER"); jitter != "" {
+		jitterFloat, err := strconv.ParseFloat(jitter, 64)
+		if err == nil && jitterFloat >= 0 && jitterFloat <= 1 {
+			c.postRetry.Jitter = jitterFloat
+		}
+	}
+	if codes := os.Getenv("GLOBOMAP_POST_RETRYABLE_STATUS_CODES"); codes != "" {
+		var statusCodes []int
+		for _, code := range strings.Split(codes, ",") {
+			codeInt, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				return
+			}
+			statusCodes = append(statusCodes, codeInt)
+		}
+		c.postRetry.RetryableStatusCodes = statusCodes
+	}
+}
+
+func (c *configParams) processCompUnitArguments() {
+	if matchers := splitList(os.Getenv("COMP_UNIT_MATCHERS")); len(matchers) > 0 {
+		c.compUnitMatchers = matchers
+	}
+	if keys := splitList(os.Getenv("COMP_UNIT_METADATA_KEYS")); len(keys) > 0 {
+		c.compUnitMetadataKeys = keys
+	}
+}
+
+func (c *configParams) processHealthArguments() {
+	timeout, err := c.parseTimeDuration(os.Getenv("HEALTHCHECK_TIMEOUT"))
+	if timeout != nil && err == nil {
+		c.healthcheckTimeout = *timeout
+	}
+	timeout, err = c.parseTimeDuration(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if timeout != nil && err == nil {
+		c.shutdownTimeout = *timeout
+	}
+}
+
+func (c *configParams) processLeaderArguments() {
+	if ttl, err := time.ParseDuration(os.Getenv("LEADER_LEASE_TTL")); err == nil && ttl > 0 {
+		c.leaderLeaseTTL = ttl
+	}
+}
+
+func (c *configParams) processHashArguments() {
+	maxAge, err := c.parseTimeDuration(os.Getenv("HASH_MAX_AGE"))
+	if maxAge != nil && err == nil {
+		c.hashMaxAge = *maxAge
+	}
+}
+
+// healthTimeout is the longest time the repeat loop may go without
+// finishing a run before it's reported unhealthy. It defaults to three
+// times the repeat frequency.
+func (c *configParams) healthTimeout() time.Duration {
+	if c.healthcheckTimeout > 0 {
+		return c.healthcheckTimeout
+	}
+	if c.repeat != nil {
+		return 3 * *c.repeat
+	}
+	return 0
+}
+
+// adminAddress is where the metrics, health and status endpoints are
+// served: METRICS_ADDRESS when set, or the listen address in repeat mode.
+func (c *configParams) adminAddress() string {
+	if c.metricsAddress != "" {
+		return c.metricsAddress
+	}
+	if c.repeat != nil {
+		return c.listenAddress
+	}
+	return ""
+}
+
+func (c *configParams) processLogArguments() {
+	if level, err := logger.ParseLevel(os.Getenv("LOG_LEVEL")); err == nil {
+		c.logLevel = level
+	}
+	if format, err := logger.ParseFormat(os.Getenv("LOG_FORMAT")); err == nil {
+		c.logFormat = format
+	}
+}
+
+// splitList parses a comma separated list, ignoring empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *configParams) processServeArguments() {
+	if addr := os.Getenv("LISTEN_ADDRESS"); addr != "" {
+		c.listenAddress = addr
+	} else if port := os.Getenv("PORT"); port != "" {
+		c.listenAddress = ":" + port
+	}
+	if path := os.Getenv("WEBHOOK_PATH"); path != "" {
+		c.webhookPath = "/" + strings.TrimPrefix(path, "/")
+	}
 }
 
 func (c *configParams) ProcessArguments(args []string) error {
 	flags := flags{fs: gnuflag.NewFlagSet("", gnuflag.ExitOnError)}
 	flags.fs.BoolVar(&flags.dry, "dry", false, "dry mode")
 	flags.fs.BoolVar(&flags.dry, "d", false, "dry mode")
+	flags.fs.BoolVar(&flags.diff, "diff", false, "diff mode")
+	flags.fs.StringVar(&flags.diffFormat, "diff-format", string(globomap.DiffText), "diff output format")
+	flags.fs.StringVar(&flags.export, "export", "", "export mode, writing to the given file")
+	flags.fs.StringVar(&flags.exportGraph, "export-graph", "", "graph file rendered by the export mode")
+	flags.fs.StringVar(&flags.exportFormat, "export-format", string(exportDOT), "export graph format")
 	flags.fs.BoolVar(&flags.verbose, "verbose", false, "verbose mode")
 	flags.fs.BoolVar(&flags.verbose, "v", false, "verbose mode")
 	flags.fs.StringVar(&flags.start, "start", "", "start time")
 	flags.fs.StringVar(&flags.start, "s", "", "start time")
 	flags.fs.BoolVar(&flags.load, "load", false, "load mode")
 	flags.fs.BoolVar(&flags.load, "l", false, "load mode")
+	flags.fs.BoolVar(&flags.reconcile, "reconcile", false, "reconcile mode")
 	flags.fs.StringVar(&flags.repeat, "repeat", "", "repeat frequency")
 	flags.fs.StringVar(&flags.repeat, "r", "", "repeat frequency")
+	flags.fs.BoolVar(&flags.serve, "serve", false, "webhook receiver mode")
+	flags.fs.StringVar(&flags.webhook, "register-webhook", "", "register tsuru webhook to the given URL")
 	err := flags.fs.Parse(true, args)
 	if err != nil {
 		return err
 	}
+	if err = c.processJobArguments(); err != nil {
+		return err
+	}
 
+	var syncCommand *syncCmd
+	if args := flags.fs.Args(); len(args) > 0 {
+		if args[0] != "sync" {
+			return fmt.Errorf("Unknown command: %s", args[0])
+		}
+		if flags.load || flags.reconcile || flags.serve || flags.webhook != "" || flags.start != "" || flags.repeat != "" {
+			return errors.New("sync command can't be set with other modes")
+		}
+		syncCommand, err = newSyncCmd(args[1:])
+		if err != nil {
+			return err
+		}
+	}
 	if flags.load && flags.start != "" {
 		return errors.New("Load mode doesn't support --start flag")
 	}
@@ -97,11 +359,60 @@ func (c *configParams) ProcessArguments(args []string) error {
 	if flags.start != "" && flags.repeat != "" {
 		return errors.New("--start and --repeat flags can't be set together")
 	}
+	if flags.reconcile && flags.load {
+		return errors.New("--reconcile and --load flags can't be set together")
+	}
+	if flags.reconcile && (flags.start != "" || flags.repeat != "") {
+		return errors.New("Reconcile mode doesn't support --start and --repeat flags")
+	}
+	if flags.serve && (flags.load || flags.reconcile || flags.start != "" || flags.repeat != "") {
+		return errors.New("Serve mode doesn't support --load, --reconcile, --start and --repeat flags")
+	}
+	if flags.serve && c.webhookSecret == "" {
+		return errors.New("Serve mode requires the WEBHOOK_SECRET env var")
+	}
+	if flags.webhook != "" && (flags.serve || flags.load || flags.reconcile || flags.start != "" || flags.repeat != "") {
+		return errors.New("--register-webhook flag can't be set with other modes")
+	}
+
+	if flags.export != "" && (syncCommand != nil || flags.load || flags.reconcile || flags.serve || flags.webhook != "" || flags.start != "" || flags.repeat != "" || flags.dry || flags.diff) {
+		return errors.New("--export flag can't be set with other modes")
+	}
+	if flags.exportGraph != "" && flags.export == "" {
+		return errors.New("--export-graph flag requires --export")
+	}
+	c.exportFormat, err = parseExportFormat(flags.exportFormat)
+	if err != nil {
+		return err
+	}
+	c.exportFile = flags.export
+	c.exportGraphFile = flags.exportGraph
+	if flags.dry && flags.diff {
+		return errors.New("--dry and --diff flags can't be set together")
+	}
+	c.diffFormat, err = globomap.ParseDiffFormat(flags.diffFormat)
+	if err != nil {
+		return err
+	}
 
 	c.dry = flags.dry
+	c.diff = flags.diff
 	c.verbose = flags.verbose
-	if flags.load {
+	if c.verbose && c.logLevel > logger.Debug {
+		c.logLevel = logger.Debug
+	}
+	if syncCommand != nil {
+		env.cmd = syncCommand
+	} else if c.exportFile != "" {
+		env.cmd = &exportCmd{path: c.exportFile, graphPath: c.exportGraphFile, format: c.exportFormat}
+	} else if flags.load {
 		env.cmd = &loadCmd{}
+	} else if flags.reconcile {
+		env.cmd = &reconcileCmd{}
+	} else if flags.serve {
+		env.cmd = &serveCmd{}
+	} else if flags.webhook != "" {
+		env.cmd = &registerWebhookCmd{url: flags.webhook}
 	} else {
 		env.cmd = &updateCmd{}
 		c.repeat, err = c.parseTimeDuration(flags.repeat)
@@ -137,7 +448,7 @@ func (c *configParams) ProcessArguments(args []string) error {
 	if c.globomapApiHostname == "" {
 		return errors.New("GLOBOMAP_API_HOSTNAME is required")
 	}
-	if !c.dry && c.globomapLoaderHostname == "" {
+	if !c.dry && !c.diff && c.exportFile == "" && c.globomapLoaderHostname == "" {
 		return errors.New("GLOBOMAP_LOADER_HOSTNAME is required")
 	}
 	return nil
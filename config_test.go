@@ -8,6 +8,8 @@ import (
 	"os"
 	"time"
 
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
 	"gopkg.in/check.v1"
 )
 
@@ -94,6 +96,150 @@ func (s *S) TestConfigMaxRetries(c *check.C) {
 	c.Assert(config.maxRetries, check.Equals, 20)
 }
 
+func (s *S) TestConfigRetryQueue(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.retryWorkers, check.Equals, 4)
+	c.Assert(config.retryQueueSize, check.Equals, 1000)
+	c.Assert(config.retryQueueFile, check.Equals, "")
+
+	os.Setenv("RETRY_WORKERS", "2")
+	os.Setenv("RETRY_QUEUE_SIZE", "50")
+	os.Setenv("RETRY_QUEUE_FILE", "/var/lib/globomap/retry.json")
+	defer os.Unsetenv("RETRY_WORKERS")
+	defer os.Unsetenv("RETRY_QUEUE_SIZE")
+	defer os.Unsetenv("RETRY_QUEUE_FILE")
+	config = NewConfig()
+	c.Assert(config.retryWorkers, check.Equals, 2)
+	c.Assert(config.retryQueueSize, check.Equals, 50)
+	c.Assert(config.retryQueueFile, check.Equals, "/var/lib/globomap/retry.json")
+
+	os.Setenv("RETRY_WORKERS", "0")
+	os.Setenv("RETRY_QUEUE_SIZE", "invalid")
+	config = NewConfig()
+	c.Assert(config.retryWorkers, check.Equals, 4)
+	c.Assert(config.retryQueueSize, check.Equals, 1000)
+}
+
+func (s *S) TestConfigLog(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.logLevel, check.Equals, logger.Info)
+	c.Assert(config.logFormat, check.Equals, logger.Text)
+
+	os.Setenv("LOG_LEVEL", "error")
+	os.Setenv("LOG_FORMAT", "json")
+	defer os.Unsetenv("LOG_LEVEL")
+	defer os.Unsetenv("LOG_FORMAT")
+	config = NewConfig()
+	c.Assert(config.logLevel, check.Equals, logger.Error)
+	c.Assert(config.logFormat, check.Equals, logger.JSON)
+
+	err := config.ProcessArguments([]string{"--verbose"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.logLevel, check.Equals, logger.Debug)
+}
+
+func (s *S) TestConfigHealthTimeout(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.healthTimeout(), check.Equals, time.Duration(0))
+	err := config.ProcessArguments([]string{"--repeat", "1h"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.healthTimeout(), check.Equals, 3*time.Hour)
+
+	os.Setenv("HEALTHCHECK_TIMEOUT", "90m")
+	defer os.Unsetenv("HEALTHCHECK_TIMEOUT")
+	config = NewConfig()
+	c.Assert(config.healthTimeout(), check.Equals, 90*time.Minute)
+}
+
+func (s *S) TestConfigAdminAddress(c *check.C) {
+	os.Unsetenv("PORT")
+	config := NewConfig()
+	c.Assert(config.adminAddress(), check.Equals, "")
+	err := config.ProcessArguments([]string{"--repeat", "1h"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.adminAddress(), check.Equals, ":8080")
+
+	os.Setenv("METRICS_ADDRESS", ":9090")
+	defer os.Unsetenv("METRICS_ADDRESS")
+	config = NewConfig()
+	c.Assert(config.adminAddress(), check.Equals, ":9090")
+}
+
+func (s *S) TestConfigShutdownTimeout(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.shutdownTimeout, check.Equals, 30*time.Second)
+
+	os.Setenv("SHUTDOWN_TIMEOUT", "2m")
+	defer os.Unsetenv("SHUTDOWN_TIMEOUT")
+	config = NewConfig()
+	c.Assert(config.shutdownTimeout, check.Equals, 2*time.Minute)
+}
+
+func (s *S) TestConfigJobTimeout(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.jobTimeout, check.Equals, time.Duration(0))
+
+	os.Setenv("GLOBOMAP_JOB_TIMEOUT", "5m")
+	defer os.Unsetenv("GLOBOMAP_JOB_TIMEOUT")
+	config = NewConfig()
+	err := config.ProcessArguments(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.jobTimeout, check.Equals, 5*time.Minute)
+
+	os.Setenv("GLOBOMAP_JOB_TIMEOUT", "30s")
+	config = NewConfig()
+	err = config.ProcessArguments(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(config.jobTimeout, check.Equals, 30*time.Second)
+
+	os.Setenv("GLOBOMAP_JOB_TIMEOUT", "1d")
+	config = NewConfig()
+	err = config.ProcessArguments(nil)
+	c.Assert(err, check.ErrorMatches, "Invalid GLOBOMAP_JOB_TIMEOUT: 1d")
+}
+
+func (s *S) TestConfigPostRetry(c *check.C) {
+	os.Unsetenv("GLOBOMAP_POST_BACKOFF")
+	config := NewConfig()
+	c.Assert(config.postRetry.MaxAttempts, check.Equals, 3)
+	c.Assert(config.postRetry.InitialBackoff, check.Equals, time.Second)
+	c.Assert(config.postRetry.RetryableStatusCodes, check.DeepEquals, globomap.DefaultRetryableStatusCodes)
+
+	os.Setenv("GLOBOMAP_POST_MAX_ATTEMPTS", "5")
+	os.Setenv("GLOBOMAP_POST_BACKOFF", "2s")
+	os.Setenv("GLOBOMAP_POST_MAX_BACKOFF", "1m")
+	os.Setenv("GLOBOMAP_POST_BACKOFF_JITTER", "0.5")
+	os.Setenv("GLOBOMAP_POST_RETRYABLE_STATUS_CODES", "500, 503")
+	defer func() {
+		os.Unsetenv("GLOBOMAP_POST_MAX_ATTEMPTS")
+		os.Unsetenv("GLOBOMAP_POST_MAX_BACKOFF")
+		os.Unsetenv("GLOBOMAP_POST_BACKOFF_JITTER")
+		os.Unsetenv("GLOBOMAP_POST_RETRYABLE_STATUS_CODES")
+	}()
+	config = NewConfig()
+	c.Assert(config.postRetry, check.DeepEquals, globomap.RetryPolicy{
+		MaxAttempts:          5,
+		InitialBackoff:       2 * time.Second,
+		MaxBackoff:           time.Minute,
+		Jitter:               0.5,
+		RetryableStatusCodes: []int{500, 503},
+	})
+}
+
+func (s *S) TestConfigCompUnitMatchers(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.compUnitMatchers, check.DeepEquals, []string{"name"})
+	c.Assert(config.compUnitMetadataKeys, check.DeepEquals, []string{"hostname"})
+
+	os.Setenv("COMP_UNIT_MATCHERS", "name,metadata, ip")
+	os.Setenv("COMP_UNIT_METADATA_KEYS", "host,label")
+	defer os.Unsetenv("COMP_UNIT_MATCHERS")
+	defer os.Unsetenv("COMP_UNIT_METADATA_KEYS")
+	config = NewConfig()
+	c.Assert(config.compUnitMatchers, check.DeepEquals, []string{"name", "metadata", "ip"})
+	c.Assert(config.compUnitMetadataKeys, check.DeepEquals, []string{"host", "label"})
+}
+
 func (s *S) TestConfigInvalidRepeat(c *check.C) {
 	config := NewConfig()
 	err := config.ProcessArguments([]string{"--repeat", "foo"})
@@ -109,6 +255,69 @@ func (s *S) TestConfigLoad(c *check.C) {
 	c.Assert(env.cmd, check.FitsTypeOf, &loadCmd{})
 }
 
+func (s *S) TestConfigReconcile(c *check.C) {
+	config := NewConfig()
+	err := config.ProcessArguments([]string{"--reconcile"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.maxDeletePercent, check.Equals, float64(10))
+	c.Assert(env.cmd, check.FitsTypeOf, &reconcileCmd{})
+}
+
+func (s *S) TestConfigReconcileMaxDeletePercent(c *check.C) {
+	os.Setenv("RECONCILE_MAX_DELETE_PERCENT", "25.5")
+	defer os.Unsetenv("RECONCILE_MAX_DELETE_PERCENT")
+	config := NewConfig()
+	c.Assert(config.maxDeletePercent, check.Equals, 25.5)
+
+	os.Setenv("RECONCILE_MAX_DELETE_PERCENT", "150")
+	config = NewConfig()
+	c.Assert(config.maxDeletePercent, check.Equals, float64(10))
+}
+
+func (s *S) TestConfigServe(c *check.C) {
+	config := NewConfig()
+	err := config.ProcessArguments([]string{"--serve"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.listenAddress, check.Equals, ":8080")
+	c.Assert(env.cmd, check.FitsTypeOf, &serveCmd{})
+}
+
+func (s *S) TestConfigServeListenAddress(c *check.C) {
+	os.Setenv("PORT", "8888")
+	defer os.Unsetenv("PORT")
+	config := NewConfig()
+	c.Assert(config.listenAddress, check.Equals, ":8888")
+
+	os.Setenv("LISTEN_ADDRESS", "127.0.0.1:9999")
+	defer os.Unsetenv("LISTEN_ADDRESS")
+	config = NewConfig()
+	c.Assert(config.listenAddress, check.Equals, "127.0.0.1:9999")
+}
+
+func (s *S) TestConfigRegisterWebhook(c *check.C) {
+	config := NewConfig()
+	err := config.ProcessArguments([]string{"--register-webhook", "http://myhost"})
+	c.Assert(err, check.IsNil)
+	c.Assert(env.cmd, check.DeepEquals, &registerWebhookCmd{url: "http://myhost"})
+}
+
+func (s *S) TestConfigWebhookPath(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.webhookPath, check.Equals, "/")
+
+	os.Setenv("WEBHOOK_PATH", "webhook")
+	defer os.Unsetenv("WEBHOOK_PATH")
+	config = NewConfig()
+	c.Assert(config.webhookPath, check.Equals, "/webhook")
+}
+
+func (s *S) TestConfigServeRequiresWebhookSecret(c *check.C) {
+	os.Unsetenv("WEBHOOK_SECRET")
+	config := NewConfig()
+	err := config.ProcessArguments([]string{"--serve"})
+	c.Assert(err, check.NotNil)
+}
+
 func (s *S) TestConfigIncompatibleFlags(c *check.C) {
 	config := NewConfig()
 	err := config.ProcessArguments([]string{"--load", "--start", "2h"})
@@ -119,6 +328,21 @@ func (s *S) TestConfigIncompatibleFlags(c *check.C) {
 
 	err = config.ProcessArguments([]string{"--start", "1d", "--repeat", "30m"})
 	c.Assert(err, check.NotNil)
+
+	err = config.ProcessArguments([]string{"--reconcile", "--load"})
+	c.Assert(err, check.NotNil)
+
+	err = config.ProcessArguments([]string{"--reconcile", "--repeat", "10m"})
+	c.Assert(err, check.NotNil)
+
+	err = config.ProcessArguments([]string{"--serve", "--load"})
+	c.Assert(err, check.NotNil)
+
+	err = config.ProcessArguments([]string{"--serve", "--start", "1h"})
+	c.Assert(err, check.NotNil)
+
+	err = config.ProcessArguments([]string{"--register-webhook", "http://myhost", "--serve"})
+	c.Assert(err, check.NotNil)
 }
 
 func (s *S) TestConfigMissingEnvVars(c *check.C) {
@@ -145,3 +369,102 @@ func (s *S) TestConfigMissingEnvVars(c *check.C) {
 	err = config.ProcessArguments([]string{"--dry"})
 	c.Assert(err, check.IsNil)
 }
+
+func (s *S) TestConfigLeaderElection(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.leaderElection, check.Equals, "")
+	c.Assert(config.leaderLeaseTTL, check.Equals, 30*time.Second)
+
+	os.Setenv("LEADER_ELECTION", "http")
+	os.Setenv("LEADER_LEASE_URL", "http://localhost:8500/lease")
+	os.Setenv("LEADER_LEASE_TTL", "15s")
+	os.Setenv("LEADER_ID", "worker-1")
+	defer func() {
+		os.Unsetenv("LEADER_ELECTION")
+		os.Unsetenv("LEADER_LEASE_URL")
+		os.Unsetenv("LEADER_LEASE_TTL")
+		os.Unsetenv("LEADER_ID")
+	}()
+	config = NewConfig()
+	c.Assert(config.leaderElection, check.Equals, "http")
+	c.Assert(config.leaderLeaseURL, check.Equals, "http://localhost:8500/lease")
+	c.Assert(config.leaderLeaseTTL, check.Equals, 15*time.Second)
+	c.Assert(config.leaderID, check.Equals, "worker-1")
+}
+
+func (s *S) TestConfigSync(c *check.C) {
+	config := NewConfig()
+	err := config.ProcessArguments([]string{"--dry", "sync", "app", "myapp"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.dry, check.Equals, true)
+	c.Assert(env.cmd, check.DeepEquals, &syncCmd{entity: "app", name: "myapp"})
+
+	err = config.ProcessArguments([]string{"sync", "app", "myapp", "--load"})
+	c.Assert(err, check.ErrorMatches, "sync command can't be set with other modes")
+
+	err = config.ProcessArguments([]string{"sync", "app"})
+	c.Assert(err, check.NotNil)
+
+	err = config.ProcessArguments([]string{"export"})
+	c.Assert(err, check.ErrorMatches, "Unknown command: export")
+}
+
+func (s *S) TestConfigDiff(c *check.C) {
+	os.Unsetenv("GLOBOMAP_LOADER_HOSTNAME")
+	config := NewConfig()
+	err := config.ProcessArguments([]string{"--load", "--diff"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.diff, check.Equals, true)
+	c.Assert(config.diffFormat, check.Equals, globomap.DiffText)
+
+	err = config.ProcessArguments([]string{"--load", "--diff", "--diff-format", "json"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.diffFormat, check.Equals, globomap.DiffJSON)
+
+	err = config.ProcessArguments([]string{"--diff", "--diff-format", "yaml"})
+	c.Assert(err, check.ErrorMatches, `invalid diff format: "yaml"`)
+
+	err = config.ProcessArguments([]string{"--diff", "--dry"})
+	c.Assert(err, check.ErrorMatches, "--dry and --diff flags can't be set together")
+}
+
+func (s *S) TestConfigHashState(c *check.C) {
+	config := NewConfig()
+	c.Assert(config.hashStateFile, check.Equals, "")
+	c.Assert(config.hashMaxAge, check.Equals, 24*time.Hour)
+
+	os.Setenv("HASH_STATE_FILE", "/var/lib/globomap/hashes.json")
+	os.Setenv("HASH_MAX_AGE", "7d")
+	defer func() {
+		os.Unsetenv("HASH_STATE_FILE")
+		os.Unsetenv("HASH_MAX_AGE")
+	}()
+	config = NewConfig()
+	c.Assert(config.hashStateFile, check.Equals, "/var/lib/globomap/hashes.json")
+	c.Assert(config.hashMaxAge, check.Equals, 7*24*time.Hour)
+}
+
+func (s *S) TestConfigExport(c *check.C) {
+	os.Unsetenv("GLOBOMAP_LOADER_HOSTNAME")
+	config := NewConfig()
+	err := config.ProcessArguments([]string{"--export", "/tmp/tsuru.ndjson"})
+	c.Assert(err, check.IsNil)
+	c.Assert(config.exportFile, check.Equals, "/tmp/tsuru.ndjson")
+	c.Assert(env.cmd, check.DeepEquals, &exportCmd{path: "/tmp/tsuru.ndjson", format: exportDOT})
+
+	err = config.ProcessArguments([]string{"--export", "/tmp/tsuru.ndjson", "--export-graph", "/tmp/tsuru.xml", "--export-format", "graphml"})
+	c.Assert(err, check.IsNil)
+	c.Assert(env.cmd, check.DeepEquals, &exportCmd{path: "/tmp/tsuru.ndjson", graphPath: "/tmp/tsuru.xml", format: exportGraphML})
+
+	err = config.ProcessArguments([]string{"--export-graph", "/tmp/tsuru.dot"})
+	c.Assert(err, check.ErrorMatches, "--export-graph flag requires --export")
+
+	err = config.ProcessArguments([]string{"--export", "/tmp/tsuru.ndjson", "--export-graph", "/tmp/tsuru.xml", "--export-format", "xml"})
+	c.Assert(err, check.ErrorMatches, "Invalid export format: xml")
+
+	err = config.ProcessArguments([]string{"--export", "/tmp/tsuru.ndjson", "--load"})
+	c.Assert(err, check.ErrorMatches, "--export flag can't be set with other modes")
+
+	err = config.ProcessArguments([]string{"--export", "/tmp/tsuru.ndjson", "--dry"})
+	c.Assert(err, check.ErrorMatches, "--export flag can't be set with other modes")
+}
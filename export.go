@@ -0,0 +1,85 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+
+	"github.com/tsuru/globomap-integration/logger"
+)
+
+// exportCmd runs the load pipeline, writing the payloads as NDJSON to a
+// file sink instead of posting them to globomap loader. When graphPath is
+// set, a DOT or GraphML rendering of the payloads is written to it too.
+type exportCmd struct {
+	path      string
+	graphPath string
+	format    exportFormat
+}
+
+// exportFile is a buffered file created by the export mode.
+type exportFile struct {
+	f *os.File
+	*bufio.Writer
+}
+
+func createExportFile(path string) (*exportFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &exportFile{f: f, Writer: bufio.NewWriter(f)}, nil
+}
+
+func (f *exportFile) finish() error {
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	return f.f.Sync()
+}
+
+func (c *exportCmd) Run(ctx context.Context) {
+	log := env.log.With(logger.Fields{"path": c.path})
+	out, err := createExportFile(c.path)
+	if err != nil {
+		log.WithField("error", err).Errorf("error creating export file")
+		return
+	}
+	defer out.f.Close()
+	var graph *exportFile
+	var graphWriter io.Writer
+	if c.graphPath != "" {
+		log = log.With(logger.Fields{"graph": c.graphPath, "format": string(c.format)})
+		graph, err = createExportFile(c.graphPath)
+		if err != nil {
+			log.WithField("error", err).Errorf("error creating export graph file")
+			return
+		}
+		defer graph.f.Close()
+		graphWriter = graph
+	}
+	s := newFileSink(out, graphWriter, c.format)
+	previous := env.sink
+	env.sink = s
+	defer func() { env.sink = previous }()
+
+	load := &loadCmd{}
+	load.Run(ctx)
+
+	if err = s.Close(); err == nil {
+		err = out.finish()
+	}
+	if err == nil && graph != nil {
+		err = graph.finish()
+	}
+	if err != nil {
+		log.WithField("error", err).Errorf("error writing export file")
+		return
+	}
+	log.Infof("exported %d documents", s.Count())
+}
@@ -6,6 +6,7 @@ package globomap
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,12 +14,16 @@ import (
 	"io/ioutil"
 	"math"
 	"net/http"
-	"net/url"
+	"os"
+	"sync"
 	"time"
 
+	"github.com/tsuru/globomap-integration/logger"
 	tsuruErrors "github.com/tsuru/tsuru/errors"
 )
 
+var defaultLogger = logger.New(os.Stdout, logger.Info, logger.Text)
+
 type PayloadType string
 
 const (
@@ -35,10 +40,40 @@ type Client struct {
 	// ChunckInterval controls the interval between each chunk of updates
 	// sent to the Globomap Loader.
 	ChunkInterval time.Duration
-	Verbose       bool
 	Dry           bool
 
-	token *token
+	// Logger receives the client messages, including the payloads posted
+	// in dry mode. Messages are written to stdout when it's nil.
+	Logger *logger.Logger
+
+	// Context, when set, cancels queries, job polling and waits between
+	// retries and chunks. A chunk already being posted is finished, but no
+	// new chunk is posted after the context is done.
+	Context context.Context
+	ctxMu   sync.Mutex
+
+	// JobTimeout enables polling the loader job of each posted chunk,
+	// waiting up to the given duration for it to complete.
+	JobTimeout      time.Duration
+	JobPollInterval time.Duration
+
+	// Retry is applied to each chunk of updates. A nil policy disables
+	// retries.
+	Retry *RetryPolicy
+
+	// ChunkObserver, when set, is called after each chunk is posted with
+	// the number of payloads accepted and rejected by the loader.
+	ChunkObserver func(posted, failed int)
+
+	// DiffOutput, when set, makes Post compare the payloads with the
+	// documents stored in globomap API and write the differences to it in
+	// DiffFormat, instead of posting them.
+	DiffOutput io.Writer
+	DiffFormat DiffFormat
+
+	tokens tokenManager
+	// diffMu serializes the diffs written by concurrent posts.
+	diffMu sync.Mutex
 }
 
 type Payload struct {
@@ -57,6 +92,7 @@ type QueryFields struct {
 
 type QueryResult struct {
 	Id         string `json:"_id"`
+	Key        string `json:"_key"`
 	Name       string
 	Properties Properties
 }
@@ -75,17 +111,23 @@ type authRequest struct {
 	Password string `json:"password"`
 }
 
-type token struct {
-	Token string `json:"token"`
-}
-
-func (g *Client) Post(payload []Payload) error {
+func (g *Client) Post(payload []Payload) (*PostResult, error) {
+	result := &PostResult{}
+	if g.DiffOutput != nil {
+		return result, g.writeDiff(payload, result)
+	}
 	if err := g.auth(g.LoaderHostname); err != nil {
-		return fmt.Errorf("failed to authenticate with globomap loader: %v", err)
+		err = fmt.Errorf("failed to authenticate with globomap loader: %v", err)
+		result.fail(payload, err)
+		return result, err
 	}
 	maxPayloadItems := 100
 	if len(payload) <= maxPayloadItems {
-		return g.post(payload)
+		if err := g.ctx().Err(); err != nil {
+			result.fail(payload, err)
+			return result, err
+		}
+		return result, g.postChunk(payload, result)
 	}
 
 	chunks := int(math.Ceil(float64(len(payload)) / float64(maxPayloadItems)))
@@ -96,27 +138,48 @@ func (g *Client) Post(payload []Payload) error {
 		if end > len(payload) {
 			end = len(payload)
 		}
-
-		if g.Verbose {
-			fmt.Printf("Posting chunk %d/%d\n", i+1, chunks)
+		if err := g.ctx().Err(); err != nil {
+			result.fail(payload[start:], err)
+			errs.Add(err)
+			break
 		}
-		err := g.post(payload[start:end])
+
+		g.log().Debugf("posting chunk %d/%d", i+1, chunks)
+		err := g.postChunk(payload[start:end], result)
 		if err != nil {
 			errs.Add(err)
 		}
-		time.Sleep(g.ChunkInterval)
+		if end < len(payload) {
+			g.sleep(g.ChunkInterval)
+		}
 	}
 
 	if errs.Len() > 0 {
-		return errs
+		return result, errs
 	}
-	return nil
+	return result, nil
 }
 
-func (g *Client) Query(f QueryFields) (*QueryResult, error) {
-	if err := g.auth(g.ApiHostname); err != nil {
-		return nil, fmt.Errorf("failed to authenticate with globomap API: %v", err)
+func (g *Client) postChunk(payload []Payload, result *PostResult) error {
+	if g.ChunkObserver != nil {
+		failedBefore := len(result.Failed)
+		defer func() {
+			failed := len(result.Failed) - failedBefore
+			g.ChunkObserver(len(payload)-failed, failed)
+		}()
+	}
+	jobID, err := g.postWithRetry(payload)
+	if err != nil {
+		result.fail(payload, err)
+		return err
 	}
+	if jobID != "" {
+		result.JobIDs = append(result.JobIDs, jobID)
+	}
+	return g.checkJob(jobID, payload, result)
+}
+
+func (g *Client) Query(f QueryFields) (*QueryResult, error) {
 	results, err := g.queryByName(f.Collection, f.Name)
 	if err != nil {
 		return nil, err
@@ -134,82 +197,95 @@ func (g *Client) Query(f QueryFields) (*QueryResult, error) {
 	return nil, nil
 }
 
-func (g *Client) auth(addr string) error {
-	if g.Username == "" && g.Password == "" {
-		return nil
-	}
-	g.token = new(token)
-	req := authRequest{Username: g.Username, Password: g.Password}
-	buf := new(bytes.Buffer)
-	if err := json.NewEncoder(buf).Encode(req); err != nil {
-		return err
-	}
-	resp, err := g.doPost(addr, "/v2/auth/", buf)
-	if err != nil {
-		return err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected response code for auth: %v", resp.StatusCode)
-	}
-
-	return json.NewDecoder(resp.Body).Decode(g.token)
+// List returns every document stored in the given collection or edge,
+// walking through all the pages returned by globomap API.
+func (g *Client) List(collection string, t PayloadType) ([]QueryResult, error) {
+	return g.QueryAll(NewQuery(collection).Type(t))
 }
 
-func (g *Client) post(payload []Payload) error {
+func (g *Client) post(payload []Payload) (string, error) {
 	path := "/v1/updates"
-	if g.Username != "" || g.Password != "" {
+	if g.hasCredentials() {
 		path = "/v2/updates/"
 	}
 	body := g.body(payload)
 	if body == nil {
-		return errors.New("No events to post")
+		return "", errors.New("No events to post")
 	}
 	resp, err := g.doPost(g.LoaderHostname, path, body)
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusAccepted {
-		return errors.New(resp.Status)
+		return "", &statusError{code: resp.StatusCode, status: resp.Status}
 	}
 
 	if g.Dry {
-		return nil
+		return "", nil
 	}
 
 	decoder := json.NewDecoder(resp.Body)
 	var data response
 	err = decoder.Decode(&data)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer resp.Body.Close()
-	fmt.Println(&data)
-	return nil
+	g.log().With(logger.Fields{"job_id": data.JobID, "count": len(payload)}).Infof("posted to globomap loader: %s", data.Message)
+	return data.JobID, nil
 }
 
-func (g *Client) queryByName(collection, name string) ([]QueryResult, error) {
-	path := "/v1/collections"
-	if g.Username != "" || g.Password != "" {
-		path = "/v2/collections"
+// SetContext replaces Context while the client may be in use.
+func (g *Client) SetContext(ctx context.Context) {
+	g.ctxMu.Lock()
+	defer g.ctxMu.Unlock()
+	g.Context = ctx
+}
+
+func (g *Client) ctx() context.Context {
+	g.ctxMu.Lock()
+	defer g.ctxMu.Unlock()
+	if g.Context == nil {
+		return context.Background()
 	}
-	query := fmt.Sprintf(`[[{"field":"name","value":"%s","operator":"=="}]]`, name)
-	path = fmt.Sprintf("%s/%s/?query=%s", path, collection, url.PathEscape(query))
-	resp, err := http.Get(g.ApiHostname + path)
-	if err != nil {
-		return nil, err
+	return g.Context
+}
+
+// sleep waits for the given duration, returning early with an error when
+// the client context is done.
+func (g *Client) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-g.ctx().Done():
+		return g.ctx().Err()
 	}
+}
 
-	decoder := json.NewDecoder(resp.Body)
-	var data struct {
-		Documents []QueryResult
+func (g *Client) log() *logger.Logger {
+	if g.Logger == nil {
+		return defaultLogger
 	}
-	err = decoder.Decode(&data)
+	return g.Logger
+}
+
+func (g *Client) queryByName(collection, name string) ([]QueryResult, error) {
+	return g.QueryAll(NewQuery(collection).And(Cond("name", OpEqual, name)))
+}
+
+func (g *Client) doGet(addr, path string) (*http.Response, error) {
+	client := &http.Client{}
+	req, err := http.NewRequest(http.MethodGet, addr+path, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	return data.Documents, nil
+	req = req.WithContext(g.ctx())
+	if err = g.authorize(req, addr); err != nil {
+		return nil, err
+	}
+	return client.Do(req)
 }
 
 func (g *Client) doPost(addr, path string, body io.Reader) (*http.Response, error) {
@@ -218,8 +294,8 @@ func (g *Client) doPost(addr, path string, body io.Reader) (*http.Response, erro
 	if err != nil {
 		return nil, err
 	}
-	if g.token != nil {
-		req.Header.Add("Authorization", fmt.Sprintf("Token token=%s", g.token.Token))
+	if err = g.authorize(req, addr); err != nil {
+		return nil, err
 	}
 	req.Header.Add("x-driver-name", "tsuru")
 	req.Header.Add("Content-Type", "application/json")
@@ -228,10 +304,11 @@ func (g *Client) doPost(addr, path string, body io.Reader) (*http.Response, erro
 		if err != nil {
 			return nil, err
 		}
-		fmt.Println(string(data))
+		g.log().WithField("payload", json.RawMessage(data)).Infof("dry mode, not posting to %s", addr+path)
 		resp := &http.Response{
-			StatusCode: http.StatusOK,
-			Status:     "OK",
+			StatusCode: http.StatusAccepted,
+			Status:     "202 Accepted",
+			Body:       http.NoBody,
 		}
 		return resp, nil
 	}
@@ -244,7 +321,7 @@ func (g *Client) body(data []Payload) io.Reader {
 	}
 	b, err := json.Marshal(data)
 	if err != nil {
-		fmt.Println(err)
+		g.log().Errorf("failed to encode payload: %s", err)
 		return nil
 	}
 	return bytes.NewReader(b)
@@ -5,6 +5,7 @@
 package globomap
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"gopkg.in/check.v1"
 )
@@ -37,7 +39,7 @@ func (s *S) TestPost(c *check.C) {
 	}
 
 	payload := []Payload{{}}
-	err := client.Post(payload)
+	_, err := client.Post(payload)
 	c.Assert(err, check.IsNil)
 }
 
@@ -73,7 +75,7 @@ func (s *S) TestPostWithCredentials(c *check.C) {
 	}
 
 	payload := []Payload{{}}
-	err := client.Post(payload)
+	_, err := client.Post(payload)
 	c.Assert(err, check.IsNil)
 	c.Assert(auth, check.Equals, true)
 	c.Assert(update, check.Equals, true)
@@ -111,7 +113,7 @@ func (s *S) TestPostInChunks(c *check.C) {
 	for i := 0; i <= 100; i++ {
 		payload[i] = Payload{Key: fmt.Sprintf("k%d", i)}
 	}
-	err := client.Post(payload)
+	_, err := client.Post(payload)
 	c.Assert(err, check.IsNil)
 	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(2))
 }
@@ -152,11 +154,190 @@ func (s *S) TestPostInChunksWithErrors(c *check.C) {
 		payload[i] = Payload{Key: fmt.Sprintf("k%d", i)}
 	}
 
-	err := client.Post(payload)
+	_, err := client.Post(payload)
 	c.Assert(err, check.NotNil)
 	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(3))
 }
 
+func (s *S) TestPostInChunksWithErrorsReturnsFailedPayloads(c *check.C) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		count := atomic.AddInt32(&requests, 1)
+		if count == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response{JobID: "2", Message: "ok"})
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname: server.URL,
+	}
+
+	payload := make([]Payload, 101)
+	for i := 0; i <= 100; i++ {
+		payload[i] = Payload{Key: fmt.Sprintf("k%d", i)}
+	}
+	result, err := client.Post(payload)
+	c.Assert(err, check.NotNil)
+	c.Assert(result.JobIDs, check.DeepEquals, []string{"2"})
+	c.Assert(result.FailedPayloads(), check.DeepEquals, payload[:100])
+}
+
+func (s *S) TestPostCallsChunkObserver(c *check.C) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response{JobID: "2", Message: "ok"})
+	}))
+	defer server.Close()
+	var chunks [][2]int
+	client := Client{
+		LoaderHostname: server.URL,
+		ChunkObserver: func(posted, failed int) {
+			chunks = append(chunks, [2]int{posted, failed})
+		},
+	}
+
+	payload := make([]Payload, 101)
+	for i := 0; i <= 100; i++ {
+		payload[i] = Payload{Key: fmt.Sprintf("k%d", i)}
+	}
+	client.Post(payload)
+	c.Assert(chunks, check.DeepEquals, [][2]int{{0, 100}, {1, 0}})
+}
+
+func (s *S) TestPostStopsWhenContextIsCancelled(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		cancel()
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response{JobID: "1", Message: "ok"})
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname: server.URL,
+		ChunkInterval:  time.Minute,
+		Context:        ctx,
+	}
+
+	payload := make([]Payload, 201)
+	for i := 0; i <= 200; i++ {
+		payload[i] = Payload{Key: fmt.Sprintf("k%d", i)}
+	}
+	result, err := client.Post(payload)
+	c.Assert(err, check.NotNil)
+	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(1))
+	c.Assert(result.JobIDs, check.DeepEquals, []string{"1"})
+	c.Assert(result.FailedPayloads(), check.DeepEquals, payload[100:])
+}
+
+func (s *S) TestPostSingleChunkWhenContextIsCancelled(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client := Client{LoaderHostname: server.URL, Context: ctx}
+
+	payload := []Payload{{Key: "k1"}}
+	result, err := client.Post(payload)
+	c.Assert(err, check.Equals, context.Canceled)
+	c.Assert(result.FailedPayloads(), check.DeepEquals, payload)
+}
+
+func (s *S) TestPostWaitsForJob(c *check.C) {
+	var statusRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/updates":
+			c.Assert(r.Method, check.Equals, http.MethodPost)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(response{JobID: "job1", Message: "ok"})
+		case "/v1/updates/job1":
+			c.Assert(r.Method, check.Equals, http.MethodGet)
+			count := atomic.AddInt32(&statusRequests, 1)
+			json.NewEncoder(w).Encode(jobStatus{Completed: count > 1})
+		default:
+			c.Fatalf("Invalid request path called: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname:  server.URL,
+		JobTimeout:      time.Second,
+		JobPollInterval: time.Millisecond,
+	}
+
+	result, err := client.Post([]Payload{{Collection: "tsuru_app", Key: "tsuru_app1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(result.JobIDs, check.DeepEquals, []string{"job1"})
+	c.Assert(result.Failed, check.HasLen, 0)
+	c.Assert(atomic.LoadInt32(&statusRequests), check.Equals, int32(2))
+}
+
+func (s *S) TestPostJobWithErrors(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/updates":
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(response{JobID: "job1", Message: "ok"})
+		case "/v1/updates/job1":
+			json.NewEncoder(w).Encode(jobStatus{
+				Completed:  true,
+				ErrorCount: 1,
+				Errors:     []jobError{{Collection: "tsuru_app", Key: "tsuru_app2", Error: "invalid document"}},
+			})
+		}
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname:  server.URL,
+		JobTimeout:      time.Second,
+		JobPollInterval: time.Millisecond,
+	}
+
+	payload := []Payload{
+		{Collection: "tsuru_app", Key: "tsuru_app1"},
+		{Collection: "tsuru_app", Key: "tsuru_app2"},
+	}
+	result, err := client.Post(payload)
+	c.Assert(err, check.NotNil)
+	c.Assert(result.Failed, check.DeepEquals, []FailedPayload{{Payload: payload[1], Error: "invalid document"}})
+	c.Assert(result.FailedPayloads(), check.DeepEquals, payload[1:])
+}
+
+func (s *S) TestPostJobTimeout(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/updates":
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(response{JobID: "job1", Message: "ok"})
+		case "/v1/updates/job1":
+			json.NewEncoder(w).Encode(jobStatus{Completed: false})
+		}
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname:  server.URL,
+		JobTimeout:      50 * time.Millisecond,
+		JobPollInterval: 10 * time.Millisecond,
+	}
+
+	payload := []Payload{{Collection: "tsuru_app", Key: "tsuru_app1"}}
+	result, err := client.Post(payload)
+	c.Assert(err, check.ErrorMatches, "timeout waiting for job job1")
+	c.Assert(result.FailedPayloads(), check.DeepEquals, payload)
+}
+
 func (s *S) TestPostNoContent(c *check.C) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c.ExpectFailure("No request should have been done")
@@ -166,7 +347,7 @@ func (s *S) TestPostNoContent(c *check.C) {
 		LoaderHostname: server.URL,
 	}
 
-	err := client.Post([]Payload{})
+	_, err := client.Post([]Payload{})
 	c.Assert(err, check.ErrorMatches, "No events to post")
 }
 
@@ -298,6 +479,54 @@ func (s *S) TestGlobomapQueryReturnsWhenOneResultWithoutIP(c *check.C) {
 	c.Assert(result.Name, check.Equals, "vm-1234")
 }
 
+func (s *S) TestGlobomapList(c *check.C) {
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.Method, check.Equals, http.MethodGet)
+		c.Assert(req.URL.Path, check.Equals, "/v1/edges/tsuru_pool_app/")
+		c.Assert(req.FormValue("per_page"), check.Equals, "100")
+		page := req.FormValue("page")
+		pages = append(pages, page)
+
+		var docs []QueryResult
+		switch page {
+		case "1":
+			docs = []QueryResult{{Id: "tsuru_pool_app/tsuru_app1-pool", Key: "tsuru_app1-pool"}}
+		case "2":
+			docs = []QueryResult{{Id: "tsuru_pool_app/tsuru_app2-pool", Key: "tsuru_app2-pool"}}
+		}
+		json.NewEncoder(w).Encode(struct {
+			Documents  []QueryResult
+			TotalPages int `json:"total_pages"`
+		}{docs, 2})
+	}))
+	defer server.Close()
+	client := Client{
+		ApiHostname: server.URL,
+	}
+
+	result, err := client.List("tsuru_pool_app", PayloadTypeEdge)
+	c.Assert(err, check.IsNil)
+	c.Assert(pages, check.DeepEquals, []string{"1", "2"})
+	c.Assert(result, check.HasLen, 2)
+	c.Assert(result[0].Key, check.Equals, "tsuru_app1-pool")
+	c.Assert(result[1].Key, check.Equals, "tsuru_app2-pool")
+}
+
+func (s *S) TestGlobomapListError(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client := Client{
+		ApiHostname: server.URL,
+	}
+
+	result, err := client.List("tsuru_app", PayloadTypeCollection)
+	c.Assert(err, check.NotNil)
+	c.Assert(result, check.IsNil)
+}
+
 func (s *S) TestGlobomapResponseString(c *check.C) {
 	r := response{
 		JobID:   "12345",
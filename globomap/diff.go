@@ -0,0 +1,289 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/globomap-integration/logger"
+)
+
+type DiffFormat string
+
+const (
+	DiffText = DiffFormat("text")
+	DiffJSON = DiffFormat("json")
+)
+
+// Status of a document compared with the payload that would be posted.
+const (
+	DiffCreate        = "create"
+	DiffUpdate        = "update"
+	DiffUnchanged     = "unchanged"
+	DiffDelete        = "delete"
+	DiffDeleteMissing = "delete_missing"
+)
+
+// Kinds of field changes.
+const (
+	FieldAdded   = "added"
+	FieldRemoved = "removed"
+	FieldChanged = "changed"
+)
+
+// DocumentDiff describes how posting a payload would change the document
+// stored in globomap.
+type DocumentDiff struct {
+	Collection string        `json:"collection"`
+	Type       PayloadType   `json:"type"`
+	Key        string        `json:"key"`
+	Status     string        `json:"status"`
+	Changes    []FieldChange `json:"changes,omitempty"`
+}
+
+// FieldChange is a difference in a single field, named by its path in the
+// document, like properties.description.
+type FieldChange struct {
+	Field string      `json:"field"`
+	Kind  string      `json:"kind"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+}
+
+// ParseDiffFormat returns the diff format with the given name.
+func ParseDiffFormat(name string) (DiffFormat, error) {
+	switch f := DiffFormat(strings.ToLower(name)); f {
+	case DiffText, DiffJSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid diff format: %q", name)
+}
+
+// Get returns the document stored with the given key, or nil when there's
+// no such document.
+func (g *Client) Get(collection string, t PayloadType, key string) (map[string]interface{}, error) {
+	if err := g.auth(g.ApiHostname); err != nil {
+		return nil, fmt.Errorf("failed to authenticate with globomap API: %v", err)
+	}
+	apiVersion := "v1"
+	if g.hasCredentials() {
+		apiVersion = "v2"
+	}
+	resp, err := g.doGet(g.ApiHostname, fmt.Sprintf("/%s/%s/%s/%s", apiVersion, t, collection, key))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code fetching %s/%s: %v", collection, key, resp.StatusCode)
+	}
+	var document map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&document)
+	return document, err
+}
+
+// Diff compares each payload with the document stored in globomap API.
+// Unchanged documents are included, with no changes.
+func (g *Client) Diff(payload []Payload) ([]DocumentDiff, error) {
+	diffs := make([]DocumentDiff, 0, len(payload))
+	for _, p := range payload {
+		if err := g.ctx().Err(); err != nil {
+			return diffs, err
+		}
+		current, err := g.Get(p.Collection, p.Type, p.Key)
+		if err != nil {
+			return diffs, err
+		}
+		diff, err := DiffDocument(p, current)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+func (g *Client) writeDiff(payload []Payload, result *PostResult) error {
+	diffs, err := g.Diff(payload)
+	if err != nil {
+		err = fmt.Errorf("failed to diff documents: %v", err)
+		result.fail(payload[len(diffs):], err)
+	}
+	// the diffs are written at once, so the lines of each document aren't
+	// mixed with the ones written by concurrent posts
+	var buf bytes.Buffer
+	writeErr := WriteDiffs(&buf, g.DiffFormat, diffs)
+	if writeErr == nil {
+		g.diffMu.Lock()
+		_, writeErr = g.DiffOutput.Write(buf.Bytes())
+		g.diffMu.Unlock()
+	}
+	if writeErr != nil {
+		return fmt.Errorf("failed to write diff: %v", writeErr)
+	}
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Status]++
+	}
+	g.log().With(logger.Fields{
+		DiffCreate:    counts[DiffCreate],
+		DiffUpdate:    counts[DiffUpdate],
+		DiffUnchanged: counts[DiffUnchanged],
+		DiffDelete:    counts[DiffDelete] + counts[DiffDeleteMissing],
+	}).Infof("compared %d documents with globomap API", len(diffs))
+	return nil
+}
+
+// DiffDocument compares a payload with the current document, which is nil
+// when it doesn't exist. The timestamp and the fields set by globomap, like
+// _id and _rev, are ignored, except the _from and _to ends of edges.
+func DiffDocument(p Payload, current map[string]interface{}) (DocumentDiff, error) {
+	diff := DocumentDiff{Collection: p.Collection, Type: p.Type, Key: p.Key}
+	if p.Action == "DELETE" {
+		diff.Status = DiffDelete
+		if current == nil {
+			diff.Status = DiffDeleteMissing
+		}
+		return diff, nil
+	}
+	// round trips the element, so its values have the same types as the
+	// decoded document
+	data, err := json.Marshal(p.Element)
+	if err != nil {
+		return diff, err
+	}
+	var element map[string]interface{}
+	if err = json.Unmarshal(data, &element); err != nil {
+		return diff, err
+	}
+	if p.Type == PayloadTypeEdge {
+		// globomap stores the edge ends as _from and _to
+		for _, end := range []string{"from", "to"} {
+			if v, ok := element[end]; ok {
+				delete(element, end)
+				element["_"+end] = v
+			}
+		}
+	}
+	if current == nil {
+		diff.Status = DiffCreate
+		current = map[string]interface{}{}
+	}
+	diff.Changes = diffFields("", current, element)
+	if diff.Status == "" {
+		diff.Status = DiffUpdate
+		if len(diff.Changes) == 0 {
+			diff.Status = DiffUnchanged
+		}
+	}
+	return diff, nil
+}
+
+func diffFields(prefix string, old, new map[string]interface{}) []FieldChange {
+	keys := make(map[string]struct{})
+	for k := range old {
+		keys[k] = struct{}{}
+	}
+	for k := range new {
+		keys[k] = struct{}{}
+	}
+	names := make([]string, 0, len(keys))
+	for k := range keys {
+		if prefix == "" && (k == "timestamp" || (strings.HasPrefix(k, "_") && k != "_from" && k != "_to")) {
+			continue
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var changes []FieldChange
+	for _, k := range names {
+		field := prefix + k
+		oldValue, inOld := old[k]
+		newValue, inNew := new[k]
+		switch {
+		case !inOld:
+			changes = append(changes, FieldChange{Field: field, Kind: FieldAdded, New: newValue})
+		case !inNew:
+			changes = append(changes, FieldChange{Field: field, Kind: FieldRemoved, Old: oldValue})
+		default:
+			oldMap, oldIsMap := oldValue.(map[string]interface{})
+			newMap, newIsMap := newValue.(map[string]interface{})
+			if oldIsMap && newIsMap {
+				changes = append(changes, diffFields(field+".", oldMap, newMap)...)
+			} else if !reflect.DeepEqual(oldValue, newValue) {
+				changes = append(changes, FieldChange{Field: field, Kind: FieldChanged, Old: oldValue, New: newValue})
+			}
+		}
+	}
+	return changes
+}
+
+// WriteDiffs writes the diffs in the given format. The text format skips
+// unchanged documents, while the JSON format writes one diff per line.
+func WriteDiffs(w io.Writer, format DiffFormat, diffs []DocumentDiff) error {
+	if format == DiffJSON {
+		encoder := json.NewEncoder(w)
+		for _, d := range diffs {
+			if err := encoder.Encode(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, d := range diffs {
+		var err error
+		name := d.Collection + "/" + d.Key
+		switch d.Status {
+		case DiffUnchanged:
+			continue
+		case DiffCreate:
+			_, err = fmt.Fprintf(w, "+ %s (missing, would be created)\n", name)
+		case DiffUpdate:
+			_, err = fmt.Fprintf(w, "~ %s\n", name)
+		case DiffDelete:
+			_, err = fmt.Fprintf(w, "- %s (would be deleted)\n", name)
+		case DiffDeleteMissing:
+			_, err = fmt.Fprintf(w, "- %s (would be deleted, but is missing)\n", name)
+		}
+		if err != nil {
+			return err
+		}
+		for _, c := range d.Changes {
+			switch c.Kind {
+			case FieldAdded:
+				_, err = fmt.Fprintf(w, "    + %s: %s\n", c.Field, formatDiffValue(c.New))
+			case FieldRemoved:
+				_, err = fmt.Fprintf(w, "    - %s: %s\n", c.Field, formatDiffValue(c.Old))
+			case FieldChanged:
+				_, err = fmt.Fprintf(w, "    ~ %s: %s => %s\n", c.Field, formatDiffValue(c.Old), formatDiffValue(c.New))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatDiffValue(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
@@ -0,0 +1,220 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestDiffDocument(c *check.C) {
+	payload := Payload{
+		Action:     "UPDATE",
+		Collection: "tsuru_app",
+		Type:       PayloadTypeCollection,
+		Key:        "tsuru_myapp",
+		Element: map[string]interface{}{
+			"name":      "myapp",
+			"timestamp": 1500000100,
+			"properties": map[string]interface{}{
+				"description": "new description",
+				"tags":        []string{"a", "b"},
+				"platform":    "python",
+			},
+		},
+	}
+	current := map[string]interface{}{
+		"_id":       "tsuru_app/tsuru_myapp",
+		"_rev":      "1",
+		"name":      "myapp",
+		"timestamp": float64(1500000000),
+		"properties": map[string]interface{}{
+			"description": "old description",
+			"tags":        []interface{}{"a", "b"},
+			"owner":       "team1",
+		},
+	}
+	diff, err := DiffDocument(payload, current)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff, check.DeepEquals, DocumentDiff{
+		Collection: "tsuru_app",
+		Type:       PayloadTypeCollection,
+		Key:        "tsuru_myapp",
+		Status:     DiffUpdate,
+		Changes: []FieldChange{
+			{Field: "properties.description", Kind: FieldChanged, Old: "old description", New: "new description"},
+			{Field: "properties.owner", Kind: FieldRemoved, Old: "team1"},
+			{Field: "properties.platform", Kind: FieldAdded, New: "python"},
+		},
+	})
+}
+
+func (s *S) TestDiffDocumentStatus(c *check.C) {
+	payload := Payload{Action: "UPDATE", Key: "k1", Element: map[string]interface{}{"name": "n1", "timestamp": 2}}
+	diff, err := DiffDocument(payload, map[string]interface{}{"name": "n1", "timestamp": 1})
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Status, check.Equals, DiffUnchanged)
+	c.Assert(diff.Changes, check.HasLen, 0)
+
+	diff, err = DiffDocument(payload, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Status, check.Equals, DiffCreate)
+	c.Assert(diff.Changes, check.DeepEquals, []FieldChange{{Field: "name", Kind: FieldAdded, New: "n1"}})
+
+	payload = Payload{Action: "DELETE", Key: "k1"}
+	diff, err = DiffDocument(payload, map[string]interface{}{"name": "n1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Status, check.Equals, DiffDelete)
+	diff, err = DiffDocument(payload, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Status, check.Equals, DiffDeleteMissing)
+}
+
+func (s *S) TestDiffDocumentEdge(c *check.C) {
+	payload := Payload{
+		Action:     "UPDATE",
+		Collection: "tsuru_pool_app",
+		Type:       PayloadTypeEdge,
+		Key:        "tsuru_myapp-pool",
+		Element: map[string]interface{}{
+			"name":      "myapp-pool1",
+			"from":      "tsuru_app/tsuru_myapp",
+			"to":        "tsuru_pool/tsuru_pool1",
+			"timestamp": 2,
+		},
+	}
+	current := map[string]interface{}{
+		"_id":       "tsuru_pool_app/tsuru_myapp-pool",
+		"_key":      "tsuru_myapp-pool",
+		"_rev":      "1",
+		"_from":     "tsuru_app/tsuru_myapp",
+		"_to":       "tsuru_pool/tsuru_pool1",
+		"name":      "myapp-pool1",
+		"timestamp": float64(1),
+	}
+	diff, err := DiffDocument(payload, current)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Status, check.Equals, DiffUnchanged)
+	c.Assert(diff.Changes, check.HasLen, 0)
+
+	current["_to"] = "tsuru_pool/tsuru_pool2"
+	diff, err = DiffDocument(payload, current)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff.Status, check.Equals, DiffUpdate)
+	c.Assert(diff.Changes, check.DeepEquals, []FieldChange{
+		{Field: "_to", Kind: FieldChanged, Old: "tsuru_pool/tsuru_pool2", New: "tsuru_pool/tsuru_pool1"},
+	})
+}
+
+func (s *S) TestPostInDiffMode(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		switch r.URL.Path {
+		case "/v1/collections/tsuru_app/tsuru_myapp1":
+			json.NewEncoder(w).Encode(map[string]interface{}{"_key": "tsuru_myapp1", "name": "myapp1", "properties": map[string]interface{}{"pool": "pool1"}})
+		case "/v1/collections/tsuru_app/tsuru_myapp2":
+			json.NewEncoder(w).Encode(map[string]interface{}{"_key": "tsuru_myapp2", "name": "myapp2"})
+		case "/v1/edges/tsuru_pool_app/tsuru_myapp1-pool":
+			json.NewEncoder(w).Encode(map[string]interface{}{"_key": "tsuru_myapp1-pool", "name": "myapp1-pool"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	var out bytes.Buffer
+	client := Client{
+		ApiHostname: server.URL,
+		DiffOutput:  &out,
+		DiffFormat:  DiffText,
+	}
+	payload := []Payload{
+		{Action: "UPDATE", Collection: "tsuru_app", Type: PayloadTypeCollection, Key: "tsuru_myapp1", Element: map[string]interface{}{
+			"name":       "myapp1",
+			"properties": map[string]interface{}{"pool": "pool2"},
+		}},
+		{Action: "UPDATE", Collection: "tsuru_app", Type: PayloadTypeCollection, Key: "tsuru_myapp2", Element: map[string]interface{}{"name": "myapp2"}},
+		{Action: "UPDATE", Collection: "tsuru_app", Type: PayloadTypeCollection, Key: "tsuru_myapp3", Element: map[string]interface{}{"name": "myapp3"}},
+		{Action: "DELETE", Collection: "tsuru_pool_app", Type: PayloadTypeEdge, Key: "tsuru_myapp1-pool"},
+	}
+	result, err := client.Post(payload)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Failed, check.HasLen, 0)
+	c.Assert(out.String(), check.Equals, `~ tsuru_app/tsuru_myapp1
+    ~ properties.pool: "pool1" => "pool2"
++ tsuru_app/tsuru_myapp3 (missing, would be created)
+    + name: "myapp3"
+- tsuru_pool_app/tsuru_myapp1-pool (would be deleted)
+`)
+
+	out.Reset()
+	client.DiffFormat = DiffJSON
+	_, err = client.Post(payload[:2])
+	c.Assert(err, check.IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, check.HasLen, 2)
+	var diff DocumentDiff
+	err = json.Unmarshal([]byte(lines[1]), &diff)
+	c.Assert(err, check.IsNil)
+	c.Assert(diff, check.DeepEquals, DocumentDiff{Collection: "tsuru_app", Type: PayloadTypeCollection, Key: "tsuru_myapp2", Status: DiffUnchanged})
+}
+
+func (s *S) TestPostInDiffModeConcurrently(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	var out bytes.Buffer
+	client := Client{ApiHostname: server.URL, DiffOutput: &out, DiffFormat: DiffText}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("myapp%d", i)
+			_, err := client.Post([]Payload{{Action: "UPDATE", Collection: "tsuru_app", Type: PayloadTypeCollection, Key: "tsuru_" + name,
+				Element: map[string]interface{}{"name": name, "pool": name}}})
+			c.Check(err, check.IsNil)
+		}(i)
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, check.HasLen, 30)
+	for i := 0; i < len(lines); i += 3 {
+		var name string
+		_, err := fmt.Sscanf(lines[i], "+ tsuru_app/tsuru_%s", &name)
+		c.Assert(err, check.IsNil)
+		c.Assert(lines[i+1], check.Equals, fmt.Sprintf("    + name: %q", name))
+		c.Assert(lines[i+2], check.Equals, fmt.Sprintf("    + pool: %q", name))
+	}
+}
+
+func (s *S) TestPostInDiffModeFetchError(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	var out bytes.Buffer
+	client := Client{ApiHostname: server.URL, DiffOutput: &out, DiffFormat: DiffText}
+	payload := []Payload{{Action: "UPDATE", Collection: "tsuru_app", Type: PayloadTypeCollection, Key: "tsuru_myapp1"}}
+	result, err := client.Post(payload)
+	c.Assert(err, check.ErrorMatches, "failed to diff documents: unexpected response code fetching tsuru_app/tsuru_myapp1: 500")
+	c.Assert(result.FailedPayloads(), check.DeepEquals, payload)
+}
+
+func (s *S) TestParseDiffFormat(c *check.C) {
+	format, err := ParseDiffFormat("JSON")
+	c.Assert(err, check.IsNil)
+	c.Assert(format, check.Equals, DiffJSON)
+
+	_, err = ParseDiffFormat("yaml")
+	c.Assert(err, check.ErrorMatches, `invalid diff format: "yaml"`)
+}
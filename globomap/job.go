@@ -0,0 +1,134 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const defaultJobPollInterval = 5 * time.Second
+
+// PostResult describes the outcome of a Post call. Failed holds every
+// payload that was rejected by the loader or reported as failed by its job,
+// so callers can retry only those.
+type PostResult struct {
+	JobIDs []string
+	Failed []FailedPayload
+}
+
+type FailedPayload struct {
+	Payload Payload
+	Error   string
+}
+
+// FailedPayloads returns the payloads that must be sent again.
+func (r *PostResult) FailedPayloads() []Payload {
+	if r == nil {
+		return nil
+	}
+	payloads := make([]Payload, len(r.Failed))
+	for i, f := range r.Failed {
+		payloads[i] = f.Payload
+	}
+	return payloads
+}
+
+func (r *PostResult) fail(payload []Payload, err error) {
+	for _, p := range payload {
+		r.Failed = append(r.Failed, FailedPayload{Payload: p, Error: err.Error()})
+	}
+}
+
+type jobStatus struct {
+	Completed  bool       `json:"completed"`
+	ErrorCount int        `json:"error_count"`
+	Errors     []jobError `json:"errors"`
+}
+
+type jobError struct {
+	Collection string `json:"collection"`
+	Key        string `json:"key"`
+	Error      string `json:"error"`
+}
+
+// waitJob polls the loader job status until it's completed or JobTimeout
+// is reached.
+func (g *Client) waitJob(jobID string) (*jobStatus, error) {
+	interval := g.JobPollInterval
+	if interval == 0 {
+		interval = defaultJobPollInterval
+	}
+	path := "/v1/updates/" + jobID
+	if g.hasCredentials() {
+		path = "/v2/updates/" + jobID + "/"
+	}
+	deadline := time.Now().Add(g.JobTimeout)
+	for {
+		status, err := g.jobStatus(path)
+		if err != nil {
+			return nil, err
+		}
+		if status.Completed {
+			return status, nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return nil, fmt.Errorf("timeout waiting for job %s", jobID)
+		}
+		g.log().WithField("job_id", jobID).Debugf("waiting for job")
+		if err := g.sleep(interval); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (g *Client) jobStatus(path string) (*jobStatus, error) {
+	resp, err := g.doGet(g.LoaderHostname, path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code fetching job status: %v", resp.StatusCode)
+	}
+	var status jobStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// checkJob waits for the job that processed the given payload, if job
+// polling is enabled, and adds the documents it failed to the result.
+func (g *Client) checkJob(jobID string, payload []Payload, result *PostResult) error {
+	if jobID == "" || g.JobTimeout == 0 || g.Dry {
+		return nil
+	}
+	status, err := g.waitJob(jobID)
+	if err != nil {
+		result.fail(payload, err)
+		return err
+	}
+	if len(status.Errors) == 0 {
+		if status.ErrorCount > 0 {
+			err = fmt.Errorf("job %s failed for %d documents", jobID, status.ErrorCount)
+			result.fail(payload, err)
+			return err
+		}
+		return nil
+	}
+	for _, jobErr := range status.Errors {
+		for _, p := range payload {
+			if p.Collection == jobErr.Collection && p.Key == jobErr.Key {
+				result.Failed = append(result.Failed, FailedPayload{Payload: p, Error: jobErr.Error})
+				break
+			}
+		}
+	}
+	return fmt.Errorf("job %s failed for %d documents", jobID, len(status.Errors))
+}
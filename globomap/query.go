@@ -0,0 +1,193 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const defaultPerPage = 100
+
+type Operator string
+
+const (
+	OpEqual    = Operator("==")
+	OpNotEqual = Operator("!=")
+	OpIn       = Operator("IN")
+	OpContains = Operator("contains")
+	OpLike     = Operator("LIKE")
+)
+
+type Condition struct {
+	Field    string      `json:"field"`
+	Operator Operator    `json:"operator"`
+	Value    interface{} `json:"value"`
+}
+
+func Cond(field string, op Operator, value interface{}) Condition {
+	return Condition{Field: field, Operator: op, Value: value}
+}
+
+// PropertyField returns the field used to filter documents by one of their
+// properties.
+func PropertyField(name string) string {
+	return "properties." + name
+}
+
+// Query selects the documents of a collection or edge. Conditions added with
+// And must all match, while each Or starts an alternative group of
+// conditions.
+type Query struct {
+	collection string
+	kind       PayloadType
+	groups     [][]Condition
+	perPage    int
+}
+
+func NewQuery(collection string) *Query {
+	return &Query{collection: collection, kind: PayloadTypeCollection, perPage: defaultPerPage}
+}
+
+// Edges makes the query select documents from an edge instead of a
+// collection.
+func (q *Query) Edges() *Query {
+	q.kind = PayloadTypeEdge
+	return q
+}
+
+func (q *Query) Type(t PayloadType) *Query {
+	q.kind = t
+	return q
+}
+
+func (q *Query) PerPage(n int) *Query {
+	if n > 0 {
+		q.perPage = n
+	}
+	return q
+}
+
+func (q *Query) And(conds ...Condition) *Query {
+	if len(q.groups) == 0 {
+		return q.Or(conds...)
+	}
+	last := len(q.groups) - 1
+	q.groups[last] = append(q.groups[last], conds...)
+	return q
+}
+
+func (q *Query) Or(conds ...Condition) *Query {
+	q.groups = append(q.groups, append([]Condition{}, conds...))
+	return q
+}
+
+func (q *Query) path(apiVersion string, page int) (string, error) {
+	v := url.Values{}
+	v.Set("page", strconv.Itoa(page))
+	v.Set("per_page", strconv.Itoa(q.perPage))
+	if len(q.groups) > 0 {
+		data, err := json.Marshal(q.groups)
+		if err != nil {
+			return "", err
+		}
+		v.Set("query", string(data))
+	}
+	return fmt.Sprintf("/%s/%s/%s/?%s", apiVersion, q.kind, q.collection, v.Encode()), nil
+}
+
+// Iterator walks through the documents matching a query, fetching each page
+// from globomap API as needed.
+type Iterator struct {
+	client     *Client
+	query      *Query
+	page       int
+	totalPages int
+	documents  []QueryResult
+	current    QueryResult
+	err        error
+}
+
+func (g *Client) Iterate(q *Query) *Iterator {
+	return &Iterator{client: g, query: q}
+}
+
+// Next advances to the next document, returning false when there are no
+// more documents or an error happened.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for len(it.documents) == 0 {
+		if it.page > 0 && it.page >= it.totalPages {
+			return false
+		}
+		it.page++
+		it.err = it.fetch()
+		if it.err != nil {
+			return false
+		}
+		if len(it.documents) == 0 {
+			return false
+		}
+	}
+	it.current, it.documents = it.documents[0], it.documents[1:]
+	return true
+}
+
+func (it *Iterator) Document() QueryResult {
+	return it.current
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) fetch() error {
+	g := it.client
+	if err := g.auth(g.ApiHostname); err != nil {
+		return fmt.Errorf("failed to authenticate with globomap API: %v", err)
+	}
+	apiVersion := "v1"
+	if g.hasCredentials() {
+		apiVersion = "v2"
+	}
+	path, err := it.query.path(apiVersion, it.page)
+	if err != nil {
+		return err
+	}
+	resp, err := g.doGet(g.ApiHostname, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response code querying %s: %v", it.query.collection, resp.StatusCode)
+	}
+	var data struct {
+		Documents  []QueryResult
+		TotalPages int `json:"total_pages"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return err
+	}
+	it.documents = data.Documents
+	it.totalPages = data.TotalPages
+	return nil
+}
+
+// QueryAll returns every document matching the query.
+func (g *Client) QueryAll(q *Query) ([]QueryResult, error) {
+	var documents []QueryResult
+	it := g.Iterate(q)
+	for it.Next() {
+		documents = append(documents, it.Document())
+	}
+	return documents, it.Err()
+}
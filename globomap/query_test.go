@@ -0,0 +1,97 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestQueryPath(c *check.C) {
+	q := NewQuery("tsuru_app").
+		And(Cond("name", OpEqual, `my"app`), Cond(PropertyField("team_owner"), OpIn, []string{"team1", "team2"})).
+		Or(Cond("name", OpLike, "%app%"))
+	path, err := q.path("v1", 2)
+	c.Assert(err, check.IsNil)
+	u, err := url.Parse(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(u.Path, check.Equals, "/v1/collections/tsuru_app/")
+	c.Assert(u.Query().Get("page"), check.Equals, "2")
+	c.Assert(u.Query().Get("per_page"), check.Equals, "100")
+
+	var groups [][]Condition
+	err = json.Unmarshal([]byte(u.Query().Get("query")), &groups)
+	c.Assert(err, check.IsNil)
+	c.Assert(groups, check.HasLen, 2)
+	c.Assert(groups[0], check.HasLen, 2)
+	c.Assert(groups[0][0], check.DeepEquals, Condition{Field: "name", Operator: OpEqual, Value: `my"app`})
+	c.Assert(groups[0][1], check.DeepEquals, Condition{Field: "properties.team_owner", Operator: OpIn, Value: []interface{}{"team1", "team2"}})
+	c.Assert(groups[1], check.DeepEquals, []Condition{{Field: "name", Operator: OpLike, Value: "%app%"}})
+}
+
+func (s *S) TestQueryPathWithoutConditions(c *check.C) {
+	path, err := NewQuery("tsuru_pool_app").Edges().PerPage(10).path("v2", 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Equals, "/v2/edges/tsuru_pool_app/?page=1&per_page=10")
+}
+
+func (s *S) TestIterate(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, check.Equals, "/v1/collections/tsuru_app/")
+		c.Assert(r.FormValue("query"), check.Equals, `[[{"field":"properties.pool","operator":"==","value":"pool1"}]]`)
+		c.Assert(r.FormValue("per_page"), check.Equals, "2")
+		var docs []QueryResult
+		switch r.FormValue("page") {
+		case "1":
+			docs = []QueryResult{{Key: "tsuru_app1"}, {Key: "tsuru_app2"}}
+		case "2":
+			docs = []QueryResult{{Key: "tsuru_app3"}}
+		default:
+			c.Fatalf("Invalid page requested: %v", r.FormValue("page"))
+		}
+		json.NewEncoder(w).Encode(struct {
+			Documents  []QueryResult
+			TotalPages int `json:"total_pages"`
+		}{docs, 2})
+	}))
+	defer server.Close()
+	client := Client{ApiHostname: server.URL}
+
+	it := client.Iterate(NewQuery("tsuru_app").And(Cond(PropertyField("pool"), OpEqual, "pool1")).PerPage(2))
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Document().Key)
+	}
+	c.Assert(it.Err(), check.IsNil)
+	c.Assert(keys, check.DeepEquals, []string{"tsuru_app1", "tsuru_app2", "tsuru_app3"})
+	c.Assert(it.Next(), check.Equals, false)
+}
+
+func (s *S) TestQueryAllError(c *check.C) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(struct {
+			Documents  []QueryResult
+			TotalPages int `json:"total_pages"`
+		}{[]QueryResult{{Key: fmt.Sprintf("k%d", requests)}}, 3})
+	}))
+	defer server.Close()
+	client := Client{ApiHostname: server.URL}
+
+	docs, err := client.QueryAll(NewQuery("tsuru_app"))
+	c.Assert(err, check.ErrorMatches, "unexpected response code querying tsuru_app: 500")
+	c.Assert(docs, check.HasLen, 1)
+	c.Assert(requests, check.Equals, 2)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// DefaultRetryableStatusCodes are the loader responses considered transient.
+var DefaultRetryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy controls how each chunk post is retried. Connection errors are
+// always retried, while error responses are only retried when their status
+// code is listed in RetryableStatusCodes. The wait between attempts starts
+// at InitialBackoff and doubles up to MaxBackoff, randomly varying by the
+// Jitter fraction.
+type RetryPolicy struct {
+	MaxAttempts          int
+	InitialBackoff       time.Duration
+	MaxBackoff           time.Duration
+	Jitter               float64
+	RetryableStatusCodes []int
+}
+
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p == nil || p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	statusErr, ok := err.(*statusError)
+	if !ok {
+		return true
+	}
+	for _, code := range p.RetryableStatusCodes {
+		if code == statusErr.code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before the attempt following the given one.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		wait += time.Duration(float64(wait) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return wait
+}
+
+// postWithRetry posts a chunk following the client retry policy. A 401
+// response triggers a new authentication before posting the chunk again,
+// which doesn't count as an attempt.
+func (g *Client) postWithRetry(payload []Payload) (string, error) {
+	reauthenticated := false
+	attempt := 1
+	for {
+		jobID, err := g.post(payload)
+		if err == nil {
+			return jobID, nil
+		}
+		if statusErr, ok := err.(*statusError); ok && statusErr.code == http.StatusUnauthorized &&
+			!reauthenticated && g.hasCredentials() {
+			reauthenticated = true
+			g.log().Debugf("unauthorized by globomap loader, authenticating again")
+			g.tokens.invalidate(g.LoaderHostname)
+			continue
+		}
+		if attempt >= g.Retry.maxAttempts() || !g.Retry.retryable(err) {
+			return "", err
+		}
+		wait := g.Retry.backoff(attempt)
+		g.log().WithField("error", err).Warnf("error posting chunk (attempt %d/%d), retrying in %s", attempt, g.Retry.maxAttempts(), wait)
+		if err := g.sleep(wait); err != nil {
+			return "", err
+		}
+		attempt++
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestPostRetriesTransientErrors(c *check.C) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response{JobID: "1", Message: "ok"})
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname: server.URL,
+		Retry: &RetryPolicy{
+			MaxAttempts:          3,
+			InitialBackoff:       time.Millisecond,
+			RetryableStatusCodes: DefaultRetryableStatusCodes,
+		},
+	}
+
+	result, err := client.Post([]Payload{{Key: "k1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Failed, check.HasLen, 0)
+	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(3))
+}
+
+func (s *S) TestPostGivesUpAfterMaxAttempts(c *check.C) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname: server.URL,
+		Retry: &RetryPolicy{
+			MaxAttempts:          2,
+			InitialBackoff:       time.Millisecond,
+			RetryableStatusCodes: DefaultRetryableStatusCodes,
+		},
+	}
+
+	payload := []Payload{{Key: "k1"}}
+	result, err := client.Post(payload)
+	c.Assert(err, check.ErrorMatches, "502 Bad Gateway")
+	c.Assert(result.FailedPayloads(), check.DeepEquals, payload)
+	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(2))
+}
+
+func (s *S) TestPostStopsRetryingWhenContextIsCancelled(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname: server.URL,
+		Context:        ctx,
+		Retry: &RetryPolicy{
+			MaxAttempts:          3,
+			InitialBackoff:       time.Minute,
+			RetryableStatusCodes: DefaultRetryableStatusCodes,
+		},
+	}
+
+	_, err := client.Post([]Payload{{Key: "k1"}})
+	c.Assert(err, check.Equals, context.Canceled)
+	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(1))
+}
+
+func (s *S) TestPostDoesNotRetryNonRetryableStatus(c *check.C) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname: server.URL,
+		Retry: &RetryPolicy{
+			MaxAttempts:          3,
+			InitialBackoff:       time.Millisecond,
+			RetryableStatusCodes: DefaultRetryableStatusCodes,
+		},
+	}
+
+	_, err := client.Post([]Payload{{Key: "k1"}})
+	c.Assert(err, check.NotNil)
+	c.Assert(atomic.LoadInt32(&requests), check.Equals, int32(1))
+}
+
+func (s *S) TestPostReauthenticatesOnUnauthorized(c *check.C) {
+	var auths, updates int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/auth/":
+			count := atomic.AddInt32(&auths, 1)
+			json.NewEncoder(w).Encode(token{Token: fmt.Sprintf("token%d", count)})
+		case "/v2/updates/":
+			atomic.AddInt32(&updates, 1)
+			if r.Header.Get("Authorization") != "Token token=token2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(response{JobID: "1", Message: "ok"})
+		}
+	}))
+	defer server.Close()
+	client := Client{
+		LoaderHostname: server.URL,
+		Username:       "user",
+		Password:       "password",
+	}
+
+	_, err := client.Post([]Payload{{Key: "k1"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(atomic.LoadInt32(&auths), check.Equals, int32(2))
+	c.Assert(atomic.LoadInt32(&updates), check.Equals, int32(2))
+}
+
+func (s *S) TestRetryPolicyBackoff(c *check.C) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	c.Assert(p.backoff(1), check.Equals, time.Second)
+	c.Assert(p.backoff(2), check.Equals, 2*time.Second)
+	c.Assert(p.backoff(3), check.Equals, 4*time.Second)
+	c.Assert(p.backoff(4), check.Equals, 5*time.Second)
+	c.Assert(p.backoff(50), check.Equals, 5*time.Second)
+
+	p.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		wait := p.backoff(1)
+		c.Assert(wait >= 500*time.Millisecond && wait <= 1500*time.Millisecond, check.Equals, true)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenLifetime is used when globomap doesn't say when the
+	// token expires.
+	defaultTokenLifetime = 10 * time.Minute
+
+	// tokenRefreshMargin is how long before expiring a token is renewed.
+	tokenRefreshMargin = time.Minute
+
+	// authTimeout limits how long an authentication request may take.
+	authTimeout = 30 * time.Second
+)
+
+var expiresAtLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999",
+	"2006-01-02T15:04:05.999999Z",
+}
+
+type token struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
+
+	expires time.Time
+}
+
+// tokenManager caches the tokens of each globomap host, renewing them
+// shortly before they expire. It's safe for concurrent use and its zero
+// value is ready to use.
+type tokenManager struct {
+	mu      sync.Mutex
+	tokens  map[string]*token
+	pending map[string]*tokenCall
+	now     func() time.Time
+}
+
+// tokenCall is an authentication in progress, shared by the requests
+// waiting for the token of the same host.
+type tokenCall struct {
+	done  chan struct{}
+	token *token
+	err   error
+}
+
+// get returns the cached token of the host or authenticates again. The
+// lock isn't held while authenticating, so a slow host doesn't block the
+// requests to the others.
+func (m *tokenManager) get(addr string, authenticate func(string) (*token, error)) (*token, error) {
+	m.mu.Lock()
+	now := m.timeNow()
+	if t, ok := m.tokens[addr]; ok && now.Before(t.expires.Add(-tokenRefreshMargin)) {
+		m.mu.Unlock()
+		return t, nil
+	}
+	if call, ok := m.pending[addr]; ok {
+		m.mu.Unlock()
+		<-call.done
+		return call.token, call.err
+	}
+	call := &tokenCall{done: make(chan struct{})}
+	if m.pending == nil {
+		m.pending = make(map[string]*tokenCall)
+	}
+	m.pending[addr] = call
+	m.mu.Unlock()
+
+	call.token, call.err = authenticate(addr)
+	if call.err == nil {
+		call.token.expires = now.Add(defaultTokenLifetime)
+		for _, layout := range expiresAtLayouts {
+			if expires, err := time.Parse(layout, call.token.ExpiresAt); err == nil {
+				call.token.expires = expires
+				break
+			}
+		}
+	}
+	m.mu.Lock()
+	delete(m.pending, addr)
+	if call.err == nil {
+		if m.tokens == nil {
+			m.tokens = make(map[string]*token)
+		}
+		m.tokens[addr] = call.token
+	}
+	m.mu.Unlock()
+	close(call.done)
+	return call.token, call.err
+}
+
+// invalidate discards the cached token, forcing a new authentication in
+// the next request.
+func (m *tokenManager) invalidate(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, addr)
+}
+
+func (m *tokenManager) timeNow() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+func (g *Client) hasCredentials() bool {
+	return g.Username != "" || g.Password != ""
+}
+
+// auth makes sure there's a valid token for the given host.
+func (g *Client) auth(addr string) error {
+	if !g.hasCredentials() {
+		return nil
+	}
+	_, err := g.tokens.get(addr, g.authenticate)
+	return err
+}
+
+// authorize adds the token of the given host to the request.
+func (g *Client) authorize(req *http.Request, addr string) error {
+	if !g.hasCredentials() {
+		return nil
+	}
+	t, err := g.tokens.get(addr, g.authenticate)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate with globomap: %v", err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Token token=%s", t.Token))
+	return nil
+}
+
+func (g *Client) authenticate(addr string) (*token, error) {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(authRequest{Username: g.Username, Password: g.Password})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, addr+"/v2/auth/", buf)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(g.ctx())
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{Timeout: authTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response code for auth: %v", resp.StatusCode)
+	}
+	var t token
+	err = json.NewDecoder(resp.Body).Decode(&t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package globomap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestClientReusesToken(c *check.C) {
+	var auths int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/auth/":
+			atomic.AddInt32(&auths, 1)
+			json.NewEncoder(w).Encode(token{Token: "xpto"})
+		case "/v2/collections/comp_unit/":
+			c.Assert(r.Header.Get("Authorization"), check.Equals, "Token token=xpto")
+			json.NewEncoder(w).Encode(struct{ Documents []QueryResult }{[]QueryResult{{Id: "abc"}}})
+		case "/v2/updates/":
+			c.Assert(r.Header.Get("Authorization"), check.Equals, "Token token=xpto")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(response{JobID: "1", Message: "ok"})
+		default:
+			c.Fatalf("Invalid request path called: %v", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	client := Client{
+		ApiHostname:    server.URL,
+		LoaderHostname: server.URL,
+		Username:       "user",
+		Password:       "password",
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := client.Query(QueryFields{Collection: "comp_unit", Name: "vm-1234"})
+		c.Assert(err, check.IsNil)
+		c.Assert(result.Id, check.Equals, "abc")
+		_, err = client.Post([]Payload{{Key: "k1"}})
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(atomic.LoadInt32(&auths), check.Equals, int32(1))
+}
+
+func (s *S) TestTokenManagerRefreshesBeforeExpiry(c *check.C) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	m := tokenManager{now: func() time.Time { return now }}
+	var auths int
+	authenticate := func(addr string) (*token, error) {
+		auths++
+		return &token{
+			Token:     fmt.Sprintf("token%d", auths),
+			ExpiresAt: now.Add(10 * time.Minute).Format(time.RFC3339),
+		}, nil
+	}
+
+	t, err := m.get("host", authenticate)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Token, check.Equals, "token1")
+
+	now = now.Add(8 * time.Minute)
+	t, err = m.get("host", authenticate)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Token, check.Equals, "token1")
+
+	now = now.Add(90 * time.Second)
+	t, err = m.get("host", authenticate)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Token, check.Equals, "token2")
+
+	t, err = m.get("other-host", authenticate)
+	c.Assert(err, check.IsNil)
+	c.Assert(t.Token, check.Equals, "token3")
+}
+
+func (s *S) TestTokenManagerDefaultLifetime(c *check.C) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	m := tokenManager{now: func() time.Time { return now }}
+	t, err := m.get("host", func(string) (*token, error) {
+		return &token{Token: "xpto"}, nil
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(t.expires, check.Equals, now.Add(defaultTokenLifetime))
+}
+
+func (s *S) TestTokenManagerInvalidate(c *check.C) {
+	var m tokenManager
+	var auths int
+	authenticate := func(string) (*token, error) {
+		auths++
+		return &token{Token: "xpto"}, nil
+	}
+	m.get("host", authenticate)
+	m.invalidate("host")
+	m.get("host", authenticate)
+	c.Assert(auths, check.Equals, 2)
+}
+
+func (s *S) TestTokenManagerAuthError(c *check.C) {
+	var m tokenManager
+	t, err := m.get("host", func(string) (*token, error) {
+		return nil, errors.New("invalid credentials")
+	})
+	c.Assert(err, check.ErrorMatches, "invalid credentials")
+	c.Assert(t, check.IsNil)
+	c.Assert(m.tokens, check.HasLen, 0)
+}
+
+func (s *S) TestTokenManagerConcurrentUse(c *check.C) {
+	var m tokenManager
+	var auths int32
+	authenticate := func(string) (*token, error) {
+		atomic.AddInt32(&auths, 1)
+		time.Sleep(10 * time.Millisecond)
+		return &token{Token: "xpto"}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t, err := m.get("host", authenticate)
+			c.Check(err, check.IsNil)
+			c.Check(t.Token, check.Equals, "xpto")
+		}()
+	}
+	wg.Wait()
+	c.Assert(atomic.LoadInt32(&auths), check.Equals, int32(1))
+}
+
+func (s *S) TestTokenManagerDoesNotBlockOtherHosts(c *check.C) {
+	var m tokenManager
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go m.get("host1", func(string) (*token, error) {
+		close(started)
+		<-release
+		return &token{Token: "host1"}, nil
+	})
+	<-started
+	defer close(release)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t, err := m.get("host2", func(string) (*token, error) {
+			return &token{Token: "host2"}, nil
+		})
+		c.Check(err, check.IsNil)
+		c.Check(t.Token, check.Equals, "host2")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("authentication of a host blocked the others")
+	}
+}
+
+func (s *S) TestClientAuthenticationIsCancelled(c *check.C) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	client := Client{LoaderHostname: server.URL, Username: "user", Password: "secret", Context: ctx}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Post([]Payload{{Key: "k1"}})
+		errCh <- err
+	}()
+	cancel()
+	select {
+	case err := <-errCh:
+		c.Assert(err, check.ErrorMatches, "failed to authenticate with globomap loader: .*")
+	case <-time.After(5 * time.Second):
+		c.Fatal("authentication wasn't cancelled")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tsuru/globomap-integration/globomap"
+)
+
+// hashEntry is the hash of the last document posted with a key.
+type hashEntry struct {
+	Hash   string    `json:"hash"`
+	Posted time.Time `json:"posted"`
+}
+
+// hashStore remembers the content of the documents posted to globomap, so
+// unchanged documents are not posted again until they're older than maxAge.
+type hashStore struct {
+	mu      sync.Mutex
+	path    string
+	maxAge  time.Duration
+	entries map[string]hashEntry
+	now     func() time.Time
+}
+
+func newHashStore(config configParams) (*hashStore, error) {
+	if config.hashStateFile == "" {
+		return nil, nil
+	}
+	s := &hashStore{
+		path:    config.hashStateFile,
+		maxAge:  config.hashMaxAge,
+		entries: make(map[string]hashEntry),
+		now:     time.Now,
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &s.entries); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func hashKey(p globomap.Payload) string {
+	return p.Collection + "/" + p.Key
+}
+
+// payloadHash is computed over the element without its timestamp, which
+// changes on every run. Map keys are sorted by the JSON encoder, so the
+// hash is stable.
+func payloadHash(p globomap.Payload) (string, error) {
+	element := make(map[string]interface{}, len(p.Element))
+	for k, v := range p.Element {
+		if k != "timestamp" {
+			element[k] = v
+		}
+	}
+	data, err := json.Marshal(struct {
+		Type    globomap.PayloadType   `json:"type"`
+		Element map[string]interface{} `json:"element"`
+	}{p.Type, element})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// filter returns the payloads that must be posted: deletes, and updates
+// whose content changed or was last posted longer than maxAge ago.
+func (s *hashStore) filter(payload []globomap.Payload) []globomap.Payload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	var changed []globomap.Payload
+	for _, p := range payload {
+		if p.Action == "UPDATE" {
+			entry, ok := s.entries[hashKey(p)]
+			hash, err := payloadHash(p)
+			if ok && err == nil && entry.Hash == hash && now.Sub(entry.Posted) < s.maxAge {
+				continue
+			}
+		}
+		changed = append(changed, p)
+	}
+	return changed
+}
+
+// record stores the hashes of the posted payloads that weren't rejected
+// and forgets the deleted ones.
+func (s *hashStore) record(payload []globomap.Payload, result *globomap.PostResult) error {
+	failed := make(map[string]bool)
+	if result != nil {
+		for _, f := range result.Failed {
+			failed[hashKey(f.Payload)] = true
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, p := range payload {
+		key := hashKey(p)
+		if failed[key] {
+			continue
+		}
+		if p.Action == "DELETE" {
+			delete(s.entries, key)
+			continue
+		}
+		hash, err := payloadHash(p)
+		if err != nil {
+			delete(s.entries, key)
+			continue
+		}
+		s.entries[key] = hashEntry{Hash: hash, Posted: now}
+	}
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
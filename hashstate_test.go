@@ -0,0 +1,143 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
+	"gopkg.in/check.v1"
+)
+
+func newTestHashStore(c *check.C, now *time.Time) (*hashStore, func()) {
+	dir, err := ioutil.TempDir("", "hashstate")
+	c.Assert(err, check.IsNil)
+	config := NewConfig()
+	config.hashStateFile = filepath.Join(dir, "hashes.json")
+	config.hashMaxAge = time.Hour
+	s, err := newHashStore(config)
+	c.Assert(err, check.IsNil)
+	s.now = func() time.Time { return *now }
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func teamPayload(name, tag string, t time.Time) globomap.Payload {
+	op := &teamOperation{
+		baseOperation: baseOperation{action: "UPDATE", time: t},
+		team:          tsuru.Team{Name: name, Tags: []string{tag}},
+	}
+	return *op.toPayload()
+}
+
+func (s *S) TestPayloadHashIgnoresTimestamp(c *check.C) {
+	now := time.Now()
+	h1, err := payloadHash(teamPayload("team1", "a", now))
+	c.Assert(err, check.IsNil)
+	h2, err := payloadHash(teamPayload("team1", "a", now.Add(time.Hour)))
+	c.Assert(err, check.IsNil)
+	c.Assert(h1, check.Equals, h2)
+	h3, err := payloadHash(teamPayload("team1", "b", now))
+	c.Assert(err, check.IsNil)
+	c.Assert(h3, check.Not(check.Equals), h1)
+}
+
+func (s *S) TestHashStoreFilter(c *check.C) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	store, cleanup := newTestHashStore(c, &now)
+	defer cleanup()
+	team1 := teamPayload("team1", "a", now)
+	team2 := teamPayload("team2", "a", now)
+	c.Assert(store.filter([]globomap.Payload{team1, team2}), check.HasLen, 2)
+	err := store.record([]globomap.Payload{team1, team2}, &globomap.PostResult{})
+	c.Assert(err, check.IsNil)
+
+	now = now.Add(time.Minute)
+	changedTeam2 := teamPayload("team2", "b", now)
+	deleteTeam1 := globomap.Payload{Action: "DELETE", Collection: team1.Collection, Key: team1.Key}
+	payload := []globomap.Payload{teamPayload("team1", "a", now), changedTeam2, deleteTeam1}
+	c.Assert(store.filter(payload), check.DeepEquals, []globomap.Payload{changedTeam2, deleteTeam1})
+
+	now = now.Add(time.Hour)
+	c.Assert(store.filter(payload), check.HasLen, 3)
+}
+
+func (s *S) TestHashStoreRecord(c *check.C) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	store, cleanup := newTestHashStore(c, &now)
+	defer cleanup()
+	team1 := teamPayload("team1", "a", now)
+	team2 := teamPayload("team2", "a", now)
+	result := &globomap.PostResult{Failed: []globomap.FailedPayload{{Payload: team2}}}
+	err := store.record([]globomap.Payload{team1, team2}, result)
+	c.Assert(err, check.IsNil)
+
+	reloaded, err := newHashStore(configParams{hashStateFile: store.path, hashMaxAge: time.Hour})
+	c.Assert(err, check.IsNil)
+	c.Assert(reloaded.entries, check.HasLen, 1)
+	entry := reloaded.entries["tsuru_team/tsuru_team1"]
+	c.Assert(entry.Posted.Equal(now), check.Equals, true)
+
+	err = store.record([]globomap.Payload{{Action: "DELETE", Collection: team1.Collection, Key: team1.Key}}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(store.entries, check.HasLen, 0)
+}
+
+func (s *S) TestNewHashStoreInvalidFile(c *check.C) {
+	f, err := ioutil.TempFile("", "hashstate")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("not json")
+	f.Close()
+
+	_, err = newHashStore(configParams{hashStateFile: f.Name()})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestPostUpdatesSkipsUnchangedDocuments(c *check.C) {
+	dir, err := ioutil.TempDir("", "hashstate")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	os.Setenv("HASH_STATE_FILE", filepath.Join(dir, "hashes.json"))
+	defer os.Unsetenv("HASH_STATE_FILE")
+	var posted [][]globomap.Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data []globomap.Payload
+		err := json.NewDecoder(r.Body).Decode(&data)
+		c.Assert(err, check.IsNil)
+		posted = append(posted, data)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	ops := func(tag string) []operation {
+		return []operation{
+			&teamOperation{baseOperation: baseOperation{action: "UPDATE", time: time.Now()}, team: tsuru.Team{Name: "team1"}},
+			&teamOperation{baseOperation: baseOperation{action: "UPDATE", time: time.Now()}, team: tsuru.Team{Name: "team2", Tags: []string{tag}}},
+		}
+	}
+	c.Assert(postUpdates(ops("a")), check.IsNil)
+	c.Assert(postUpdates(ops("a")), check.IsNil)
+	c.Assert(postUpdates(ops("b")), check.IsNil)
+	c.Assert(posted, check.HasLen, 2)
+	c.Assert(posted[0], check.HasLen, 2)
+	c.Assert(posted[1], check.HasLen, 1)
+	c.Assert(posted[1][0].Key, check.Equals, "tsuru_team2")
+	c.Assert(env.status.counts[countSkipped], check.Equals, 3)
+
+	// a new process keeps skipping the documents posted by the previous one
+	setup(nil)
+	c.Assert(postUpdates(ops("b")), check.IsNil)
+	c.Assert(posted, check.HasLen, 2)
+}
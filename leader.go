@@ -0,0 +1,271 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// leaderLock is held by the only instance allowed to run updates.
+type leaderLock interface {
+	// Acquire takes the lock for the given holder, or renews it when it's
+	// already held by the holder, returning whether the holder owns it.
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, holder string) error
+}
+
+// fileLock uses an exclusive flock on a local file, which is released by
+// the system when the process dies, so the ttl is not used.
+type fileLock struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (l *fileLock) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return false, nil
+	}
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	// the holder is written only to tell who holds the lock
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(holder+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	l.file = f
+	return true, nil
+}
+
+func (l *fileLock) Release(ctx context.Context, holder string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
+
+// httpLeaseLock acquires a lease from an HTTP service. A PUT to the lease
+// URL with the holder and the ttl responds with 200 when the lease is
+// granted or renewed, and with 409 when another holder owns it. A DELETE
+// releases the lease.
+type httpLeaseLock struct {
+	url    string
+	client *http.Client
+}
+
+type leaseRequest struct {
+	Holder     string  `json:"holder"`
+	TTLSeconds float64 `json:"ttl_seconds,omitempty"`
+}
+
+func (l *httpLeaseLock) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	resp, err := l.do(ctx, http.MethodPut, leaseRequest{Holder: holder, TTLSeconds: ttl.Seconds()})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected response acquiring lease: %s", resp.Status)
+}
+
+func (l *httpLeaseLock) Release(ctx context.Context, holder string) error {
+	resp, err := l.do(ctx, http.MethodDelete, leaseRequest{Holder: holder})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusConflict:
+		return nil
+	}
+	return fmt.Errorf("unexpected response releasing lease: %s", resp.Status)
+}
+
+func (l *httpLeaseLock) do(ctx context.Context, method string, body leaseRequest) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, l.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	client := l.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// leaderElector keeps trying to acquire the leader lock, so a standby
+// instance takes over when the leader stops renewing it.
+type leaderElector struct {
+	lock   leaderLock
+	id     string
+	ttl    time.Duration
+	mu     sync.Mutex
+	leader bool
+	// runs cancels the contexts returned by leaderContext when the
+	// instance stops being the leader.
+	runs    map[int]context.CancelFunc
+	nextRun int
+}
+
+func newLeaderElector(config configParams) (*leaderElector, error) {
+	var lock leaderLock
+	switch config.leaderElection {
+	case "":
+		return nil, nil
+	case "file":
+		if config.leaderLockFile == "" {
+			return nil, fmt.Errorf("LEADER_LOCK_FILE is required by the file leader election")
+		}
+		lock = &fileLock{path: config.leaderLockFile}
+	case "http":
+		if config.leaderLeaseURL == "" {
+			return nil, fmt.Errorf("LEADER_LEASE_URL is required by the http leader election")
+		}
+		lock = &httpLeaseLock{url: config.leaderLeaseURL, client: &http.Client{Timeout: config.leaderLeaseTTL}}
+	default:
+		return nil, fmt.Errorf("Invalid leader election: %s", config.leaderElection)
+	}
+	id := config.leaderID
+	if id == "" {
+		hostname, _ := os.Hostname()
+		id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	return &leaderElector{lock: lock, id: id, ttl: config.leaderLeaseTTL}, nil
+}
+
+func (e *leaderElector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// campaign acquires or renews the lock. Errors make the instance step down,
+// since it can't tell whether the lease is still held.
+func (e *leaderElector) campaign(ctx context.Context) bool {
+	acquired, err := e.lock.Acquire(ctx, e.id, e.ttl)
+	if err != nil {
+		env.log.WithField("error", err).Errorf("error acquiring leader lock")
+		acquired = false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if acquired != e.leader {
+		if acquired {
+			env.log.WithField("holder", e.id).Infof("became the leader")
+		} else {
+			env.log.WithField("holder", e.id).Warnf("lost the leadership, standing by")
+			e.endTerm()
+		}
+	}
+	e.leader = acquired
+	return acquired
+}
+
+// leaderContext returns a context derived from parent that is cancelled
+// when the instance loses the leadership, so a run doesn't keep posting
+// after another instance takes over. It's done right away when the
+// instance isn't the leader.
+func (e *leaderElector) leaderContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.leader {
+		cancel()
+		return ctx, cancel
+	}
+	if e.runs == nil {
+		e.runs = make(map[int]context.CancelFunc)
+	}
+	id := e.nextRun
+	e.nextRun++
+	e.runs[id] = cancel
+	return ctx, func() {
+		e.mu.Lock()
+		delete(e.runs, id)
+		e.mu.Unlock()
+		cancel()
+	}
+}
+
+// endTerm must be called with e.mu held.
+func (e *leaderElector) endTerm() {
+	for id, cancel := range e.runs {
+		cancel()
+		delete(e.runs, id)
+	}
+}
+
+// run campaigns three times per ttl until the context is cancelled, then
+// releases the lock so another instance can take over right away.
+func (e *leaderElector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return
+		case <-ticker.C:
+			e.campaign(ctx)
+		}
+	}
+}
+
+func (e *leaderElector) resign() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.leader {
+		return
+	}
+	e.leader = false
+	e.endTerm()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.lock.Release(ctx, e.id); err != nil {
+		env.log.WithField("error", err).Errorf("error releasing leader lock")
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"gopkg.in/check.v1"
+)
+
+// leaseServer is a local stand-in for the lease service.
+type leaseServer struct {
+	mu      sync.Mutex
+	now     time.Time
+	holder  string
+	expires time.Time
+}
+
+func (l *leaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req leaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held := l.holder != "" && l.now.Before(l.expires)
+	switch r.Method {
+	case http.MethodPut:
+		if held && l.holder != req.Holder {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		l.holder = req.Holder
+		l.expires = l.now.Add(time.Duration(req.TTLSeconds * float64(time.Second)))
+	case http.MethodDelete:
+		if !held || l.holder != req.Holder {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		l.holder = ""
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (l *leaseServer) advance(d time.Duration) {
+	l.mu.Lock()
+	l.now = l.now.Add(d)
+	l.mu.Unlock()
+}
+
+type fakeLock struct {
+	acquired bool
+	err      error
+	released []string
+}
+
+func (l *fakeLock) Acquire(ctx context.Context, holder string, ttl time.Duration) (bool, error) {
+	return l.acquired, l.err
+}
+
+func (l *fakeLock) Release(ctx context.Context, holder string) error {
+	l.released = append(l.released, holder)
+	return nil
+}
+
+func (s *S) TestFileLockIsExclusive(c *check.C) {
+	dir, err := ioutil.TempDir("", "leader")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leader.lock")
+	first := &fileLock{path: path}
+	second := &fileLock{path: path}
+	ctx := context.Background()
+
+	ok, err := first.Acquire(ctx, "first", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	ok, err = first.Acquire(ctx, "first", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, "first\n")
+
+	ok, err = second.Acquire(ctx, "second", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, false)
+
+	c.Assert(first.Release(ctx, "first"), check.IsNil)
+	ok, err = second.Acquire(ctx, "second", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(second.Release(ctx, "second"), check.IsNil)
+}
+
+func (s *S) TestHTTPLeaseLock(c *check.C) {
+	lease := &leaseServer{now: time.Now()}
+	server := httptest.NewServer(lease)
+	defer server.Close()
+	first := &httpLeaseLock{url: server.URL}
+	second := &httpLeaseLock{url: server.URL}
+	ctx := context.Background()
+
+	ok, err := first.Acquire(ctx, "first", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	ok, err = second.Acquire(ctx, "second", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, false)
+
+	lease.advance(2 * time.Minute)
+	ok, err = second.Acquire(ctx, "second", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+	ok, err = first.Acquire(ctx, "first", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, false)
+
+	c.Assert(first.Release(ctx, "first"), check.IsNil)
+	c.Assert(second.Release(ctx, "second"), check.IsNil)
+	ok, err = first.Acquire(ctx, "first", time.Minute)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+}
+
+func (s *S) TestHTTPLeaseLockUnexpectedResponse(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	lock := &httpLeaseLock{url: server.URL}
+	ok, err := lock.Acquire(context.Background(), "first", time.Minute)
+	c.Assert(err, check.ErrorMatches, "unexpected response acquiring lease: 500 Internal Server Error")
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *S) TestNewLeaderElector(c *check.C) {
+	config := NewConfig()
+	elector, err := newLeaderElector(config)
+	c.Assert(err, check.IsNil)
+	c.Assert(elector, check.IsNil)
+
+	config.leaderElection = "file"
+	_, err = newLeaderElector(config)
+	c.Assert(err, check.ErrorMatches, "LEADER_LOCK_FILE is required by the file leader election")
+	config.leaderLockFile = "/tmp/leader.lock"
+	config.leaderID = "worker-1"
+	elector, err = newLeaderElector(config)
+	c.Assert(err, check.IsNil)
+	c.Assert(elector.id, check.Equals, "worker-1")
+	c.Assert(elector.lock, check.FitsTypeOf, &fileLock{})
+
+	config.leaderElection = "http"
+	_, err = newLeaderElector(config)
+	c.Assert(err, check.ErrorMatches, "LEADER_LEASE_URL is required by the http leader election")
+	config.leaderLeaseURL = "http://localhost:8500/lease"
+	elector, err = newLeaderElector(config)
+	c.Assert(err, check.IsNil)
+	c.Assert(elector.lock, check.FitsTypeOf, &httpLeaseLock{})
+
+	config.leaderElection = "zookeeper"
+	_, err = newLeaderElector(config)
+	c.Assert(err, check.ErrorMatches, "Invalid leader election: zookeeper")
+}
+
+func (s *S) TestLeaderElectorCampaign(c *check.C) {
+	setup(nil)
+	lock := &fakeLock{acquired: true}
+	elector := &leaderElector{lock: lock, id: "worker-1", ttl: time.Minute}
+	c.Assert(elector.campaign(context.Background()), check.Equals, true)
+	c.Assert(elector.isLeader(), check.Equals, true)
+
+	lock.err = errors.New("connection refused")
+	c.Assert(elector.campaign(context.Background()), check.Equals, false)
+	c.Assert(elector.isLeader(), check.Equals, false)
+
+	lock.err = nil
+	elector.campaign(context.Background())
+	elector.resign()
+	c.Assert(elector.isLeader(), check.Equals, false)
+	c.Assert(lock.released, check.DeepEquals, []string{"worker-1"})
+	elector.resign()
+	c.Assert(lock.released, check.HasLen, 1)
+}
+
+func (s *S) TestRunStandsByWhenNotLeader(c *check.C) {
+	setup(nil)
+	lock := &fakeLock{}
+	env.elector = &leaderElector{lock: lock, id: "worker-2", ttl: time.Minute}
+	cmd := &countCmd{runs: make(chan struct{}, 1)}
+	env.cmd = cmd
+	run(context.Background())
+	c.Assert(cmd.runs, check.HasLen, 0)
+
+	lock.acquired = true
+	run(context.Background())
+	c.Assert(cmd.runs, check.HasLen, 1)
+	c.Assert(env.elector.isLeader(), check.Equals, false)
+	c.Assert(lock.released, check.DeepEquals, []string{"worker-2"})
+}
+
+func (s *S) TestRunRepeatStandsByWhenNotLeader(c *check.C) {
+	setup([]string{"--repeat", "1h"})
+	env.elector = &leaderElector{lock: &fakeLock{}, id: "worker-2", ttl: time.Minute}
+	cmd := &countCmd{runs: make(chan struct{}, 1)}
+	env.cmd = cmd
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+	for env.status.report().Phase != phaseStandBy {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("run didn't stop after the context was cancelled")
+	}
+	c.Assert(cmd.runs, check.HasLen, 0)
+}
+
+// postCmd posts its payload when run.
+type postCmd struct {
+	payload []globomap.Payload
+	err     error
+}
+
+func (c *postCmd) Run(ctx context.Context) {
+	_, c.err = env.sink.Post(c.payload)
+}
+
+func (s *S) TestRunStopsPostingWhenLeadershipIsLost(c *check.C) {
+	lock := &fakeLock{acquired: true}
+	var posts int32
+	loader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&posts, 1) == 1 {
+			// another instance takes over while the first chunk is posted
+			lock.acquired = false
+			env.elector.campaign(context.Background())
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+	setup(nil)
+	env.globomap.ChunkInterval = time.Millisecond
+	env.elector = &leaderElector{lock: lock, id: "worker-1", ttl: time.Minute}
+	payload := make([]globomap.Payload, 250)
+	for i := range payload {
+		payload[i] = globomap.Payload{Action: "UPDATE", Collection: "tsuru_team", Type: globomap.PayloadTypeCollection, Key: fmt.Sprintf("tsuru_team%d", i)}
+	}
+	cmd := &postCmd{payload: payload}
+	env.cmd = cmd
+
+	run(context.Background())
+
+	c.Assert(atomic.LoadInt32(&posts), check.Equals, int32(1))
+	c.Assert(cmd.err, check.ErrorMatches, "(?s).*context canceled.*")
+	c.Assert(env.globomap.Context, check.Equals, context.Background())
+}
+
+func (s *S) TestLeaderContext(c *check.C) {
+	setup(nil)
+	lock := &fakeLock{}
+	elector := &leaderElector{lock: lock, id: "worker-1", ttl: time.Minute}
+	ctx, cancel := elector.leaderContext(context.Background())
+	defer cancel()
+	c.Assert(ctx.Err(), check.Equals, context.Canceled)
+
+	lock.acquired = true
+	elector.campaign(context.Background())
+	ctx, cancel = elector.leaderContext(context.Background())
+	defer cancel()
+	c.Assert(ctx.Err(), check.IsNil)
+	elector.resign()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		c.Fatal("context wasn't cancelled after resigning")
+	}
+}
+
+func (s *S) TestRetryQueueDoesNotRetryWhenInactive(c *check.C) {
+	setup(nil)
+	env.config.retrySleepTime = 0
+	q, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+	processed := make(chan bool, 1)
+	q.process = func(retryEntry) bool {
+		processed <- true
+		return true
+	}
+	q.active = func() bool { return false }
+
+	q.add(&nodeOperation{nodeAddr: "https://1.1.1.1:2376"})
+	select {
+	case <-processed:
+		c.Fatal("inactive queue retried a node")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Assert(q.stop(), check.IsNil)
+	c.Assert(q.pending(), check.HasLen, 1)
+}
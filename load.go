@@ -5,80 +5,78 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"sync"
 	"time"
+
+	"github.com/tsuru/globomap-integration/logger"
 )
 
 type loadCmd struct {
 	wg sync.WaitGroup
 }
 
-func (c *loadCmd) Run() {
-	c.wg.Add(4)
+func (c *loadCmd) Run(ctx context.Context) {
+	env.compUnitReport.reset()
+	c.wg.Add(10)
 
-	go c.loadApps()
+	go c.loadApps(ctx)
 	go c.loadPools()
 	go c.loadNodes()
 	go c.loadServices()
+	go c.loadTeams()
+	go c.loadPlatforms()
+	go c.loadRouters()
+	go c.loadVolumes()
+	go c.loadPlans()
+	go c.loadServiceBrokers()
 
 	c.wg.Wait()
+	env.compUnitReport.log()
 }
 
-func (c *loadCmd) loadApps() {
+// loadApps fetches the info of each app, which may take long, so it stops
+// early when the context is cancelled.
+func (c *loadCmd) loadApps(ctx context.Context) {
 	defer c.wg.Done()
 	apps, err := env.tsuru.AppList()
 	if err != nil {
-		if env.config.verbose {
-			fmt.Printf("Error fetching apps: %s\n", err)
-		}
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "app", "error": err}).Errorf("error fetching apps")
 		return
 	}
 
 	if len(apps) == 0 {
-		if env.config.verbose {
-			fmt.Println("No apps to process")
-		}
+		env.log.WithField("entity", "app").Debugf("no apps to process")
 		return
 	}
-	if env.config.verbose {
-		fmt.Printf("Processing %d apps\n", len(apps))
+	env.log.WithField("entity", "app").Debugf("processing %d apps", len(apps))
+
+	hosts, err := unitHosts()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "unit", "error": err}).Errorf("error fetching nodes, units won't be linked to their hosts")
 	}
 
-	appOps := make([]operation, 2*len(apps))
-	var i int
+	var appOps []operation
+	var unitOps []operation
 	for _, app := range apps {
-		cachedApp, err := env.tsuru.AppInfo(app.Name)
+		if ctx.Err() != nil {
+			env.log.WithField("entity", "app").Warnf("load interrupted, apps were not posted")
+			return
+		}
+		cachedApp, units, err := env.tsuru.AppInfoWithUnits(app.Name)
 		if err != nil {
-			if env.config.verbose {
-				fmt.Printf("Error fetching app %s info: %s\n", app.Name, err)
-			}
+			env.status.recordError(subsystemTsuru, err)
+			env.log.With(logger.Fields{"entity": "app", "target": app.Name, "error": err}).Errorf("error fetching app info")
 			continue
 		}
 
-		op := &appOperation{
-			baseOperation: baseOperation{
-				action: "UPDATE",
-				time:   time.Now(),
-			},
-			appName:   cachedApp.Name,
-			cachedApp: cachedApp,
-		}
-		appOps[i] = op
-		i++
-
-		appPoolOp := &appPoolOperation{
-			baseOperation: baseOperation{
-				action: "UPDATE",
-				time:   time.Now(),
-			},
-			appName:   cachedApp.Name,
-			cachedApp: cachedApp,
-		}
-		appOps[i] = appPoolOp
-		i++
+		appOps = append(appOps, appOperations("UPDATE", time.Now(), cachedApp)...)
+		unitOps = append(unitOps, unitOperations("UPDATE", time.Now(), units, hosts)...)
 	}
 	postUpdates(appOps)
+	postUpdates(unitOps)
 }
 
 func (c *loadCmd) loadPools() {
@@ -86,23 +84,19 @@ func (c *loadCmd) loadPools() {
 	var err error
 	env.pools, err = env.tsuru.PoolList()
 	if err != nil {
-		if env.config.verbose {
-			fmt.Printf("Error fetching pools: %s\n", err)
-		}
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "pool", "error": err}).Errorf("error fetching pools")
 		return
 	}
 
 	if len(env.pools) == 0 {
-		if env.config.verbose {
-			fmt.Println("No pools to process")
-		}
+		env.log.WithField("entity", "pool").Debugf("no pools to process")
 		return
 	}
-	if env.config.verbose {
-		fmt.Printf("Processing %d pools\n", len(env.pools))
-	}
+	env.log.WithField("entity", "pool").Debugf("processing %d pools", len(env.pools))
 
 	poolOps := make([]operation, len(env.pools))
+	var teamPoolOps []operation
 	var i int
 	for _, pool := range env.pools {
 		op := &poolOperation{
@@ -114,34 +108,41 @@ func (c *loadCmd) loadPools() {
 		}
 		poolOps[i] = op
 		i++
+
+		for _, team := range pool.Teams {
+			teamPoolOps = append(teamPoolOps, &teamPoolOperation{
+				baseOperation: baseOperation{
+					action: "UPDATE",
+					time:   time.Now(),
+				},
+				poolName: pool.Name,
+				teamName: team,
+			})
+		}
 	}
 	postUpdates(poolOps)
+	postUpdates(teamPoolOps)
 }
 
 func (c *loadCmd) loadNodes() {
 	defer c.wg.Done()
-	var err error
-	env.nodes, err = env.tsuru.NodeList()
+	nodes, err := env.tsuru.NodeList()
 	if err != nil {
-		if env.config.verbose {
-			fmt.Printf("Error fetching nodes: %s\n", err)
-		}
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "node", "error": err}).Errorf("error fetching nodes")
 		return
 	}
+	setNodes(nodes)
 
-	if len(env.nodes) == 0 {
-		if env.config.verbose {
-			fmt.Println("No nodes to process")
-		}
+	if len(nodes) == 0 {
+		env.log.WithField("entity", "node").Debugf("no nodes to process")
 		return
 	}
-	if env.config.verbose {
-		fmt.Printf("Processing %d nodes\n", len(env.nodes))
-	}
+	env.log.WithField("entity", "node").Debugf("processing %d nodes", len(nodes))
 
-	nodeOps := make([]operation, len(env.nodes))
+	nodeOps := make([]operation, len(nodes))
 	var i int
-	for _, node := range env.nodes {
+	for _, node := range nodes {
 		op := &nodeOperation{
 			baseOperation: baseOperation{
 				action: "UPDATE",
@@ -159,27 +160,24 @@ func (c *loadCmd) loadServices() {
 	defer c.wg.Done()
 	services, err := env.tsuru.ServiceList()
 	if err != nil {
-		if env.config.verbose {
-			fmt.Printf("Error fetching services: %s\n", err)
-		}
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "service", "error": err}).Errorf("error fetching services")
 		return
 	}
 
 	if len(services) == 0 {
-		if env.config.verbose {
-			fmt.Println("No services to process")
-		}
+		env.log.WithField("entity", "service").Debugf("no services to process")
 		return
 	}
 
-	if env.config.verbose {
-		fmt.Printf("Processing %d services\n", len(services))
-	}
+	env.log.WithField("entity", "service").Debugf("processing %d services", len(services))
 
 	serviceOps := make([]operation, len(services))
+	var brokerServiceOps []operation
 	var instanceOps []operation
 	var serviceInstanceOps []operation
 	var appInstanceOps []operation
+	var teamInstanceOps []operation
 	for i := range services {
 		serviceOps[i] = &serviceOperation{
 			baseOperation: baseOperation{
@@ -189,6 +187,14 @@ func (c *loadCmd) loadServices() {
 			service: services[i],
 		}
 
+		brokerServiceOps = append(brokerServiceOps, &serviceBrokerServiceOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			serviceName: services[i].Service,
+		})
+
 		for _, instance := range services[i].ServiceInstances {
 			instanceOps = append(instanceOps, &serviceInstanceOperation{
 				baseOperation: baseOperation{
@@ -206,6 +212,14 @@ func (c *loadCmd) loadServices() {
 				instance: instance,
 			})
 
+			teamInstanceOps = append(teamInstanceOps, &teamServiceInstanceOperation{
+				baseOperation: baseOperation{
+					action: "UPDATE",
+					time:   time.Now(),
+				},
+				instance: instance,
+			})
+
 			for _, app := range instance.Apps {
 				appInstanceOps = append(appInstanceOps, &appServiceInstanceOperation{
 					baseOperation: baseOperation{
@@ -224,4 +238,202 @@ func (c *loadCmd) loadServices() {
 	postUpdates(serviceOps)
 	postUpdates(serviceInstanceOps)
 	postUpdates(appInstanceOps)
+	postUpdates(teamInstanceOps)
+	postUpdates(brokerServiceOps)
+}
+
+func (c *loadCmd) loadTeams() {
+	defer c.wg.Done()
+	teams, err := env.tsuru.TeamList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "team", "error": err}).Errorf("error fetching teams")
+		return
+	}
+
+	if len(teams) == 0 {
+		env.log.WithField("entity", "team").Debugf("no teams to process")
+		return
+	}
+	env.log.WithField("entity", "team").Debugf("processing %d teams", len(teams))
+
+	teamOps := make([]operation, len(teams))
+	for i := range teams {
+		teamOps[i] = &teamOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			team: teams[i],
+		}
+	}
+	postUpdates(teamOps)
+}
+
+func (c *loadCmd) loadPlatforms() {
+	defer c.wg.Done()
+	platforms, err := env.tsuru.PlatformList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "platform", "error": err}).Errorf("error fetching platforms")
+		return
+	}
+
+	if len(platforms) == 0 {
+		env.log.WithField("entity", "platform").Debugf("no platforms to process")
+		return
+	}
+	env.log.WithField("entity", "platform").Debugf("processing %d platforms", len(platforms))
+
+	platformOps := make([]operation, len(platforms))
+	for i := range platforms {
+		platformOps[i] = &platformOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			platform: platforms[i],
+		}
+	}
+	postUpdates(platformOps)
+}
+
+func (c *loadCmd) loadRouters() {
+	defer c.wg.Done()
+	routers, err := env.tsuru.RouterList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "router", "error": err}).Errorf("error fetching routers")
+		return
+	}
+
+	if len(routers) == 0 {
+		env.log.WithField("entity", "router").Debugf("no routers to process")
+		return
+	}
+	env.log.WithField("entity", "router").Debugf("processing %d routers", len(routers))
+
+	routerOps := make([]operation, len(routers))
+	for i := range routers {
+		routerOps[i] = &routerOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			router: routers[i],
+		}
+	}
+	postUpdates(routerOps)
+}
+
+func (c *loadCmd) loadVolumes() {
+	defer c.wg.Done()
+	volumes, err := env.tsuru.VolumeList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "volume", "error": err}).Errorf("error fetching volumes")
+		return
+	}
+
+	if len(volumes) == 0 {
+		env.log.WithField("entity", "volume").Debugf("no volumes to process")
+		return
+	}
+	env.log.WithField("entity", "volume").Debugf("processing %d volumes", len(volumes))
+
+	volumeOps := make([]operation, len(volumes))
+	volumePoolOps := make([]operation, len(volumes))
+	var appVolumeOps []operation
+	for i := range volumes {
+		volumeOps[i] = &volumeOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			volume: volumes[i],
+		}
+		volumePoolOps[i] = &volumePoolOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			volume: volumes[i],
+		}
+
+		for j := range volumes[i].Binds {
+			bind := volumes[i].Binds[j]
+			if bind.Id == nil {
+				continue
+			}
+			appVolumeOps = append(appVolumeOps, &appVolumeOperation{
+				baseOperation: baseOperation{
+					action: "UPDATE",
+					time:   time.Now(),
+				},
+				appName:    bind.Id.App,
+				volumeName: volumes[i].Name,
+				mountpoint: bind.Id.Mountpoint,
+				bind:       &bind,
+			})
+		}
+	}
+	postUpdates(volumeOps)
+	postUpdates(volumePoolOps)
+	postUpdates(appVolumeOps)
+}
+
+func (c *loadCmd) loadPlans() {
+	defer c.wg.Done()
+	plans, err := env.tsuru.PlanList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "plan", "error": err}).Errorf("error fetching plans")
+		return
+	}
+
+	if len(plans) == 0 {
+		env.log.WithField("entity", "plan").Debugf("no plans to process")
+		return
+	}
+	env.log.WithField("entity", "plan").Debugf("processing %d plans", len(plans))
+
+	planOps := make([]operation, len(plans))
+	for i := range plans {
+		planOps[i] = &planOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			plan: plans[i],
+		}
+	}
+	postUpdates(planOps)
+}
+
+func (c *loadCmd) loadServiceBrokers() {
+	defer c.wg.Done()
+	brokers, err := env.tsuru.ServiceBrokerList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.With(logger.Fields{"entity": "service-broker", "error": err}).Errorf("error fetching service brokers")
+		return
+	}
+
+	if len(brokers) == 0 {
+		env.log.WithField("entity", "service-broker").Debugf("no service brokers to process")
+		return
+	}
+	env.log.WithField("entity", "service-broker").Debugf("processing %d service brokers", len(brokers))
+
+	brokerOps := make([]operation, len(brokers))
+	for i := range brokers {
+		brokerOps[i] = &serviceBrokerOperation{
+			baseOperation: baseOperation{
+				action: "UPDATE",
+				time:   time.Now(),
+			},
+			broker: brokers[i],
+		}
+	}
+	postUpdates(brokerOps)
 }
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -25,9 +26,10 @@ func (s *S) TestLoadCmdRun(c *check.C) {
 		a2 := app{Name: "myapp2", Pool: "pool1"}
 		services := []tsuru.Service{
 			{Service: "myservice1", ServiceInstances: []tsuru.ServiceInstance{
-				{ServiceName: "myservice1", Name: "myinstance", Apps: []string{"myapp1", "myapp2"}},
+				{ServiceName: "myservice1", Name: "myinstance", TeamOwner: "team1", Apps: []string{"myapp1", "myapp2"}},
 			}},
 			{Service: "myservice2", ServiceInstances: []tsuru.ServiceInstance{{ServiceName: "myservice2", Name: "myinstance"}}},
+			{Service: "broker1::myservice3"},
 		}
 		switch req.URL.Path {
 		case "/1.0/apps":
@@ -35,13 +37,32 @@ func (s *S) TestLoadCmdRun(c *check.C) {
 		case "/1.0/apps/myapp1":
 			atomic.AddInt32(&requestAppInfo1, 1)
 			a1.Description = "my first app"
-			json.NewEncoder(w).Encode(a1)
+			json.NewEncoder(w).Encode(struct {
+				app
+				Units []unit `json:"units"`
+			}{a1, []unit{{Id: "unit1", Appname: "myapp1", Processname: "web", Ip: "1.1.1.1", Status: "started"}}})
 		case "/1.0/apps/myapp2":
 			atomic.AddInt32(&requestAppInfo2, 1)
 			a2.Description = "my second app"
 			json.NewEncoder(w).Encode(a2)
 		case "/1.0/pools":
-			json.NewEncoder(w).Encode([]pool{{Name: "pool1"}})
+			json.NewEncoder(w).Encode([]pool{{Name: "pool1", Teams: []string{"team1"}}})
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+		case "/1.0/routers":
+			json.NewEncoder(w).Encode([]tsuru.Router{{Name: "galeb", Type_: "galebv2"}})
+		case "/1.4/volumes":
+			json.NewEncoder(w).Encode([]tsuru.Volume{{
+				Name:  "vol1",
+				Pool:  "pool1",
+				Binds: []tsuru.VolumeBind{{Id: &tsuru.VolumeBindId{App: "myapp1", Mountpoint: "/data", Volume: "vol1"}}},
+			}})
+		case "/1.0/plans":
+			json.NewEncoder(w).Encode([]tsuru.Plan{{Name: "large", Default_: true}})
+		case "/1.7/brokers":
+			json.NewEncoder(w).Encode(tsuru.ServiceBrokerList{Brokers: []tsuru.ServiceBroker{{Name: "broker1", URL: "https://broker.example.com"}}})
+		case "/1.0/platforms":
+			json.NewEncoder(w).Encode([]tsuru.Platform{{Name: "python", Disabled: true}})
 		case "/1.2/node":
 			n1 := node{Pool: "pool1", Iaasid: "node1", Address: "https://1.1.1.1:2376"}
 			n2 := node{Pool: "pool2", Iaasid: "node2", Address: "https://2.2.2.2:2376"}
@@ -79,7 +100,7 @@ func (s *S) TestLoadCmdRun(c *check.C) {
 	defer globomapApi.Close()
 	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
 
-	requests := make(chan bool, 7)
+	requests := make(chan bool, 20)
 	globomapLoader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			requests <- true
@@ -162,16 +183,21 @@ func (s *S) TestLoadCmdRun(c *check.C) {
 			c.Assert(ok, check.Equals, true)
 			c.Assert(props["address"], check.Equals, "https://1.1.1.1:2376")
 		case "tsuru_service":
-			c.Assert(data, check.HasLen, 2)
+			c.Assert(data, check.HasLen, 3)
 			c.Assert(data[0].Action, check.Equals, "UPDATE")
 			c.Assert(data[0].Collection, check.Equals, "tsuru_service")
 			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
-			c.Assert(data[0].Key, check.Equals, "tsuru_myservice1")
+			c.Assert(data[0].Key, check.Equals, "tsuru_broker1::myservice3")
 
 			c.Assert(data[1].Action, check.Equals, "UPDATE")
 			c.Assert(data[1].Collection, check.Equals, "tsuru_service")
 			c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
-			c.Assert(data[1].Key, check.Equals, "tsuru_myservice2")
+			c.Assert(data[1].Key, check.Equals, "tsuru_myservice1")
+
+			c.Assert(data[2].Action, check.Equals, "UPDATE")
+			c.Assert(data[2].Collection, check.Equals, "tsuru_service")
+			c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[2].Key, check.Equals, "tsuru_myservice2")
 		case "tsuru_service_instance":
 			c.Assert(data, check.HasLen, 2)
 			c.Assert(data[0].Action, check.Equals, "UPDATE")
@@ -205,6 +231,119 @@ func (s *S) TestLoadCmdRun(c *check.C) {
 			c.Assert(el["name"], check.Equals, "myapp1_myinstance")
 			c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
 			c.Assert(el["to"], check.Equals, "tsuru_service_instance/tsuru_myservice1_myinstance")
+		case "tsuru_team":
+			c.Assert(data, check.HasLen, 1)
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[0].Key, check.Equals, "tsuru_team1")
+		case "tsuru_platform":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[0].Key, check.Equals, "tsuru_python")
+			props, ok := el["properties"].(map[string]interface{})
+			c.Assert(ok, check.Equals, true)
+			c.Assert(props["disabled"], check.Equals, "true")
+		case "tsuru_router":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[0].Key, check.Equals, "tsuru_galeb")
+			props, ok := el["properties"].(map[string]interface{})
+			c.Assert(ok, check.Equals, true)
+			c.Assert(props["type"], check.Equals, "galebv2")
+		case "tsuru_volume":
+			c.Assert(data, check.HasLen, 1)
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[0].Key, check.Equals, "tsuru_vol1")
+		case "tsuru_volume_pool":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[0].Key, check.Equals, "tsuru_vol1-pool")
+			c.Assert(el["from"], check.Equals, "tsuru_volume/tsuru_vol1")
+			c.Assert(el["to"], check.Equals, "tsuru_pool/tsuru_pool1")
+		case "tsuru_app_volume":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[0].Key, check.Equals, "tsuru_myapp1_vol1_data")
+			c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+			c.Assert(el["to"], check.Equals, "tsuru_volume/tsuru_vol1")
+		case "tsuru_app_unit":
+			c.Assert(data, check.HasLen, 3)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[0].Key, check.Equals, "tsuru_unit1")
+			c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+			c.Assert(el["to"], check.Equals, "tsuru_unit/tsuru_unit1")
+
+			el = data[1].Element
+			c.Assert(data[1].Action, check.Equals, "UPDATE")
+			c.Assert(data[1].Collection, check.Equals, "tsuru_unit")
+			c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[1].Key, check.Equals, "tsuru_unit1")
+			props, ok := el["properties"].(map[string]interface{})
+			c.Assert(ok, check.Equals, true)
+			c.Assert(props["process_name"], check.Equals, "web")
+			c.Assert(props["ip"], check.Equals, "1.1.1.1")
+			c.Assert(props["status"], check.Equals, "started")
+
+			el = data[2].Element
+			c.Assert(data[2].Action, check.Equals, "UPDATE")
+			c.Assert(data[2].Collection, check.Equals, "tsuru_unit_comp_unit")
+			c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[2].Key, check.Equals, "tsuru_unit1")
+			c.Assert(el["from"], check.Equals, "tsuru_unit/tsuru_unit1")
+			c.Assert(el["to"], check.Equals, "comp_unit/globomap_node1")
+		case "tsuru_plan":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[0].Key, check.Equals, "tsuru_large")
+			props, ok := el["properties"].(map[string]interface{})
+			c.Assert(ok, check.Equals, true)
+			c.Assert(props["default"], check.Equals, "true")
+		case "tsuru_service_broker":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+			c.Assert(data[0].Key, check.Equals, "tsuru_broker1")
+			props, ok := el["properties"].(map[string]interface{})
+			c.Assert(ok, check.Equals, true)
+			c.Assert(props["url"], check.Equals, "https://broker.example.com")
+		case "tsuru_service_broker_service":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[0].Key, check.Equals, "tsuru_broker1::myservice3")
+			c.Assert(el["from"], check.Equals, "tsuru_service_broker/tsuru_broker1")
+			c.Assert(el["to"], check.Equals, "tsuru_service/tsuru_broker1::myservice3")
+		case "tsuru_team_pool":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[0].Key, check.Equals, "tsuru_pool1_team1")
+			c.Assert(el["from"], check.Equals, "tsuru_team/tsuru_team1")
+			c.Assert(el["to"], check.Equals, "tsuru_pool/tsuru_pool1")
+		case "tsuru_team_service_instance":
+			c.Assert(data, check.HasLen, 1)
+			el := data[0].Element
+			c.Assert(data[0].Action, check.Equals, "UPDATE")
+			c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[0].Key, check.Equals, "tsuru_myservice1_myinstance-team")
+			c.Assert(el["from"], check.Equals, "tsuru_team/tsuru_team1")
+			c.Assert(el["to"], check.Equals, "tsuru_service_instance/tsuru_myservice1_myinstance")
 		}
 	}))
 	defer globomapLoader.Close()
@@ -212,7 +351,7 @@ func (s *S) TestLoadCmdRun(c *check.C) {
 	setup(nil)
 
 	cmd := &loadCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	start := time.Now()
 	fullTimeout := 5 * time.Second
@@ -252,7 +391,7 @@ func (s *S) TestLoadCmdRunNoRequestWhenNoData(c *check.C) {
 	setup(nil)
 
 	cmd := &loadCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -271,6 +410,7 @@ func (s *S) TestLoadCmdRunAppProperties(c *check.C) {
 			Ip:          "myapp1.example.com",
 			Cname:       []string{"myapp1.alias.com"},
 			Router:      "galeb",
+			Routeropts:  map[string]string{"domain": "example.com"},
 			Owner:       "me@example.com",
 			TeamOwner:   "my-team",
 			Teams:       []string{"team1", "team2"},
@@ -301,7 +441,7 @@ func (s *S) TestLoadCmdRunAppProperties(c *check.C) {
 		err := decoder.Decode(&data)
 		c.Assert(err, check.IsNil)
 		defer r.Body.Close()
-		c.Assert(data, check.HasLen, 2)
+		c.Assert(data, check.HasLen, 6)
 
 		sortPayload(data)
 		el := data[0].Element
@@ -320,31 +460,63 @@ func (s *S) TestLoadCmdRunAppProperties(c *check.C) {
 		c.Assert(props["owner"], check.Equals, "me@example.com")
 		c.Assert(props["team_owner"], check.Equals, "my-team")
 		c.Assert(props["teams"], check.DeepEquals, []interface{}{"team1", "team2"})
-		c.Assert(props["plan_name"], check.Equals, "large")
-		c.Assert(props["plan_router"], check.Equals, "galeb1")
-		c.Assert(props["plan_memory"], check.Equals, "1073741824")
-		c.Assert(props["plan_swap"], check.Equals, "0")
-		c.Assert(props["plan_cpushare"], check.Equals, "1024")
+		_, ok = props["plan_name"]
+		c.Assert(ok, check.Equals, false)
 		_, ok = el["properties_metadata"]
 		c.Assert(ok, check.Equals, true)
 
 		el = data[1].Element
 		c.Assert(data[1].Action, check.Equals, "UPDATE")
-		c.Assert(data[1].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[1].Collection, check.Equals, "tsuru_app_plan")
 		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[1].Key, check.Equals, "tsuru_myapp1-pool")
+		c.Assert(data[1].Key, check.Equals, "tsuru_myapp1-plan")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_plan/tsuru_large")
+
+		el = data[2].Element
+		c.Assert(data[2].Action, check.Equals, "UPDATE")
+		c.Assert(data[2].Collection, check.Equals, "tsuru_app_platform")
+		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[2].Key, check.Equals, "tsuru_myapp1-platform")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_platform/tsuru_go")
+
+		el = data[3].Element
+		c.Assert(data[3].Action, check.Equals, "UPDATE")
+		c.Assert(data[3].Collection, check.Equals, "tsuru_app_router")
+		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[3].Key, check.Equals, "tsuru_myapp1-router")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_router/tsuru_galeb")
+		props, ok = el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["domain"], check.Equals, "example.com")
+
+		el = data[4].Element
+		c.Assert(data[4].Action, check.Equals, "UPDATE")
+		c.Assert(data[4].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[4].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[4].Key, check.Equals, "tsuru_myapp1-pool")
 		c.Assert(el["name"], check.Equals, "myapp1-pool")
 		_, ok = el["properties"]
 		c.Assert(ok, check.Equals, false)
 		_, ok = el["properties_metadata"]
 		c.Assert(ok, check.Equals, false)
+
+		el = data[5].Element
+		c.Assert(data[5].Action, check.Equals, "UPDATE")
+		c.Assert(data[5].Collection, check.Equals, "tsuru_team_app")
+		c.Assert(data[5].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[5].Key, check.Equals, "tsuru_myapp1-team")
+		c.Assert(el["from"], check.Equals, "tsuru_team/tsuru_my-team")
+		c.Assert(el["to"], check.Equals, "tsuru_app/tsuru_myapp1")
 	}))
 	defer server.Close()
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
 	setup(nil)
 
 	cmd := &loadCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
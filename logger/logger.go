@@ -0,0 +1,218 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logger provides a leveled logger that writes either plain text or
+// JSON lines, carrying a set of fields along with each message.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("invalid log level %q", name)
+}
+
+type Format int
+
+const (
+	Text Format = iota
+	JSON
+)
+
+// ParseFormat returns the format with the given name, either text or json.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	}
+	return Text, fmt.Errorf("invalid log format %q", name)
+}
+
+type Fields map[string]interface{}
+
+// Logger writes messages at or above its level. Loggers derived with With
+// share the output and the fields set with Set.
+type Logger struct {
+	core   *core
+	fields Fields
+}
+
+type core struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  Level
+	format Format
+	now    func() time.Time
+	fields Fields
+}
+
+func New(out io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		core: &core{
+			out:    out,
+			level:  level,
+			format: format,
+			now:    time.Now,
+			fields: Fields{},
+		},
+	}
+}
+
+// With returns a logger that adds the given fields to every message.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{core: l.core, fields: merged}
+}
+
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return l.With(Fields{key: value})
+}
+
+// Set adds a field to the messages of this logger and of every logger
+// derived from it, such as the id of the current run.
+func (l *Logger) Set(key string, value interface{}) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	fields := make(Fields, len(l.core.fields)+1)
+	for k, v := range l.core.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	l.core.fields = fields
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.core.level
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.Logf(Debug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Logf(Info, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Logf(Warn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Logf(Error, format, args...)
+}
+
+func (l *Logger) Logf(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	fields := make(Fields, len(l.core.fields)+len(l.fields))
+	for k, v := range l.core.fields {
+		fields[k] = v
+	}
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	now := l.core.now().UTC()
+	if l.core.format == JSON {
+		l.core.writeJSON(now, level, msg, fields)
+	} else {
+		l.core.writeText(now, level, msg, fields)
+	}
+}
+
+func (c *core) writeJSON(now time.Time, level Level, msg string, fields Fields) {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]string{
+			"time":  entry["time"].(string),
+			"level": Error.String(),
+			"msg":   fmt.Sprintf("failed to encode log entry %q: %s", msg, err),
+		})
+	}
+	c.out.Write(append(data, '\n'))
+}
+
+func (c *core) writeText(now time.Time, level Level, msg string, fields Fields) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %s", now.Format(time.RFC3339), strings.ToUpper(level.String()), msg)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, textValue(fields[k]))
+	}
+	b.WriteByte('\n')
+	io.WriteString(c.out, b.String())
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch value := v.(type) {
+	case json.RawMessage:
+		return string(value)
+	case error:
+		s = value.Error()
+	default:
+		s = fmt.Sprint(value)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+func newTestLogger(level Level, format Format) (*Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := New(&buf, level, format)
+	l.core.now = func() time.Time {
+		return time.Date(2017, 10, 1, 12, 30, 0, 0, time.UTC)
+	}
+	return l, &buf
+}
+
+func (s *S) TestParseLevel(c *check.C) {
+	level, err := ParseLevel("WARN")
+	c.Assert(err, check.IsNil)
+	c.Assert(level, check.Equals, Warn)
+
+	_, err = ParseLevel("verbose")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestParseFormat(c *check.C) {
+	format, err := ParseFormat("json")
+	c.Assert(err, check.IsNil)
+	c.Assert(format, check.Equals, JSON)
+
+	_, err = ParseFormat("xml")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestLogText(c *check.C) {
+	l, buf := newTestLogger(Info, Text)
+	l.With(Fields{"target": "myapp", "error": errors.New("not found")}).Errorf("error fetching %s", "app")
+	c.Assert(buf.String(), check.Equals, "2017-10-01T12:30:00Z ERROR error fetching app error=\"not found\" target=myapp\n")
+}
+
+func (s *S) TestLogTextRawJSON(c *check.C) {
+	l, buf := newTestLogger(Info, Text)
+	l.WithField("payload", json.RawMessage(`[{"key":"k1"}]`)).Infof("dry mode")
+	c.Assert(buf.String(), check.Equals, "2017-10-01T12:30:00Z INFO  dry mode payload=[{\"key\":\"k1\"}]\n")
+}
+
+func (s *S) TestLogJSON(c *check.C) {
+	l, buf := newTestLogger(Debug, JSON)
+	l.Set("run_id", "abc")
+	l.With(Fields{"collection": "tsuru_app", "count": 2}).Debugf("posted")
+	var entry map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	c.Assert(err, check.IsNil)
+	c.Assert(entry, check.DeepEquals, map[string]interface{}{
+		"time":       "2017-10-01T12:30:00Z",
+		"level":      "debug",
+		"msg":        "posted",
+		"run_id":     "abc",
+		"collection": "tsuru_app",
+		"count":      float64(2),
+	})
+}
+
+func (s *S) TestLogBelowLevel(c *check.C) {
+	l, buf := newTestLogger(Warn, Text)
+	l.Debugf("debug")
+	l.Infof("info")
+	c.Assert(buf.Len(), check.Equals, 0)
+	l.Warnf("warn")
+	c.Assert(buf.Len(), check.Not(check.Equals), 0)
+}
+
+func (s *S) TestSetIsSharedWithDerivedLoggers(c *check.C) {
+	l, buf := newTestLogger(Info, Text)
+	child := l.WithField("entity", "node")
+	l.Set("run_id", "1")
+	child.Infof("first")
+	l.Set("run_id", "2")
+	child.WithField("run_id", "overridden").Infof("second")
+	c.Assert(buf.String(), check.Equals, "2017-10-01T12:30:00Z INFO  first entity=node run_id=1\n"+
+		"2017-10-01T12:30:00Z INFO  second entity=node run_id=overridden\n")
+}
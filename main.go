@@ -5,24 +5,46 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
+)
+
+// Exit codes. A worker stopped by a signal exits with exitOK once the
+// current run is finished or aborted and the pending retries are saved.
+const (
+	exitOK      = 0
+	exitFailure = 1
 )
 
 type command interface {
-	Run()
+	Run(ctx context.Context)
 }
 
 type environment struct {
-	config   configParams
-	cmd      command
-	tsuru    *tsuruClient
-	globomap *globomap.Client
-	pools    []pool
-	nodes    []node
+	config     configParams
+	cmd        command
+	tsuru      *tsuruClient
+	globomap   *globomap.Client
+	sink       sink
+	checkpoint checkpointStore
+	retryQueue *retryQueue
+	hashes     *hashStore
+	elector    *leaderElector
+	status     *runStatus
+	log        *logger.Logger
+	pools      []pool
+	nodes      []node
+
+	compUnitMatchers []compUnitMatcher
+	compUnitReport   *compUnitReport
 }
 
 var env environment
@@ -35,6 +57,12 @@ func setup(args []string) {
 	if err != nil {
 		panic(err)
 	}
+	logOutput := os.Stdout
+	if env.config.diff {
+		// keeps stdout for the diff, so it can be piped
+		logOutput = os.Stderr
+	}
+	env.log = logger.New(logOutput, env.config.logLevel, env.config.logFormat)
 	env.tsuru = &tsuruClient{
 		Hostname: env.config.tsuruHostname,
 		Token:    env.config.tsuruToken,
@@ -45,34 +73,186 @@ func setup(args []string) {
 		Username:       env.config.globomapUsername,
 		Password:       env.config.globomapPassword,
 		ChunkInterval:  env.config.sleepTimeBetweenChunks,
-		Verbose:        env.config.verbose,
+		Logger:         env.log,
 		Dry:            env.config.dry,
+		JobTimeout:     env.config.jobTimeout,
+		Retry:          &env.config.postRetry,
+		ChunkObserver:  recordChunk,
+	}
+	env.sink = env.globomap
+	if env.config.diff {
+		env.globomap.DiffOutput = os.Stdout
+		env.globomap.DiffFormat = env.config.diffFormat
+	}
+	env.compUnitMatchers, err = newCompUnitMatchers(env.config)
+	if err != nil {
+		panic(err)
+	}
+	env.compUnitReport = &compUnitReport{}
+	env.status = newRunStatus()
+	env.retryQueue, err = newRetryQueue(env.config)
+	if err != nil {
+		panic(err)
+	}
+	if env.config.exportFile == "" {
+		// the export writes every document, so it doesn't skip unchanged ones
+		env.hashes, err = newHashStore(env.config)
+		if err != nil {
+			panic(err)
+		}
+	}
+	env.elector, err = newLeaderElector(env.config)
+	if err != nil {
+		panic(err)
+	}
+	if env.elector != nil {
+		env.retryQueue.active = env.elector.isLeader
+	}
+	if env.config.checkpointFile != "" {
+		env.checkpoint = &fileCheckpointStore{path: env.config.checkpointFile}
 	}
 }
 
 func main() {
 	setup(os.Args[1:])
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env.tsuru.Context = ctx
+	env.globomap.Context = ctx
+	if addr := env.config.adminAddress(); addr != "" {
+		go serveAdmin(addr)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+
+	code := exitOK
+	select {
+	case <-done:
+	case sig := <-signals:
+		env.log.Infof("received %s, shutting down", sig)
+		cancel()
+		code = waitShutdown(done, signals)
+	}
+	if err := env.retryQueue.stop(); err != nil {
+		env.log.WithField("error", err).Errorf("error saving pending retries")
+		code = exitFailure
+	}
+	os.Exit(code)
+}
+
+// run runs the command once, or in a loop in repeat mode, until the
+// context is cancelled. With leader election, only the leader runs it.
+func run(ctx context.Context) {
+	if env.elector != nil {
+		env.elector.campaign(ctx)
+		electorDone := make(chan struct{})
+		defer func() { <-electorDone }()
+		electorCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			defer close(electorDone)
+			env.elector.run(electorCtx)
+		}()
+	}
 	if env.config.repeat == nil {
-		env.cmd.Run()
+		if !leading() {
+			return
+		}
+		runCmd(ctx)
 		return
 	}
+	env.retryQueue.start()
 	for {
 		start := time.Now()
-		env.cmd.Run()
+		if leading() {
+			env.status.startRun()
+			runCmd(ctx)
+			env.status.endRun(start.Add(*env.config.repeat))
+		} else {
+			env.status.standBy(start.Add(*env.config.repeat))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		pending := env.retryQueue.pending()
+		if len(pending) > 0 {
+			env.log.Debugf("%d nodes pending comp_unit retry", len(pending))
+		}
+		for _, e := range pending {
+			env.log.With(logger.Fields{
+				"entity":   "node",
+				"target":   e.NodeAddr,
+				"attempts": e.Attempts,
+				"next_try": e.NextTry.Format(time.RFC3339),
+			}).Debugf("pending comp_unit retry")
+		}
 		diff := *env.config.repeat - time.Since(start)
 		if diff > 0 {
-			if env.config.verbose {
-				fmt.Printf("waiting %s...\n", diff)
+			env.log.Debugf("waiting %s...", diff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(diff):
 			}
-			time.Sleep(diff)
 		}
 
 		env.pools = nil
-		env.nodes = nil
+		setNodes(nil)
+		env.compUnitReport.reset()
+	}
+}
+
+// runCmd runs the command once. With leader election, the run and the
+// requests made by the clients meanwhile are cancelled when the instance
+// loses the leadership.
+func runCmd(ctx context.Context) {
+	if env.elector != nil {
+		runCtx, cancel := env.elector.leaderContext(ctx)
+		defer cancel()
+		env.tsuru.SetContext(runCtx)
+		env.globomap.SetContext(runCtx)
+		defer env.tsuru.SetContext(ctx)
+		defer env.globomap.SetContext(ctx)
+		ctx = runCtx
+	}
+	env.log.Set("run_id", newRunID())
+	env.cmd.Run(ctx)
+}
+
+// leading reports whether this instance may run the command, logging
+// when it stands by for another one.
+func leading() bool {
+	if env.elector == nil || env.elector.isLeader() {
+		return true
+	}
+	env.log.WithField("holder", env.elector.id).Infof("another instance is the leader, standing by")
+	return false
+}
+
+// waitShutdown waits for the current run to stop after a termination
+// signal. A second signal or the shutdown timeout abandon it.
+func waitShutdown(done <-chan struct{}, signals <-chan os.Signal) int {
+	timer := time.NewTimer(env.config.shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		env.log.Infof("shutdown complete")
+		return exitOK
+	case sig := <-signals:
+		env.log.Warnf("received %s again, exiting without waiting for the current run", sig)
+	case <-timer.C:
+		env.log.Warnf("current run didn't stop in %s, exiting", env.config.shutdownTimeout)
 	}
+	return exitFailure
 }
 
-func postUpdates(operations []operation) {
+func postUpdates(operations []operation) error {
 	data := []globomap.Payload{}
 	for _, op := range operations {
 		payload := op.toPayload()
@@ -81,13 +261,57 @@ func postUpdates(operations []operation) {
 		}
 
 		data = append(data, *payload)
-
-		if env.config.verbose {
-			fmt.Printf("%v\n", op)
+		operationsGenerated.inc(payload.Collection)
+		env.log.With(logger.Fields{"collection": payload.Collection, "key": payload.Key}).Debugf("%v", op)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	env.status.count(countOperations, len(data))
+	if env.hashes != nil && !env.config.diff {
+		changed := env.hashes.filter(data)
+		if skipped := len(data) - len(changed); skipped > 0 {
+			payloadsSkipped.add("", float64(skipped))
+			env.status.count(countSkipped, skipped)
+			env.log.Debugf("skipping %d unchanged documents", skipped)
+		}
+		data = changed
+		if len(data) == 0 {
+			return nil
 		}
 	}
-	err := env.globomap.Post(data)
-	if err != nil && env.config.verbose {
-		fmt.Println(err)
+	result, err := env.sink.Post(data)
+	env.status.count(countPosted, len(data)-len(result.Failed))
+	env.status.count(countFailed, len(result.Failed))
+	recordHashes(data, result)
+	if err != nil {
+		env.status.recordError(subsystemGlobomapLoader, err)
+		env.log.WithField("error", err).Errorf("failed to post updates to globomap")
+		for _, f := range result.Failed {
+			env.log.With(logger.Fields{
+				"collection": f.Payload.Collection,
+				"key":        f.Payload.Key,
+				"error":      f.Error,
+			}).Errorf("failed to post document")
+		}
 	}
+	return err
+}
+
+// recordHashes saves the hashes of the documents actually posted, which
+// doesn't happen in dry and diff modes.
+func recordHashes(data []globomap.Payload, result *globomap.PostResult) {
+	if env.hashes == nil || env.config.dry || env.config.diff {
+		return
+	}
+	if err := env.hashes.record(data, result); err != nil {
+		env.log.WithField("error", err).Errorf("error saving hash state")
+	}
+}
+
+// newRunID returns a random id identifying the messages logged by a run.
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
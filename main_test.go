@@ -0,0 +1,56 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+type countCmd struct {
+	runs chan struct{}
+}
+
+func (c *countCmd) Run(ctx context.Context) {
+	c.runs <- struct{}{}
+}
+
+func (s *S) TestRunRepeatStopsWhenContextIsCancelled(c *check.C) {
+	setup([]string{"--repeat", "1h"})
+	cmd := &countCmd{runs: make(chan struct{}, 1)}
+	env.cmd = cmd
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+	<-cmd.runs
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("repeat loop didn't stop")
+	}
+	c.Assert(env.status.report().Phase, check.Equals, phaseWaiting)
+}
+
+func (s *S) TestWaitShutdown(c *check.C) {
+	setup(nil)
+	done := make(chan struct{})
+	close(done)
+	c.Assert(waitShutdown(done, make(chan os.Signal)), check.Equals, exitOK)
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	c.Assert(waitShutdown(make(chan struct{}), signals), check.Equals, exitFailure)
+
+	env.config.shutdownTimeout = time.Millisecond
+	c.Assert(waitShutdown(make(chan struct{}), make(chan os.Signal)), check.Equals, exitFailure)
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is exposed in the Prometheus text format by metricsHandler.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	eventsFetched = newCounterVec("globomap_integration_events_fetched_total",
+		"Number of events fetched from tsuru.", "kind")
+	operationsGenerated = newCounterVec("globomap_integration_operations_total",
+		"Number of operations sent to globomap.", "collection")
+	chunksPosted = newCounterVec("globomap_integration_chunks_total",
+		"Number of chunks posted to globomap loader.", "status")
+	payloadsPosted = newCounterVec("globomap_integration_payloads_posted_total",
+		"Number of payloads accepted by globomap loader.", "")
+	payloadsFailed = newCounterVec("globomap_integration_payloads_failed_total",
+		"Number of payloads rejected by globomap loader.", "")
+	payloadsSkipped = newCounterVec("globomap_integration_payloads_skipped_total",
+		"Number of unchanged payloads not posted to globomap loader.", "")
+	compUnitQueries = newCounterVec("globomap_integration_comp_unit_queries_total",
+		"Number of comp_unit lookups in globomap API.", "result")
+	lastSuccess = &gauge{name: "globomap_integration_last_success_timestamp_seconds",
+		help: "Unix time of the last run that posted every update."}
+	runDuration = &gauge{name: "globomap_integration_run_duration_seconds",
+		help: "Duration of the last run."}
+	pendingRetries = &gaugeFunc{name: "globomap_integration_pending_node_retries",
+		help: "Number of nodes waiting for their comp_unit to be found.",
+		value: func() float64 {
+			if env.retryQueue == nil {
+				return 0
+			}
+			return float64(len(env.retryQueue.pending()))
+		}}
+
+	metrics = []metric{
+		eventsFetched, operationsGenerated, chunksPosted, payloadsPosted,
+		payloadsFailed, payloadsSkipped, compUnitQueries, lastSuccess, runDuration, pendingRetries,
+	}
+)
+
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(labelValue string, n float64) {
+	c.mu.Lock()
+	c.values[labelValue] += n
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.add(labelValue, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.values[""]))
+		return
+	}
+	labelValues := make([]string, 0, len(c.values))
+	for v := range c.values {
+		labelValues = append(labelValues, v)
+	}
+	sort.Strings(labelValues)
+	for _, v := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", c.name, c.label, labelEscaper.Replace(v), formatValue(c.values[v]))
+	}
+}
+
+type gauge struct {
+	name  string
+	help  string
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *gauge) set(value float64) {
+	g.mu.Lock()
+	g.value = value
+	g.mu.Unlock()
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value))
+}
+
+// gaugeFunc is a gauge whose value is computed when the metrics are read.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// recordChunk is set as the globomap client chunk observer.
+func recordChunk(posted, failed int) {
+	if failed > 0 {
+		chunksPosted.inc("error")
+	} else {
+		chunksPosted.inc("success")
+	}
+	payloadsPosted.add("", float64(posted))
+	payloadsFailed.add("", float64(failed))
+}
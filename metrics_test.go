@@ -0,0 +1,82 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestCounterVecWrite(c *check.C) {
+	counter := newCounterVec("my_counter_total", "My counter.", "kind")
+	counter.inc("b")
+	counter.add("a", 2)
+	counter.inc("b")
+	counter.inc(`with "quotes"`)
+	var buf bytes.Buffer
+	counter.write(&buf)
+	c.Assert(buf.String(), check.Equals, `# HELP my_counter_total My counter.
+# TYPE my_counter_total counter
+my_counter_total{kind="a"} 2
+my_counter_total{kind="b"} 2
+my_counter_total{kind="with \"quotes\""} 1
+`)
+}
+
+func (s *S) TestCounterVecWriteWithoutLabel(c *check.C) {
+	counter := newCounterVec("my_counter_total", "My counter.", "")
+	var buf bytes.Buffer
+	counter.write(&buf)
+	c.Assert(buf.String(), check.Equals, "# HELP my_counter_total My counter.\n# TYPE my_counter_total counter\nmy_counter_total 0\n")
+
+	counter.add("", 3)
+	buf.Reset()
+	counter.write(&buf)
+	c.Assert(strings.HasSuffix(buf.String(), "\nmy_counter_total 3\n"), check.Equals, true)
+}
+
+func (s *S) TestGaugeWrite(c *check.C) {
+	g := &gauge{name: "my_gauge", help: "My gauge."}
+	g.set(1.5)
+	var buf bytes.Buffer
+	g.write(&buf)
+	c.Assert(buf.String(), check.Equals, "# HELP my_gauge My gauge.\n# TYPE my_gauge gauge\nmy_gauge 1.5\n")
+}
+
+func (s *S) TestMetricsHandlerAfterUpdate(c *check.C) {
+	tsuruServer := newTsuruServer([]event{newEvent("pool.create", "pool1")}, nil, nil, []pool{{Name: "pool1"}}, nil)
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "text/plain; version=0.0.4")
+	body := recorder.Body.String()
+	c.Assert(strings.Contains(body, `globomap_integration_events_fetched_total{kind="pool.create"}`), check.Equals, true)
+	c.Assert(strings.Contains(body, `globomap_integration_operations_total{collection="tsuru_pool"}`), check.Equals, true)
+	c.Assert(strings.Contains(body, `globomap_integration_chunks_total{status="success"}`), check.Equals, true)
+	c.Assert(strings.Contains(body, "\nglobomap_integration_pending_node_retries 0\n"), check.Equals, true)
+	c.Assert(lastSuccess.value > 0, check.Equals, true)
+	c.Assert(strings.Contains(body, "\nglobomap_integration_last_success_timestamp_seconds 0\n"), check.Equals, false)
+}
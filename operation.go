@@ -9,9 +9,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
 	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
 )
 
@@ -63,6 +65,113 @@ type appServiceInstanceOperation struct {
 	serviceName  string
 }
 
+type teamOperation struct {
+	baseOperation
+	team tsuru.Team
+}
+
+type teamAppOperation struct {
+	baseOperation
+	appName   string
+	cachedApp *app
+}
+
+type teamPoolOperation struct {
+	baseOperation
+	poolName string
+	teamName string
+}
+
+type teamServiceInstanceOperation struct {
+	baseOperation
+	instance tsuru.ServiceInstance
+}
+
+type platformOperation struct {
+	baseOperation
+	platform tsuru.Platform
+}
+
+type appPlatformOperation struct {
+	baseOperation
+	appName   string
+	cachedApp *app
+}
+
+type routerOperation struct {
+	baseOperation
+	router tsuru.Router
+}
+
+type appRouterOperation struct {
+	baseOperation
+	appName   string
+	cachedApp *app
+}
+
+type volumeOperation struct {
+	baseOperation
+	volume tsuru.Volume
+}
+
+type volumePoolOperation struct {
+	baseOperation
+	volume tsuru.Volume
+}
+
+type appVolumeOperation struct {
+	baseOperation
+	appName    string
+	volumeName string
+	mountpoint string
+	bind       *tsuru.VolumeBind
+}
+
+type unitOperation struct {
+	baseOperation
+	unit unit
+}
+
+type appUnitOperation struct {
+	baseOperation
+	unit unit
+}
+
+type unitCompUnitOperation struct {
+	baseOperation
+	unit  unit
+	hosts map[string]node
+}
+
+type planOperation struct {
+	baseOperation
+	plan tsuru.Plan
+}
+
+type appPlanOperation struct {
+	baseOperation
+	appName   string
+	cachedApp *app
+}
+
+type serviceBrokerOperation struct {
+	baseOperation
+	broker tsuru.ServiceBroker
+}
+
+type serviceBrokerServiceOperation struct {
+	baseOperation
+	serviceName string
+}
+
+// staleEdgeOperation deletes an edge found in globomap API, when it no
+// longer exists in tsuru and its key can't be built from tsuru data.
+type staleEdgeOperation struct {
+	baseOperation
+	collection string
+	key        string
+}
+
 type baseOperation struct {
 	action string
 	time   time.Time
@@ -81,12 +190,34 @@ var (
 	_ operation = &serviceInstanceOperation{}
 	_ operation = &serviceServiceInstanceOperation{}
 	_ operation = &appServiceInstanceOperation{}
+	_ operation = &teamOperation{}
+	_ operation = &teamAppOperation{}
+	_ operation = &teamPoolOperation{}
+	_ operation = &teamServiceInstanceOperation{}
+	_ operation = &platformOperation{}
+	_ operation = &appPlatformOperation{}
+	_ operation = &routerOperation{}
+	_ operation = &appRouterOperation{}
+	_ operation = &volumeOperation{}
+	_ operation = &volumePoolOperation{}
+	_ operation = &appVolumeOperation{}
+	_ operation = &unitOperation{}
+	_ operation = &appUnitOperation{}
+	_ operation = &unitCompUnitOperation{}
+	_ operation = &planOperation{}
+	_ operation = &appPlanOperation{}
+	_ operation = &serviceBrokerOperation{}
+	_ operation = &serviceBrokerServiceOperation{}
+	_ operation = &staleEdgeOperation{}
 )
 
+// eventStatus returns the action of the documents changed by the event.
+// Only deletes remove them, every other kind, like app.deploy, updates
+// them.
 func eventStatus(e event) string {
 	parts := strings.Split(e.Kind.Name, ".")
 	status := strings.ToUpper(parts[1])
-	if status == "CREATE" {
+	if status != "DELETE" {
 		status = "UPDATE"
 	}
 	return status
@@ -158,14 +289,6 @@ func (op *appOperation) properties() map[string]interface{} {
 		"teams":       app.Teams,
 	}
 
-	if app.Plan != nil {
-		props["plan_name"] = app.Plan.Name
-		props["plan_router"] = app.Plan.Router
-		props["plan_memory"] = strconv.FormatInt(app.Plan.Memory, 10)
-		props["plan_swap"] = strconv.FormatInt(app.Plan.Swap, 10)
-		props["plan_cpushare"] = strconv.Itoa(int(app.Plan.Cpushare))
-	}
-
 	return props
 }
 
@@ -259,18 +382,14 @@ func (op *nodeOperation) buildPayload(queryResult *globomap.QueryResult) *globom
 	}
 
 	if queryResult == nil {
-		queryResult, err = env.globomap.Query(globomap.QueryFields{
-			Collection: "comp_unit",
-			Name:       node.Name(),
-			IP:         node.IP(),
-		})
+		queryResult, err = queryCompUnit(node)
 		if err != nil || queryResult == nil {
-			if env.config.repeat != nil {
-				go op.retry()
-			}
-			if env.config.verbose {
-				fmt.Printf("node %s (IP %s) not found in globomap API\n", node.Name(), node.IP())
+			// the queue outlives the run, so nodes are only queued when
+			// the payloads are posted to globomap
+			if env.config.repeat != nil && env.sink == env.globomap {
+				env.retryQueue.add(op)
 			}
+			env.log.With(logger.Fields{"entity": "node", "target": node.Name(), "ip": node.IP()}).Debugf("node not found in globomap API")
 			return nil
 		}
 	}
@@ -298,22 +417,17 @@ func (op *nodeOperation) String() string {
 }
 
 func (op *nodeOperation) node() (*node, error) {
-	if len(env.nodes) == 0 {
-		nodes, err := env.tsuru.NodeList()
-		if err != nil {
-			return nil, err
-		}
-		env.nodes = nodes
+	nodes, err := cachedNodes()
+	if err != nil {
+		return nil, err
 	}
 	ip := op.nodeIP()
-	for _, node := range env.nodes {
+	for _, node := range nodes {
 		if extractIPFromAddr(node.Address) == ip {
 			return &node, nil
 		}
 	}
-	if env.config.verbose {
-		fmt.Printf("Node not found in tsuru API: %s\n", op.nodeAddr)
-	}
+	env.log.With(logger.Fields{"entity": "node", "target": op.nodeAddr}).Debugf("node not found in tsuru API")
 
 	return nil, nil
 }
@@ -322,46 +436,6 @@ func (op *nodeOperation) nodeIP() string {
 	return extractIPFromAddr(op.nodeAddr)
 }
 
-func (op *nodeOperation) retry() {
-	node, err := op.node()
-	if err != nil || node == nil {
-		return
-	}
-	f := globomap.QueryFields{
-		Collection: "comp_unit",
-		Name:       node.Name(),
-		IP:         node.IP(),
-	}
-
-	for i := 1; i <= env.config.maxRetries; i++ {
-		retrySleepTime := env.config.retrySleepTime * time.Duration(i)
-		if env.config.verbose {
-			fmt.Printf("(%d/%d) retrying globomap query in %s\n", i, env.config.maxRetries, retrySleepTime)
-		}
-		time.Sleep(retrySleepTime)
-
-		queryResult, err := env.globomap.Query(f)
-		if queryResult == nil || err != nil {
-			if env.config.verbose {
-				fmt.Printf("node %s (IP %s) not found in globomap API\n", node.Name(), node.IP())
-			}
-			continue
-		}
-
-		payload := op.buildPayload(queryResult)
-		if payload == nil {
-			return
-		}
-		err = env.globomap.Post([]globomap.Payload{*payload})
-		if err != nil && env.config.verbose {
-			fmt.Println(err)
-		}
-		return
-	}
-
-	fmt.Printf("max retries reached for fetching node %s (IP %s) from globomap API, giving up\n", node.Name(), node.IP())
-}
-
 func (op *serviceOperation) toPayload() *globomap.Payload {
 	planMap := make(map[string]struct{})
 	for _, p := range op.service.Plans {
@@ -432,6 +506,614 @@ func (op *appServiceInstanceOperation) toPayload() *globomap.Payload {
 	}
 }
 
+func (op *teamOperation) toPayload() *globomap.Payload {
+	return baseDocument(op.team.Name, op.action, "tsuru_team", op.time, map[string]interface{}{
+		"tags":        op.team.Tags,
+		"permissions": op.team.Permissions,
+	})
+}
+
+func (op *teamOperation) String() string {
+	return fmt.Sprintf("%s: team %s", op.baseOperation.String(), op.team.Name)
+}
+
+func (op *teamAppOperation) app() (*app, error) {
+	var err error
+	if op.cachedApp == nil {
+		op.cachedApp, err = env.tsuru.AppInfo(op.appName)
+	}
+	return op.cachedApp, err
+}
+
+func (op *teamAppOperation) toPayload() *globomap.Payload {
+	id := fmt.Sprintf("%s-team", op.appName)
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_team_app",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	app, err := op.app()
+	if err != nil || app.TeamOwner == "" {
+		return nil
+	}
+	props.Element = map[string]interface{}{
+		"id":        id,
+		"name":      id,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_team/tsuru_" + app.TeamOwner,
+		"to":        "tsuru_app/tsuru_" + app.Name,
+	}
+	return &props
+}
+
+func (op *teamAppOperation) String() string {
+	return fmt.Sprintf("%s: team owner of app %s", op.baseOperation.String(), op.appName)
+}
+
+func (op *teamPoolOperation) toPayload() *globomap.Payload {
+	id := op.poolName + "_" + op.teamName
+	return &globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_team_pool",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+		Element: map[string]interface{}{
+			"id":        id,
+			"name":      id,
+			"provider":  "tsuru",
+			"timestamp": op.time.Unix(),
+			"from":      "tsuru_team/tsuru_" + op.teamName,
+			"to":        "tsuru_pool/tsuru_" + op.poolName,
+		},
+	}
+}
+
+func (op *teamPoolOperation) String() string {
+	return fmt.Sprintf("%s: team %s pool %s", op.baseOperation.String(), op.teamName, op.poolName)
+}
+
+func (op *teamServiceInstanceOperation) toPayload() *globomap.Payload {
+	id := op.instance.ServiceName + "_" + op.instance.Name + "-team"
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_team_service_instance",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	if op.instance.TeamOwner == "" {
+		return nil
+	}
+	props.Element = map[string]interface{}{
+		"id":        id,
+		"name":      id,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_team/tsuru_" + op.instance.TeamOwner,
+		"to":        "tsuru_service_instance/tsuru_" + op.instance.ServiceName + "_" + op.instance.Name,
+	}
+	return &props
+}
+
+func (op *teamServiceInstanceOperation) String() string {
+	return fmt.Sprintf("%s: team owner of service instance %v service %v", op.baseOperation.String(), op.instance.Name, op.instance.ServiceName)
+}
+
+func (op *platformOperation) toPayload() *globomap.Payload {
+	return baseDocument(op.platform.Name, op.action, "tsuru_platform", op.time, map[string]interface{}{
+		"disabled": strconv.FormatBool(op.platform.Disabled),
+	})
+}
+
+func (op *platformOperation) String() string {
+	return fmt.Sprintf("%s: platform %s", op.baseOperation.String(), op.platform.Name)
+}
+
+func (op *appPlatformOperation) app() (*app, error) {
+	var err error
+	if op.cachedApp == nil {
+		op.cachedApp, err = env.tsuru.AppInfo(op.appName)
+	}
+	return op.cachedApp, err
+}
+
+func (op *appPlatformOperation) toPayload() *globomap.Payload {
+	id := fmt.Sprintf("%s-platform", op.appName)
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_app_platform",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	app, err := op.app()
+	if err != nil || app.Platform == "" {
+		return nil
+	}
+	props.Element = map[string]interface{}{
+		"id":        id,
+		"name":      id,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_app/tsuru_" + app.Name,
+		"to":        "tsuru_platform/tsuru_" + app.Platform,
+	}
+	return &props
+}
+
+func (op *appPlatformOperation) String() string {
+	return fmt.Sprintf("%s: platform of app %s", op.baseOperation.String(), op.appName)
+}
+
+func (op *routerOperation) toPayload() *globomap.Payload {
+	return baseDocument(op.router.Name, op.action, "tsuru_router", op.time, map[string]interface{}{
+		"type":          op.router.Type_,
+		"address":       op.router.Addres,
+		"status":        op.router.Status,
+		"status-detail": op.router.StatusDetail,
+		"opts":          op.router.Opts,
+	})
+}
+
+func (op *routerOperation) String() string {
+	return fmt.Sprintf("%s: router %s", op.baseOperation.String(), op.router.Name)
+}
+
+func (op *appRouterOperation) app() (*app, error) {
+	var err error
+	if op.cachedApp == nil {
+		op.cachedApp, err = env.tsuru.AppInfo(op.appName)
+	}
+	return op.cachedApp, err
+}
+
+func (op *appRouterOperation) toPayload() *globomap.Payload {
+	id := fmt.Sprintf("%s-router", op.appName)
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_app_router",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	app, err := op.app()
+	if err != nil || app.Router == "" {
+		return nil
+	}
+	properties := map[string]interface{}{}
+	propertiesMetadata := map[string]map[string]string{}
+	for k, v := range app.Routeropts {
+		properties[k] = v
+		propertiesMetadata[k] = map[string]string{
+			"description": k,
+		}
+	}
+	props.Element = map[string]interface{}{
+		"id":                  id,
+		"name":                id,
+		"provider":            "tsuru",
+		"timestamp":           op.time.Unix(),
+		"from":                "tsuru_app/tsuru_" + app.Name,
+		"to":                  "tsuru_router/tsuru_" + app.Router,
+		"properties":          properties,
+		"properties_metadata": propertiesMetadata,
+	}
+	return &props
+}
+
+func (op *appRouterOperation) String() string {
+	return fmt.Sprintf("%s: router of app %s", op.baseOperation.String(), op.appName)
+}
+
+func (op *volumeOperation) toPayload() *globomap.Payload {
+	var plan string
+	if op.volume.Plan != nil {
+		plan = op.volume.Plan.Name
+	}
+	return baseDocument(op.volume.Name, op.action, "tsuru_volume", op.time, map[string]interface{}{
+		"pool":       op.volume.Pool,
+		"team_owner": op.volume.TeamOwner,
+		"status":     op.volume.Status,
+		"plan":       plan,
+		"opts":       op.volume.Opts,
+	})
+}
+
+func (op *volumeOperation) String() string {
+	return fmt.Sprintf("%s: volume %s", op.baseOperation.String(), op.volume.Name)
+}
+
+func (op *volumePoolOperation) toPayload() *globomap.Payload {
+	id := fmt.Sprintf("%s-pool", op.volume.Name)
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_volume_pool",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	if op.volume.Pool == "" {
+		return nil
+	}
+	props.Element = map[string]interface{}{
+		"id":        id,
+		"name":      id,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_volume/tsuru_" + op.volume.Name,
+		"to":        "tsuru_pool/tsuru_" + op.volume.Pool,
+	}
+	return &props
+}
+
+func (op *volumePoolOperation) String() string {
+	return fmt.Sprintf("%s: pool of volume %s", op.baseOperation.String(), op.volume.Name)
+}
+
+func (op *appVolumeOperation) toPayload() *globomap.Payload {
+	// a volume can be bound to the same app more than once, at different
+	// mountpoints
+	mountpoint := strings.Trim(strings.Replace(op.mountpoint, "/", "_", -1), "_")
+	id := op.appName + "_" + op.volumeName + "_" + mountpoint
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_app_volume",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	if op.bind == nil || op.bind.Id == nil {
+		return nil
+	}
+	props.Element = map[string]interface{}{
+		"id":        id,
+		"name":      id,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_app/tsuru_" + op.appName,
+		"to":        "tsuru_volume/tsuru_" + op.volumeName,
+		"properties": map[string]interface{}{
+			"mountpoint": op.bind.Id.Mountpoint,
+			"readonly":   strconv.FormatBool(op.bind.Readonly),
+		},
+		"properties_metadata": map[string]map[string]string{
+			"mountpoint": {"description": "mountpoint"},
+			"readonly":   {"description": "readonly"},
+		},
+	}
+	return &props
+}
+
+func (op *appVolumeOperation) String() string {
+	return fmt.Sprintf("%s: app %s volume %s at %s", op.baseOperation.String(), op.appName, op.volumeName, op.mountpoint)
+}
+
+// appOperations builds the operations of an app document and of its edges
+// to pool, team, platform, router and plan.
+func appOperations(action string, t time.Time, a *app) []operation {
+	base := baseOperation{action: action, time: t}
+	return []operation{
+		&appOperation{baseOperation: base, appName: a.Name, cachedApp: a},
+		&appPoolOperation{baseOperation: base, appName: a.Name, cachedApp: a},
+		&teamAppOperation{baseOperation: base, appName: a.Name, cachedApp: a},
+		&appPlatformOperation{baseOperation: base, appName: a.Name, cachedApp: a},
+		&appRouterOperation{baseOperation: base, appName: a.Name, cachedApp: a},
+		&appPlanOperation{baseOperation: base, appName: a.Name, cachedApp: a},
+	}
+}
+
+// serviceInstanceOperations builds the operations of a service instance
+// document and of its edges to service, team and apps.
+func serviceInstanceOperations(action string, t time.Time, instance tsuru.ServiceInstance) []operation {
+	base := baseOperation{action: action, time: t}
+	operations := []operation{
+		&serviceInstanceOperation{baseOperation: base, instance: instance},
+		&serviceServiceInstanceOperation{baseOperation: base, instance: instance},
+		&teamServiceInstanceOperation{baseOperation: base, instance: instance},
+	}
+	for _, app := range instance.Apps {
+		operations = append(operations, &appServiceInstanceOperation{
+			baseOperation: base,
+			appName:       app,
+			instanceName:  instance.Name,
+			serviceName:   instance.ServiceName,
+		})
+	}
+	return operations
+}
+
+// unitOperations returns the operations needed to sync the given units and
+// their links to the app and to the host running them, found in hosts by
+// the unit IP. Hosts are not needed to delete units.
+func unitOperations(action string, t time.Time, units []unit, hosts map[string]node) []operation {
+	var operations []operation
+	for _, u := range units {
+		base := baseOperation{action: action, time: t}
+		operations = append(operations,
+			&unitOperation{baseOperation: base, unit: u},
+			&appUnitOperation{baseOperation: base, unit: u},
+			&unitCompUnitOperation{baseOperation: base, unit: u, hosts: hosts},
+		)
+	}
+	return operations
+}
+
+func (op *unitOperation) toPayload() *globomap.Payload {
+	return baseDocument(op.unit.Id, op.action, "tsuru_unit", op.time, map[string]interface{}{
+		"app":          op.unit.Appname,
+		"process_name": op.unit.Processname,
+		"type":         op.unit.Type_,
+		"ip":           op.unit.Ip,
+		"status":       op.unit.Status,
+		"address":      op.unit.Addr(),
+	})
+}
+
+func (op *unitOperation) String() string {
+	return fmt.Sprintf("%s: unit %s", op.baseOperation.String(), op.unit.Id)
+}
+
+func (op *appUnitOperation) toPayload() *globomap.Payload {
+	return &globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_app_unit",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + op.unit.Id,
+		Element: map[string]interface{}{
+			"id":        op.unit.Id,
+			"name":      op.unit.Id,
+			"provider":  "tsuru",
+			"timestamp": op.time.Unix(),
+			"from":      "tsuru_app/tsuru_" + op.unit.Appname,
+			"to":        "tsuru_unit/tsuru_" + op.unit.Id,
+		},
+	}
+}
+
+func (op *appUnitOperation) String() string {
+	return fmt.Sprintf("%s: app %s unit %s", op.baseOperation.String(), op.unit.Appname, op.unit.Id)
+}
+
+func (op *unitCompUnitOperation) toPayload() *globomap.Payload {
+	edge := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_unit_comp_unit",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + op.unit.Id,
+	}
+
+	if edge.Action == "DELETE" {
+		return &edge
+	}
+
+	node, ok := op.hosts[extractIPFromAddr(op.unit.Ip)]
+	if !ok {
+		env.log.With(logger.Fields{"entity": "unit", "target": op.unit.Id, "ip": op.unit.Ip}).Debugf("host of unit not found in tsuru API")
+		return nil
+	}
+	queryResult, err := queryCompUnit(&node)
+	if err != nil || queryResult == nil {
+		env.log.With(logger.Fields{"entity": "unit", "target": op.unit.Id, "ip": op.unit.Ip}).Debugf("host of unit not found in globomap API")
+		return nil
+	}
+
+	edge.Element = map[string]interface{}{
+		"id":        op.unit.Id,
+		"name":      op.unit.Id,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_unit/tsuru_" + op.unit.Id,
+		"to":        queryResult.Id,
+	}
+	return &edge
+}
+
+func (op *unitCompUnitOperation) String() string {
+	return fmt.Sprintf("%s: host of unit %s", op.baseOperation.String(), op.unit.Id)
+}
+
+func (op *planOperation) toPayload() *globomap.Payload {
+	return baseDocument(op.plan.Name, op.action, "tsuru_plan", op.time, map[string]interface{}{
+		"memory":   strconv.FormatInt(op.plan.Memory, 10),
+		"swap":     strconv.FormatInt(op.plan.Swap, 10),
+		"cpushare": strconv.Itoa(int(op.plan.Cpushare)),
+		"router":   op.plan.Router,
+		"default":  strconv.FormatBool(op.plan.Default_),
+	})
+}
+
+func (op *planOperation) String() string {
+	return fmt.Sprintf("%s: plan %s", op.baseOperation.String(), op.plan.Name)
+}
+
+func (op *appPlanOperation) app() (*app, error) {
+	var err error
+	if op.cachedApp == nil {
+		op.cachedApp, err = env.tsuru.AppInfo(op.appName)
+	}
+	return op.cachedApp, err
+}
+
+func (op *appPlanOperation) toPayload() *globomap.Payload {
+	id := fmt.Sprintf("%s-plan", op.appName)
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_app_plan",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + id,
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	app, err := op.app()
+	if err != nil || app.Plan == nil || app.Plan.Name == "" {
+		return nil
+	}
+	props.Element = map[string]interface{}{
+		"id":        id,
+		"name":      id,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_app/tsuru_" + app.Name,
+		"to":        "tsuru_plan/tsuru_" + app.Plan.Name,
+	}
+	return &props
+}
+
+func (op *appPlanOperation) String() string {
+	return fmt.Sprintf("%s: plan of app %s", op.baseOperation.String(), op.appName)
+}
+
+func (op *serviceBrokerOperation) toPayload() *globomap.Payload {
+	props := map[string]interface{}{
+		"url":       op.broker.URL,
+		"auth_type": "",
+	}
+	// Credentials are never sent to globomap, only the kind of
+	// authentication used by the broker.
+	if cfg := op.broker.Config; cfg != nil {
+		props["insecure"] = strconv.FormatBool(cfg.Insecure)
+		if auth := cfg.AuthConfig; auth != nil {
+			switch {
+			case auth.BasicAuthConfig != nil:
+				props["auth_type"] = "basic"
+			case auth.BearerConfig != nil:
+				props["auth_type"] = "bearer"
+			}
+		}
+	}
+	return baseDocument(op.broker.Name, op.action, "tsuru_service_broker", op.time, props)
+}
+
+func (op *serviceBrokerOperation) String() string {
+	return fmt.Sprintf("%s: service broker %s", op.baseOperation.String(), op.broker.Name)
+}
+
+// brokerName returns the name of the broker providing the service. Services
+// provided by brokers are named as "<broker>::<service>".
+func (op *serviceBrokerServiceOperation) brokerName() string {
+	parts := strings.SplitN(op.serviceName, "::", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+func (op *serviceBrokerServiceOperation) toPayload() *globomap.Payload {
+	props := globomap.Payload{
+		Action:     op.action,
+		Collection: "tsuru_service_broker_service",
+		Type:       globomap.PayloadTypeEdge,
+		Key:        "tsuru_" + op.serviceName,
+	}
+
+	broker := op.brokerName()
+	if broker == "" {
+		return nil
+	}
+
+	if props.Action == "DELETE" {
+		return &props
+	}
+
+	props.Element = map[string]interface{}{
+		"id":        op.serviceName,
+		"name":      op.serviceName,
+		"provider":  "tsuru",
+		"timestamp": op.time.Unix(),
+		"from":      "tsuru_service_broker/tsuru_" + broker,
+		"to":        "tsuru_service/tsuru_" + op.serviceName,
+	}
+	return &props
+}
+
+func (op *serviceBrokerServiceOperation) String() string {
+	return fmt.Sprintf("%s: broker of service %s", op.baseOperation.String(), op.serviceName)
+}
+
+func (op *staleEdgeOperation) toPayload() *globomap.Payload {
+	return &globomap.Payload{
+		Action:     "DELETE",
+		Collection: op.collection,
+		Type:       globomap.PayloadTypeEdge,
+		Key:        op.key,
+	}
+}
+
+func (op *staleEdgeOperation) String() string {
+	return fmt.Sprintf("%s: stale edge %s/%s", op.baseOperation.String(), op.collection, op.key)
+}
+
+// nodesMu guards env.nodes, which is shared by the operations built at the
+// same time by the loaders, the event processors and the retry queue.
+var nodesMu sync.Mutex
+
+// cachedNodes returns the nodes cached for the current run, fetching them
+// from tsuru when the cache is empty.
+func cachedNodes() ([]node, error) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	if len(env.nodes) == 0 {
+		nodes, err := env.tsuru.NodeList()
+		if err != nil {
+			return nil, err
+		}
+		env.nodes = nodes
+	}
+	return env.nodes, nil
+}
+
+// setNodes replaces the nodes cached for the current run. Setting them to
+// nil makes the next run fetch them again.
+func setNodes(nodes []node) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+	env.nodes = nodes
+}
+
+// unitHosts returns the nodes cached for the current run indexed by IP, to
+// find the host running each unit.
+func unitHosts() (map[string]node, error) {
+	nodes, err := cachedNodes()
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]node, len(nodes))
+	for _, n := range nodes {
+		hosts[extractIPFromAddr(n.Address)] = n
+	}
+	return hosts, nil
+}
+
 func extractIPFromAddr(addr string) string {
 	re := regexp.MustCompile(`(\d+\.\d+\.\d+\.\d+)`)
 	matches := re.FindAllStringSubmatch(addr, -1)
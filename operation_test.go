@@ -87,3 +87,20 @@ func (s *S) TestNodeOperationNodeIP(c *check.C) {
 	op.nodeAddr = "invalid"
 	c.Assert(op.nodeIP(), check.Equals, "")
 }
+
+func (s *S) TestEventStatus(c *check.C) {
+	tests := map[string]string{
+		"app.create":              "UPDATE",
+		"app.update":              "UPDATE",
+		"app.deploy":              "UPDATE",
+		"app.update.bind":         "UPDATE",
+		"app.update.router.add":   "UPDATE",
+		"app.delete":              "DELETE",
+		"pool.update.team.remove": "UPDATE",
+		"node.delete":             "DELETE",
+		"service-instance.delete": "DELETE",
+	}
+	for kind, status := range tests {
+		c.Check(eventStatus(newEvent(kind, "target")), check.Equals, status, check.Commentf(kind))
+	}
+}
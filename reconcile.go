@@ -0,0 +1,253 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
+)
+
+// reconciledCollections lists the collections and edges checked by the
+// reconcile mode.
+var reconciledCollections = []struct {
+	name string
+	kind globomap.PayloadType
+}{
+	{"tsuru_app", globomap.PayloadTypeCollection},
+	{"tsuru_pool", globomap.PayloadTypeCollection},
+	{"tsuru_service", globomap.PayloadTypeCollection},
+	{"tsuru_service_instance", globomap.PayloadTypeCollection},
+	{"tsuru_service_broker", globomap.PayloadTypeCollection},
+	{"tsuru_team", globomap.PayloadTypeCollection},
+	{"tsuru_platform", globomap.PayloadTypeCollection},
+	{"tsuru_router", globomap.PayloadTypeCollection},
+	{"tsuru_volume", globomap.PayloadTypeCollection},
+	{"tsuru_plan", globomap.PayloadTypeCollection},
+	{"tsuru_pool_app", globomap.PayloadTypeEdge},
+	{"tsuru_pool_comp_unit", globomap.PayloadTypeEdge},
+	{"tsuru_service_service_instance", globomap.PayloadTypeEdge},
+	{"tsuru_app_service_instance", globomap.PayloadTypeEdge},
+	{"tsuru_service_broker_service", globomap.PayloadTypeEdge},
+	{"tsuru_team_app", globomap.PayloadTypeEdge},
+	{"tsuru_team_pool", globomap.PayloadTypeEdge},
+	{"tsuru_team_service_instance", globomap.PayloadTypeEdge},
+	{"tsuru_app_platform", globomap.PayloadTypeEdge},
+	{"tsuru_app_router", globomap.PayloadTypeEdge},
+	{"tsuru_app_plan", globomap.PayloadTypeEdge},
+	{"tsuru_volume_pool", globomap.PayloadTypeEdge},
+	{"tsuru_app_volume", globomap.PayloadTypeEdge},
+	{"tsuru_unit", globomap.PayloadTypeCollection},
+	{"tsuru_app_unit", globomap.PayloadTypeEdge},
+	{"tsuru_unit_comp_unit", globomap.PayloadTypeEdge},
+}
+
+type reconcileCmd struct{}
+
+func (c *reconcileCmd) Run(ctx context.Context) {
+	expected, err := expectedKeys()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.WithField("error", err).Errorf("error fetching tsuru resources, aborting reconcile")
+		return
+	}
+
+	var deletes []globomap.Payload
+	var total int
+	for _, col := range reconciledCollections {
+		docs, err := env.globomap.List(col.name, col.kind)
+		if err != nil {
+			env.status.recordError(subsystemGlobomapAPI, err)
+			env.log.With(logger.Fields{"collection": col.name, "error": err}).Errorf("error listing globomap documents, aborting reconcile")
+			return
+		}
+		total += len(docs)
+		for _, doc := range docs {
+			if expected[col.name][doc.Key] {
+				continue
+			}
+			deletes = append(deletes, globomap.Payload{
+				Action:     "DELETE",
+				Collection: col.name,
+				Type:       col.kind,
+				Key:        doc.Key,
+			})
+			env.log.With(logger.Fields{"collection": col.name, "key": doc.Key}).Debugf("DELETE: orphaned document")
+		}
+	}
+
+	env.log.Debugf("found %d orphaned documents out of %d", len(deletes), total)
+	if len(deletes) == 0 {
+		return
+	}
+
+	if ctx.Err() != nil {
+		env.log.Warnf("reconcile interrupted, no document was deleted")
+		return
+	}
+
+	percent := 100 * float64(len(deletes)) / float64(total)
+	if percent > env.config.maxDeletePercent {
+		env.log.Warnf("reconcile would delete %.1f%% of the documents (max %.1f%%), aborting", percent, env.config.maxDeletePercent)
+		return
+	}
+
+	result, err := env.sink.Post(deletes)
+	recordHashes(deletes, result)
+	if err != nil {
+		env.status.recordError(subsystemGlobomapLoader, err)
+		env.log.WithField("error", err).Errorf("failed to post reconcile deletes")
+	}
+}
+
+// expectedKeys returns the keys of every document that should exist in
+// globomap, indexed by collection. Keys are computed by the same operations
+// used by the other modes, built with the DELETE action so no additional
+// tsuru or globomap request is needed, besides the app info listing the
+// units of each app.
+func expectedKeys() (map[string]map[string]bool, error) {
+	var ops []operation
+	now := time.Now()
+	del := baseOperation{action: "DELETE", time: now}
+
+	apps, err := env.tsuru.AppList()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range apps {
+		ops = append(ops,
+			&appOperation{baseOperation: del, appName: a.Name, cachedApp: &app{Name: a.Name}},
+			&appPoolOperation{baseOperation: del, appName: a.Name},
+			&teamAppOperation{baseOperation: del, appName: a.Name},
+			&appPlatformOperation{baseOperation: del, appName: a.Name},
+			&appRouterOperation{baseOperation: del, appName: a.Name},
+			&appPlanOperation{baseOperation: del, appName: a.Name},
+		)
+		// units are only listed in the app info. An app that fails would
+		// have all of its units deleted, so the reconcile is aborted.
+		_, units, err := env.tsuru.AppInfoWithUnits(a.Name)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, unitOperations("DELETE", now, units, nil)...)
+	}
+
+	pools, err := env.tsuru.PoolList()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pools {
+		ops = append(ops, &poolOperation{baseOperation: del, poolName: p.Name})
+		for _, team := range p.Teams {
+			ops = append(ops, &teamPoolOperation{baseOperation: del, poolName: p.Name, teamName: team})
+		}
+	}
+
+	nodes, err := env.tsuru.NodeList()
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes {
+		ops = append(ops, &nodeOperation{baseOperation: del, nodeAddr: n.Addr()})
+	}
+
+	services, err := env.tsuru.ServiceList()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range services {
+		ops = append(ops,
+			&serviceOperation{baseOperation: del, service: s},
+			&serviceBrokerServiceOperation{baseOperation: del, serviceName: s.Service},
+		)
+		for _, instance := range s.ServiceInstances {
+			ops = append(ops,
+				&serviceInstanceOperation{baseOperation: del, instance: instance},
+				&serviceServiceInstanceOperation{baseOperation: del, instance: instance},
+				&teamServiceInstanceOperation{baseOperation: del, instance: instance},
+			)
+			for _, app := range instance.Apps {
+				ops = append(ops, &appServiceInstanceOperation{
+					baseOperation: del,
+					appName:       app,
+					instanceName:  instance.Name,
+					serviceName:   instance.ServiceName,
+				})
+			}
+		}
+	}
+
+	brokers, err := env.tsuru.ServiceBrokerList()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range brokers {
+		ops = append(ops, &serviceBrokerOperation{baseOperation: del, broker: b})
+	}
+
+	teams, err := env.tsuru.TeamList()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range teams {
+		ops = append(ops, &teamOperation{baseOperation: del, team: t})
+	}
+
+	platforms, err := env.tsuru.PlatformList()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range platforms {
+		ops = append(ops, &platformOperation{baseOperation: del, platform: p})
+	}
+
+	routers, err := env.tsuru.RouterList()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routers {
+		ops = append(ops, &routerOperation{baseOperation: del, router: r})
+	}
+
+	volumes, err := env.tsuru.VolumeList()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range volumes {
+		ops = append(ops,
+			&volumeOperation{baseOperation: del, volume: v},
+			&volumePoolOperation{baseOperation: del, volume: v},
+		)
+		for _, bind := range v.Binds {
+			if bind.Id == nil {
+				continue
+			}
+			ops = append(ops, &appVolumeOperation{baseOperation: del, appName: bind.Id.App, volumeName: v.Name, mountpoint: bind.Id.Mountpoint})
+		}
+	}
+
+	plans, err := env.tsuru.PlanList()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range plans {
+		ops = append(ops, &planOperation{baseOperation: del, plan: p})
+	}
+
+	keys := make(map[string]map[string]bool)
+	for _, op := range ops {
+		payload := op.toPayload()
+		if payload == nil {
+			continue
+		}
+		if keys[payload.Collection] == nil {
+			keys[payload.Collection] = make(map[string]bool)
+		}
+		keys[payload.Collection][payload.Key] = true
+	}
+	return keys, nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
+	"gopkg.in/check.v1"
+)
+
+func reconcileTsuruServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/1.0/apps":
+			json.NewEncoder(w).Encode([]app{{Name: "myapp1", Pool: "pool1"}})
+		case "/1.0/apps/myapp1":
+			json.NewEncoder(w).Encode(struct {
+				app
+				Units []unit `json:"units"`
+			}{app{Name: "myapp1", Pool: "pool1"}, []unit{{Id: "unit1", Appname: "myapp1", Ip: "1.1.1.1"}}})
+		case "/1.0/pools":
+			json.NewEncoder(w).Encode([]pool{{Name: "pool1", Teams: []string{"team1"}}})
+		case "/1.2/node":
+			json.NewEncoder(w).Encode(struct{ Nodes []node }{Nodes: []node{{Pool: "pool1", Address: "https://1.1.1.1:2376"}}})
+		case "/1.0/services/instances":
+			json.NewEncoder(w).Encode([]tsuru.Service{
+				{Service: "myservice1", ServiceInstances: []tsuru.ServiceInstance{
+					{ServiceName: "myservice1", Name: "myinstance", Apps: []string{"myapp1"}},
+				}},
+			})
+		case "/1.7/brokers":
+			json.NewEncoder(w).Encode(tsuru.ServiceBrokerList{})
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+		case "/1.0/platforms":
+			json.NewEncoder(w).Encode([]tsuru.Platform{{Name: "python"}})
+		case "/1.0/routers":
+			json.NewEncoder(w).Encode([]tsuru.Router{{Name: "galeb"}})
+		case "/1.4/volumes":
+			json.NewEncoder(w).Encode([]tsuru.Volume{})
+		case "/1.0/plans":
+			json.NewEncoder(w).Encode([]tsuru.Plan{{Name: "large"}})
+		}
+	}))
+}
+
+func reconcileGlobomapApi(c *check.C, documents map[string][]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.Method, check.Equals, http.MethodGet)
+		parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+		c.Assert(parts, check.HasLen, 3)
+		var result []globomap.QueryResult
+		for _, key := range documents[parts[2]] {
+			result = append(result, globomap.QueryResult{Id: parts[2] + "/" + key, Key: key})
+		}
+		json.NewEncoder(w).Encode(struct {
+			Documents  []globomap.QueryResult
+			TotalPages int `json:"total_pages"`
+		}{result, 1})
+	}))
+}
+
+func (s *S) TestReconcileCmdRun(c *check.C) {
+	tsuruServer := reconcileTsuruServer()
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	globomapApi := reconcileGlobomapApi(c, map[string][]string{
+		"tsuru_app":                  {"tsuru_myapp1", "tsuru_oldapp"},
+		"tsuru_pool":                 {"tsuru_pool1"},
+		"tsuru_pool_app":             {"tsuru_myapp1-pool", "tsuru_oldapp-pool"},
+		"tsuru_pool_comp_unit":       {"tsuru_1_1_1_1"},
+		"tsuru_team":                 {"tsuru_team1"},
+		"tsuru_team_pool":            {"tsuru_pool1_team1"},
+		"tsuru_platform":             {"tsuru_python"},
+		"tsuru_router":               {"tsuru_galeb"},
+		"tsuru_plan":                 {"tsuru_large"},
+		"tsuru_service":              {"tsuru_myservice1"},
+		"tsuru_service_instance":     {"tsuru_myservice1_myinstance"},
+		"tsuru_app_service_instance": {"tsuru_myapp1_myinstance"},
+		"tsuru_unit":                 {"tsuru_unit1", "tsuru_oldunit"},
+		"tsuru_app_unit":             {"tsuru_unit1", "tsuru_oldunit"},
+		"tsuru_unit_comp_unit":       {"tsuru_unit1", "tsuru_oldunit"},
+	})
+	defer globomapApi.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
+
+	var posts int
+	var data []globomap.Payload
+	globomapLoader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+		err := json.NewDecoder(r.Body).Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+	}))
+	defer globomapLoader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", globomapLoader.URL)
+	setup([]string{"--reconcile"})
+	env.config.maxDeletePercent = 30
+
+	cmd := &reconcileCmd{}
+	cmd.Run(context.Background())
+
+	c.Assert(posts, check.Equals, 1)
+	sortPayload(data)
+	c.Assert(data, check.DeepEquals, []globomap.Payload{
+		{Action: "DELETE", Collection: "tsuru_app", Type: globomap.PayloadTypeCollection, Key: "tsuru_oldapp"},
+		{Action: "DELETE", Collection: "tsuru_app_unit", Type: globomap.PayloadTypeEdge, Key: "tsuru_oldunit"},
+		{Action: "DELETE", Collection: "tsuru_pool_app", Type: globomap.PayloadTypeEdge, Key: "tsuru_oldapp-pool"},
+		{Action: "DELETE", Collection: "tsuru_unit", Type: globomap.PayloadTypeCollection, Key: "tsuru_oldunit"},
+		{Action: "DELETE", Collection: "tsuru_unit_comp_unit", Type: globomap.PayloadTypeEdge, Key: "tsuru_oldunit"},
+	})
+}
+
+func (s *S) TestReconcileCmdRunAbortsAboveMaxDeletePercent(c *check.C) {
+	tsuruServer := reconcileTsuruServer()
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	globomapApi := reconcileGlobomapApi(c, map[string][]string{
+		"tsuru_app":  {"tsuru_myapp1", "tsuru_oldapp1", "tsuru_oldapp2"},
+		"tsuru_pool": {"tsuru_pool1"},
+	})
+	defer globomapApi.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
+
+	globomapLoader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer globomapLoader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", globomapLoader.URL)
+	setup([]string{"--reconcile"})
+
+	cmd := &reconcileCmd{}
+	cmd.Run(context.Background())
+}
+
+func (s *S) TestReconcileCmdRunAbortsOnTsuruError(c *check.C) {
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	globomapApi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer globomapApi.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
+	setup([]string{"--reconcile"})
+
+	cmd := &reconcileCmd{}
+	cmd.Run(context.Background())
+}
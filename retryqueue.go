@@ -0,0 +1,296 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
+)
+
+// retryEntry is a node whose comp_unit wasn't found in globomap yet.
+type retryEntry struct {
+	NodeAddr string    `json:"node_addr"`
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try"`
+}
+
+// standbyRetryWait is how often a queue standing by checks whether it
+// became active.
+const standbyRetryWait = 10 * time.Second
+
+// retryQueue retries linking nodes to their comp_units using a fixed number
+// of workers. Entries are deduplicated by node IP and, when a path is set,
+// persisted so pending retries survive a restart.
+type retryQueue struct {
+	mu       sync.Mutex
+	entries  map[string]*retryEntry
+	inFlight map[string]bool
+	path     string
+	size     int
+	workers  int
+	jobs     chan retryEntry
+	wake     chan struct{}
+	quit     chan struct{}
+	once     sync.Once
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	process  func(retryEntry) bool
+	// active reports whether retries may run, so an instance standing by
+	// for the leader doesn't post them.
+	active func() bool
+}
+
+func newRetryQueue(config configParams) (*retryQueue, error) {
+	q := &retryQueue{
+		entries:  make(map[string]*retryEntry),
+		inFlight: make(map[string]bool),
+		path:     config.retryQueueFile,
+		size:     config.retryQueueSize,
+		workers:  config.retryWorkers,
+		jobs:     make(chan retryEntry),
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	q.process = q.retryNode
+	if q.path == "" {
+		return q, nil
+	}
+	data, err := ioutil.ReadFile(q.path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []retryEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		q.entries[extractIPFromAddr(entries[i].NodeAddr)] = &entries[i]
+	}
+	return q, nil
+}
+
+// add enqueues the node of the given operation, unless it's already pending
+// or the queue is full.
+func (q *retryQueue) add(op *nodeOperation) {
+	key := op.nodeIP()
+	q.mu.Lock()
+	if _, ok := q.entries[key]; ok {
+		q.mu.Unlock()
+		return
+	}
+	if len(q.entries) >= q.size {
+		q.mu.Unlock()
+		env.log.With(logger.Fields{"entity": "node", "target": op.nodeAddr}).Warnf("retry queue is full, dropping node")
+		return
+	}
+	q.entries[key] = &retryEntry{
+		NodeAddr: op.nodeAddr,
+		Time:     op.time,
+		Attempts: 1,
+		NextTry:  time.Now().Add(env.config.retrySleepTime),
+	}
+	q.persist()
+	q.mu.Unlock()
+	q.start()
+	q.notify()
+}
+
+// pending returns a snapshot of the queued entries, ordered by next try.
+func (q *retryQueue) pending() []retryEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]retryEntry, 0, len(q.entries))
+	for _, e := range q.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].NextTry.Before(entries[j].NextTry)
+	})
+	return entries
+}
+
+func (q *retryQueue) start() {
+	q.once.Do(func() {
+		q.wg.Add(q.workers)
+		for i := 0; i < q.workers; i++ {
+			go q.work()
+		}
+		go q.schedule()
+	})
+}
+
+// stop stops scheduling retries, waits for the ones in progress and saves
+// the pending entries, so they're resumed by the next process.
+func (q *retryQueue) stop() error {
+	q.stopOnce.Do(func() {
+		// prevents start from launching workers after the queue is stopped
+		q.once.Do(func() { close(q.jobs) })
+		close(q.quit)
+	})
+	q.wg.Wait()
+	if q.path == "" {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.save()
+}
+
+func (q *retryQueue) stopping() bool {
+	select {
+	case <-q.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *retryQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule hands due entries to the workers and sleeps until the next one
+// is due or a new entry is added.
+func (q *retryQueue) schedule() {
+	defer close(q.jobs)
+	for {
+		if q.stopping() {
+			return
+		}
+		if q.active != nil && !q.active() {
+			select {
+			case <-q.quit:
+			case <-time.After(standbyRetryWait):
+			}
+			continue
+		}
+		var due []retryEntry
+		wait := time.Hour
+		now := time.Now()
+		q.mu.Lock()
+		for key, e := range q.entries {
+			if q.inFlight[key] {
+				continue
+			}
+			if d := e.NextTry.Sub(now); d > 0 {
+				if d < wait {
+					wait = d
+				}
+				continue
+			}
+			q.inFlight[key] = true
+			due = append(due, *e)
+		}
+		q.mu.Unlock()
+		for _, e := range due {
+			q.jobs <- e
+		}
+		if len(due) > 0 {
+			continue
+		}
+		select {
+		case <-q.wake:
+		case <-q.quit:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (q *retryQueue) work() {
+	defer q.wg.Done()
+	for e := range q.jobs {
+		done := q.process(e)
+		key := extractIPFromAddr(e.NodeAddr)
+		q.mu.Lock()
+		delete(q.inFlight, key)
+		// a retry interrupted by the shutdown doesn't count as an attempt
+		if entry, ok := q.entries[key]; ok && (done || !q.stopping()) {
+			if done || entry.Attempts >= env.config.maxRetries {
+				if !done {
+					env.log.With(logger.Fields{"entity": "node", "target": e.NodeAddr}).Warnf("max retries reached for fetching node from globomap API, giving up")
+				}
+				delete(q.entries, key)
+			} else {
+				entry.Attempts++
+				entry.NextTry = time.Now().Add(env.config.retrySleepTime * time.Duration(entry.Attempts))
+			}
+			q.persist()
+		}
+		q.mu.Unlock()
+		q.notify()
+	}
+}
+
+// persist must be called with q.mu held.
+func (q *retryQueue) persist() {
+	if q.path == "" {
+		return
+	}
+	if err := q.save(); err != nil {
+		env.log.WithField("error", err).Errorf("error saving retry queue")
+	}
+}
+
+func (q *retryQueue) save() error {
+	entries := make([]retryEntry, 0, len(q.entries))
+	for _, e := range q.entries {
+		entries = append(entries, *e)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.path, data)
+}
+
+// retryNode queries the node comp_unit again and posts the edge when found.
+// It returns false when the entry should be retried later.
+func (q *retryQueue) retryNode(e retryEntry) bool {
+	op := &nodeOperation{
+		baseOperation: baseOperation{action: "UPDATE", time: e.Time},
+		nodeAddr:      e.NodeAddr,
+	}
+	node, err := op.node()
+	if err != nil {
+		return false
+	}
+	if node == nil {
+		return true
+	}
+	log := env.log.With(logger.Fields{"entity": "node", "target": node.Name(), "ip": node.IP()})
+	log.Debugf("(%d/%d) retrying globomap query", e.Attempts, env.config.maxRetries)
+	queryResult, err := queryCompUnit(node)
+	if queryResult == nil || err != nil {
+		log.Debugf("node not found in globomap API")
+		return false
+	}
+
+	payload := op.buildPayload(queryResult)
+	if payload == nil {
+		return true
+	}
+	_, err = env.sink.Post([]globomap.Payload{*payload})
+	if err != nil {
+		env.status.recordError(subsystemGlobomapLoader, err)
+		log.WithField("error", err).Errorf("failed to post node comp_unit edge")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestRetryQueueAddDeduplicatesNodes(c *check.C) {
+	setup(nil)
+	env.config.retrySleepTime = time.Hour
+	q, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+	q.process = func(retryEntry) bool { return true }
+
+	q.add(&nodeOperation{nodeAddr: "https://1.1.1.1:2376"})
+	q.add(&nodeOperation{nodeAddr: "https://1.1.1.1:2376"})
+	q.add(&nodeOperation{nodeAddr: "https://2.2.2.2:2376"})
+
+	pending := q.pending()
+	c.Assert(pending, check.HasLen, 2)
+	c.Assert(pending[0].NodeAddr, check.Equals, "https://1.1.1.1:2376")
+	c.Assert(pending[0].Attempts, check.Equals, 1)
+	c.Assert(pending[1].NodeAddr, check.Equals, "https://2.2.2.2:2376")
+}
+
+func (s *S) TestRetryQueueAddDropsWhenFull(c *check.C) {
+	setup(nil)
+	env.config.retrySleepTime = time.Hour
+	env.config.retryQueueSize = 1
+	q, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+	q.process = func(retryEntry) bool { return true }
+
+	q.add(&nodeOperation{nodeAddr: "https://1.1.1.1:2376"})
+	q.add(&nodeOperation{nodeAddr: "https://2.2.2.2:2376"})
+
+	pending := q.pending()
+	c.Assert(pending, check.HasLen, 1)
+	c.Assert(pending[0].NodeAddr, check.Equals, "https://1.1.1.1:2376")
+}
+
+func (s *S) TestRetryQueueGivesUpAfterMaxRetries(c *check.C) {
+	setup(nil)
+	env.config.retrySleepTime = 0
+	env.config.maxRetries = 3
+	q, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+	attempts := make(chan int, 10)
+	q.process = func(e retryEntry) bool {
+		attempts <- e.Attempts
+		return false
+	}
+
+	q.add(&nodeOperation{nodeAddr: "https://1.1.1.1:2376"})
+
+	for i := 1; i <= 3; i++ {
+		select {
+		case attempt := <-attempts:
+			c.Assert(attempt, check.Equals, i)
+		case <-time.After(5 * time.Second):
+			c.Fatal("timeout waiting for retry")
+		}
+	}
+	timeout := time.After(5 * time.Second)
+	for len(q.pending()) > 0 {
+		select {
+		case <-timeout:
+			c.Fatal("entry was not removed from the queue")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	c.Assert(attempts, check.HasLen, 0)
+}
+
+func (s *S) TestRetryQueuePersistsEntries(c *check.C) {
+	dir, err := ioutil.TempDir("", "retryqueue")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "queue.json")
+	os.Setenv("RETRY_QUEUE_FILE", path)
+	defer os.Unsetenv("RETRY_QUEUE_FILE")
+
+	setup(nil)
+	env.config.retrySleepTime = time.Hour
+	now := time.Now().Truncate(time.Second)
+	env.retryQueue.process = func(retryEntry) bool { return true }
+	env.retryQueue.add(&nodeOperation{baseOperation: baseOperation{time: now}, nodeAddr: "https://1.1.1.1:2376"})
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	var entries []retryEntry
+	err = json.Unmarshal(data, &entries)
+	c.Assert(err, check.IsNil)
+	c.Assert(entries, check.HasLen, 1)
+	c.Assert(entries[0].NodeAddr, check.Equals, "https://1.1.1.1:2376")
+
+	setup(nil)
+	pending := env.retryQueue.pending()
+	c.Assert(pending, check.HasLen, 1)
+	c.Assert(pending[0].NodeAddr, check.Equals, "https://1.1.1.1:2376")
+	c.Assert(pending[0].Time.Equal(now), check.Equals, true)
+	c.Assert(pending[0].Attempts, check.Equals, 1)
+}
+
+func (s *S) TestNewRetryQueueInvalidFile(c *check.C) {
+	f, err := ioutil.TempFile("", "retryqueue")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("not json")
+	f.Close()
+
+	config := NewConfig()
+	config.retryQueueFile = f.Name()
+	_, err = newRetryQueue(config)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestRetryQueueStopSavesPendingEntries(c *check.C) {
+	dir, err := ioutil.TempDir("", "retryqueue")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	setup(nil)
+	env.config.retrySleepTime = 0
+	env.config.retryQueueFile = filepath.Join(dir, "queue.json")
+	q, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+	processing := make(chan bool)
+	release := make(chan bool)
+	q.process = func(retryEntry) bool {
+		processing <- true
+		<-release
+		return false
+	}
+
+	q.add(&nodeOperation{nodeAddr: "https://1.1.1.1:2376"})
+	<-processing
+	stopped := make(chan error)
+	go func() {
+		stopped <- q.stop()
+	}()
+	for !q.stopping() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	select {
+	case err = <-stopped:
+		c.Assert(err, check.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for the queue to stop")
+	}
+
+	reloaded, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+	pending := reloaded.pending()
+	c.Assert(pending, check.HasLen, 1)
+	c.Assert(pending[0].NodeAddr, check.Equals, "https://1.1.1.1:2376")
+	c.Assert(pending[0].Attempts, check.Equals, 1)
+}
+
+func (s *S) TestRetryQueueStopWithoutStart(c *check.C) {
+	setup(nil)
+	q, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+	c.Assert(q.stop(), check.IsNil)
+	q.add(&nodeOperation{nodeAddr: "https://1.1.1.1:2376"})
+	c.Assert(q.stop(), check.IsNil)
+}
+
+func (s *S) TestRetryNodeRetriesWhenPostFails(c *check.C) {
+	globomapApi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(struct{ Documents []globomap.QueryResult }{
+			Documents: []globomap.QueryResult{{Id: "comp_unit/globomap_node1", Name: "node1"}},
+		})
+	}))
+	defer globomapApi.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
+	loader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+	setup(nil)
+	setNodes([]node{{Pool: "pool1", Iaasid: "node1", Address: "https://1.1.1.1:2376"}})
+	q, err := newRetryQueue(env.config)
+	c.Assert(err, check.IsNil)
+
+	done := q.retryNode(retryEntry{NodeAddr: "https://1.1.1.1:2376", Time: time.Now(), Attempts: 1})
+	c.Assert(done, check.Equals, false)
+}
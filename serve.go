@@ -0,0 +1,178 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/tsuru/globomap-integration/logger"
+	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
+)
+
+const (
+	webhookName = "globomap-integration"
+
+	// webhookSecretHeader carries the secret shared between tsuru and the
+	// serve mode, set with the WEBHOOK_SECRET env var.
+	webhookSecretHeader = "X-Globomap-Integration-Secret"
+)
+
+// serveCmd receives events delivered by tsuru webhooks and posts the
+// resulting operations to globomap as soon as they arrive.
+type serveCmd struct {
+	mu sync.Mutex
+}
+
+// Run serves webhooks until the context is cancelled, then waits for the
+// events being processed before returning.
+func (c *serveCmd) Run(ctx context.Context) {
+	env.log.Infof("listening for tsuru webhooks on %s", env.config.listenAddress)
+	server := &http.Server{Addr: env.config.listenAddress, Handler: c}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errCh:
+		env.log.WithField("error", err).Errorf("error serving webhooks")
+	case <-ctx.Done():
+		server.Shutdown(context.Background())
+	}
+}
+
+func (c *serveCmd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != env.config.webhookPath {
+		http.NotFound(w, r)
+		return
+	}
+	if !validWebhookSecret(r.Header.Get(webhookSecretHeader)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var e event
+	err := json.NewDecoder(r.Body).Decode(&e)
+	r.Body.Close()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid event: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	processors := webhookEventProcessors(e)
+	if processors == nil {
+		env.log.With(logger.Fields{"kind": e.Kind.Name, "target": e.Target.Value}).Debugf("ignoring event")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Operations rely on the pools and nodes cached in env, so events are
+	// processed one at a time and the cache is reset for each of them.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	env.log.Set("run_id", newRunID())
+	env.pools = nil
+	setNodes(nil)
+	err = processEvents([]event{e}, processors)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// validWebhookSecret reports whether the secret sent in a request matches
+// the configured one, comparing them in constant time.
+func validWebhookSecret(secret string) bool {
+	expected := env.config.webhookSecret
+	return expected != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
+
+// webhookEventProcessors returns the processors used in update mode for the
+// given event, or nil if the event is not synced to globomap.
+func webhookEventProcessors(e event) map[string]eventProcessorFunc {
+	if e.Kind.Name == healerKindname {
+		if e.Target.Type == "node" {
+			return eventProcessors()
+		}
+		return nil
+	}
+	if containsString(eventKindnames, e.Kind.Name) {
+		return eventProcessors()
+	}
+	if containsString(bindEventKindnames, e.Kind.Name) {
+		return bindEventProcessors()
+	}
+	return nil
+}
+
+// registerWebhookCmd creates the tsuru webhook that delivers the events
+// handled by the serve mode to the given URL.
+type registerWebhookCmd struct {
+	url string
+}
+
+func (c *registerWebhookCmd) Run(ctx context.Context) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		env.log.WithField("error", err).Errorf("invalid webhook url")
+		return
+	}
+	if path := "/" + strings.TrimPrefix(u.Path, "/"); path != env.config.webhookPath {
+		env.log.Errorf("webhook url path %s doesn't match the path served, set WEBHOOK_PATH to %s", path, path)
+		return
+	}
+	secret := env.config.webhookSecret
+	if secret == "" {
+		secret = newWebhookSecret()
+		env.log.Infof("generated webhook secret, set WEBHOOK_SECRET=%s in serve mode", secret)
+	}
+	kinds := append([]string{healerKindname}, eventKindnames...)
+	kinds = append(kinds, bindEventKindnames...)
+	err = env.tsuru.WebhookCreate(tsuru.Webhook{
+		Name:        webhookName,
+		Description: "Sends tsuru events to globomap",
+		TeamOwner:   env.config.webhookTeamOwner,
+		Url:         c.url,
+		Method:      http.MethodPost,
+		Headers:     map[string][]string{webhookSecretHeader: {secret}},
+		EventFilter: &tsuru.WebhookEventFilter{
+			KindNames:   kinds,
+			SuccessOnly: true,
+		},
+	})
+	if err != nil {
+		env.log.WithField("error", err).Errorf("error registering webhook")
+		return
+	}
+	env.log.Infof("webhook %s registered to %s", webhookName, c.url)
+}
+
+// newWebhookSecret returns a random secret shared with tsuru webhooks.
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestServeCmdProcessesWebhookEvent(c *check.C) {
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.URL.Path, check.Equals, "/1.0/teams")
+		json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	var data []globomap.Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+		err := json.NewDecoder(r.Body).Decode(&data)
+		c.Assert(err, check.IsNil)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup([]string{"--serve"})
+
+	body, err := json.Marshal(newEvent("team.create", "team1"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	request := newWebhookRequest(http.MethodPost, "/", bytes.NewReader(body))
+	cmd := &serveCmd{}
+	cmd.ServeHTTP(recorder, request)
+
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(data, check.HasLen, 1)
+	c.Assert(data[0].Action, check.Equals, "UPDATE")
+	c.Assert(data[0].Collection, check.Equals, "tsuru_team")
+	c.Assert(data[0].Key, check.Equals, "tsuru_team1")
+}
+
+func (s *S) TestServeCmdPostError(c *check.C) {
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup([]string{"--serve"})
+
+	body, err := json.Marshal(newEvent("team.create", "team1"))
+	c.Assert(err, check.IsNil)
+	recorder := httptest.NewRecorder()
+	request := newWebhookRequest(http.MethodPost, "/", bytes.NewReader(body))
+	cmd := &serveCmd{}
+	cmd.ServeHTTP(recorder, request)
+
+	c.Assert(recorder.Code, check.Equals, http.StatusBadGateway)
+}
+
+func (s *S) TestServeCmdIgnoresUnknownEvents(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer server.Close()
+	os.Setenv("TSURU_HOST", server.URL)
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup([]string{"--serve"})
+	cmd := &serveCmd{}
+
+	healer := newEvent("healer", "container1")
+	healer.Target.Type = "container"
+	for _, e := range []event{newEvent("user.create", "user1"), healer} {
+		body, err := json.Marshal(e)
+		c.Assert(err, check.IsNil)
+		recorder := httptest.NewRecorder()
+		cmd.ServeHTTP(recorder, newWebhookRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		c.Assert(recorder.Code, check.Equals, http.StatusNoContent)
+	}
+}
+
+func (s *S) TestServeCmdInvalidRequests(c *check.C) {
+	setup([]string{"--serve"})
+	cmd := &serveCmd{}
+
+	recorder := httptest.NewRecorder()
+	cmd.ServeHTTP(recorder, newWebhookRequest(http.MethodGet, "/", nil))
+	c.Assert(recorder.Code, check.Equals, http.StatusMethodNotAllowed)
+
+	recorder = httptest.NewRecorder()
+	cmd.ServeHTTP(recorder, newWebhookRequest(http.MethodPost, "/", strings.NewReader("invalid")))
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestServeCmdRejectsUnauthenticatedRequests(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer server.Close()
+	os.Setenv("TSURU_HOST", server.URL)
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup([]string{"--serve"})
+	cmd := &serveCmd{}
+	body, err := json.Marshal(newEvent("app.delete", "app1"))
+	c.Assert(err, check.IsNil)
+
+	recorder := httptest.NewRecorder()
+	cmd.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+
+	recorder = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	request.Header.Set(webhookSecretHeader, "wrong")
+	cmd.ServeHTTP(recorder, request)
+	c.Assert(recorder.Code, check.Equals, http.StatusUnauthorized)
+}
+
+func (s *S) TestServeCmdServesOnlyWebhookPath(c *check.C) {
+	os.Setenv("WEBHOOK_PATH", "/webhook")
+	defer os.Unsetenv("WEBHOOK_PATH")
+	setup([]string{"--serve"})
+	cmd := &serveCmd{}
+
+	recorder := httptest.NewRecorder()
+	cmd.ServeHTTP(recorder, newWebhookRequest(http.MethodPost, "/", strings.NewReader("{}")))
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+
+	recorder = httptest.NewRecorder()
+	cmd.ServeHTTP(recorder, newWebhookRequest(http.MethodPost, "/webhook/other", strings.NewReader("{}")))
+	c.Assert(recorder.Code, check.Equals, http.StatusNotFound)
+
+	recorder = httptest.NewRecorder()
+	cmd.ServeHTTP(recorder, newWebhookRequest(http.MethodPost, "/webhook", strings.NewReader("invalid")))
+	c.Assert(recorder.Code, check.Equals, http.StatusBadRequest)
+}
+
+func (s *S) TestWebhookEventProcessors(c *check.C) {
+	healer := newEvent("healer", "node1")
+	healer.Target.Type = "node"
+	c.Assert(webhookEventProcessors(healer), check.NotNil)
+	c.Assert(webhookEventProcessors(newEvent("app.create", "app1")), check.HasLen, len(eventProcessors()))
+	c.Assert(webhookEventProcessors(newEvent("app.update.bind", "app1")), check.HasLen, len(bindEventProcessors()))
+	c.Assert(webhookEventProcessors(newEvent("app.update.env.set", "app1")), check.IsNil)
+}
+
+func (s *S) TestRegisterWebhookCmd(c *check.C) {
+	var webhook tsuru.Webhook
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.Method, check.Equals, http.MethodPost)
+		c.Assert(req.URL.Path, check.Equals, "/1.6/events/webhooks")
+		err := json.NewDecoder(req.Body).Decode(&webhook)
+		c.Assert(err, check.IsNil)
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	os.Setenv("WEBHOOK_TEAM_OWNER", "team1")
+	defer os.Unsetenv("WEBHOOK_TEAM_OWNER")
+	setup([]string{"--register-webhook", "http://globomap-integration.example.com"})
+
+	env.cmd.Run(context.Background())
+
+	c.Assert(webhook.Name, check.Equals, webhookName)
+	c.Assert(webhook.TeamOwner, check.Equals, "team1")
+	c.Assert(webhook.Url, check.Equals, "http://globomap-integration.example.com")
+	c.Assert(webhook.Method, check.Equals, http.MethodPost)
+	c.Assert(webhook.Headers, check.DeepEquals, map[string][]string{webhookSecretHeader: {"secret"}})
+	c.Assert(webhook.EventFilter, check.NotNil)
+	c.Assert(webhook.EventFilter.SuccessOnly, check.Equals, true)
+	c.Assert(webhook.EventFilter.KindNames, check.HasLen, len(eventKindnames)+len(bindEventKindnames)+1)
+}
+
+func (s *S) TestRegisterWebhookCmdGeneratesSecret(c *check.C) {
+	var webhook tsuru.Webhook
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		err := json.NewDecoder(req.Body).Decode(&webhook)
+		c.Assert(err, check.IsNil)
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	os.Unsetenv("WEBHOOK_SECRET")
+	setup([]string{"--register-webhook", "http://globomap-integration.example.com"})
+
+	env.cmd.Run(context.Background())
+
+	secret := webhook.Headers[webhookSecretHeader]
+	c.Assert(secret, check.HasLen, 1)
+	c.Assert(secret[0], check.HasLen, 64)
+}
+
+func (s *S) TestRegisterWebhookCmdPathMismatch(c *check.C) {
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	setup([]string{"--register-webhook", "http://globomap-integration.example.com/webhook"})
+
+	env.cmd.Run(context.Background())
+}
+
+func (s *S) TestServeCmdRunStopsWhenContextIsCancelled(c *check.C) {
+	os.Setenv("LISTEN_ADDRESS", "127.0.0.1:0")
+	defer os.Unsetenv("LISTEN_ADDRESS")
+	setup([]string{"--serve"})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cmd := &serveCmd{}
+		cmd.Run(ctx)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("serve mode didn't stop")
+	}
+}
+
+func newWebhookRequest(method, target string, body io.Reader) *http.Request {
+	request := httptest.NewRequest(method, target, body)
+	request.Header.Set(webhookSecretHeader, "secret")
+	return request
+}
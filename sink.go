@@ -0,0 +1,252 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tsuru/globomap-integration/globomap"
+)
+
+// sink receives the payloads built by the running mode. The globomap
+// client is the default one, posting them to globomap loader.
+type sink interface {
+	Post(payload []globomap.Payload) (*globomap.PostResult, error)
+}
+
+// exportFormat is the format of the optional graph rendered by the export.
+type exportFormat string
+
+const (
+	exportDOT     = exportFormat("dot")
+	exportGraphML = exportFormat("graphml")
+)
+
+func parseExportFormat(name string) (exportFormat, error) {
+	switch f := exportFormat(strings.ToLower(name)); f {
+	case exportDOT, exportGraphML:
+		return f, nil
+	}
+	return "", fmt.Errorf("Invalid export format: %s", name)
+}
+
+// fileSink writes payloads as NDJSON as they arrive. When a graph writer
+// is set, the graph is also rendered to it on close, once every vertex and
+// edge is known.
+type fileSink struct {
+	mu       sync.Mutex
+	w        io.Writer
+	graph    io.Writer
+	format   exportFormat
+	payloads []globomap.Payload
+	count    int
+}
+
+func newFileSink(w, graph io.Writer, format exportFormat) *fileSink {
+	return &fileSink{w: w, graph: graph, format: format}
+}
+
+func (s *fileSink) Post(payload []globomap.Payload) (*globomap.PostResult, error) {
+	result := &globomap.PostResult{}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.graph != nil {
+		s.payloads = append(s.payloads, payload...)
+	}
+	encoder := json.NewEncoder(s.w)
+	for i, p := range payload {
+		if err := encoder.Encode(p); err != nil {
+			err = fmt.Errorf("failed to export payload: %v", err)
+			result.Failed = make([]globomap.FailedPayload, 0, len(payload)-i)
+			for _, f := range payload[i:] {
+				result.Failed = append(result.Failed, globomap.FailedPayload{Payload: f, Error: err.Error()})
+			}
+			return result, err
+		}
+		s.count++
+	}
+	return result, nil
+}
+
+// Close renders the graph, if any. It doesn't close the underlying writers.
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.graph == nil {
+		return nil
+	}
+	if s.format == exportGraphML {
+		return writeGraphML(s.graph, newExportGraph(s.payloads))
+	}
+	return writeDOT(s.graph, newExportGraph(s.payloads))
+}
+
+// Count returns the number of payloads exported.
+func (s *fileSink) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// exportGraph has a vertex for each collection document and an edge for
+// each edge document, identified by collection/key like in globomap.
+type exportGraph struct {
+	vertices []exportVertex
+	edges    []exportEdge
+}
+
+type exportVertex struct {
+	id         string
+	collection string
+	name       string
+}
+
+type exportEdge struct {
+	id         string
+	collection string
+	from       string
+	to         string
+}
+
+// newExportGraph builds the graph from the payloads. Edge ends that are
+// not exported, like comp_units, become vertices without a name.
+func newExportGraph(payload []globomap.Payload) exportGraph {
+	vertices := make(map[string]exportVertex)
+	edges := make(map[string]exportEdge)
+	for _, p := range payload {
+		if p.Action == "DELETE" {
+			continue
+		}
+		id := p.Collection + "/" + p.Key
+		if p.Type == globomap.PayloadTypeEdge {
+			from, _ := p.Element["from"].(string)
+			to, _ := p.Element["to"].(string)
+			if from == "" || to == "" {
+				continue
+			}
+			edges[id] = exportEdge{id: id, collection: p.Collection, from: from, to: to}
+			continue
+		}
+		name, _ := p.Element["name"].(string)
+		vertices[id] = exportVertex{id: id, collection: p.Collection, name: name}
+	}
+	for _, e := range edges {
+		for _, end := range []string{e.from, e.to} {
+			if _, ok := vertices[end]; !ok {
+				vertices[end] = exportVertex{id: end, collection: strings.SplitN(end, "/", 2)[0]}
+			}
+		}
+	}
+	var g exportGraph
+	for _, v := range vertices {
+		g.vertices = append(g.vertices, v)
+	}
+	for _, e := range edges {
+		g.edges = append(g.edges, e)
+	}
+	sort.Slice(g.vertices, func(i, j int) bool { return g.vertices[i].id < g.vertices[j].id })
+	sort.Slice(g.edges, func(i, j int) bool { return g.edges[i].id < g.edges[j].id })
+	return g
+}
+
+var dotEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+func writeDOT(w io.Writer, g exportGraph) error {
+	var b strings.Builder
+	b.WriteString("digraph tsuru {\n")
+	for _, v := range g.vertices {
+		label := v.name
+		if label == "" {
+			label = v.id
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, collection=%s];\n", dotQuote(v.id), dotQuote(label), dotQuote(v.collection))
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", dotQuote(e.from), dotQuote(e.to), dotQuote(e.collection))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	ID     string        `xml:"id,attr"`
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func writeGraphML(w io.Writer, g exportGraph) error {
+	doc := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "collection", For: "all", Name: "collection", Type: "string"},
+			{ID: "name", For: "node", Name: "name", Type: "string"},
+		},
+		Graph: graphMLGraph{ID: "tsuru", EdgeDefault: "directed"},
+	}
+	for _, v := range g.vertices {
+		node := graphMLNode{ID: v.id, Data: []graphMLData{{Key: "collection", Value: v.collection}}}
+		if v.name != "" {
+			node.Data = append(node.Data, graphMLData{Key: "name", Value: v.name})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, node)
+	}
+	for _, e := range g.edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			ID:     e.id,
+			Source: e.from,
+			Target: e.to,
+			Data:   []graphMLData{{Key: "collection", Value: e.collection}},
+		})
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, data)
+	return err
+}
@@ -0,0 +1,192 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
+	"gopkg.in/check.v1"
+)
+
+func exportPayloads() []globomap.Payload {
+	return []globomap.Payload{
+		{Action: "UPDATE", Collection: "tsuru_app", Type: globomap.PayloadTypeCollection, Key: "tsuru_myapp",
+			Element: map[string]interface{}{"name": "myapp"}},
+		{Action: "UPDATE", Collection: "tsuru_pool", Type: globomap.PayloadTypeCollection, Key: "tsuru_pool1",
+			Element: map[string]interface{}{"name": "pool1"}},
+		{Action: "UPDATE", Collection: "tsuru_pool_app", Type: globomap.PayloadTypeEdge, Key: "tsuru_myapp-pool",
+			Element: map[string]interface{}{"name": "myapp-pool1", "from": "tsuru_app/tsuru_myapp", "to": "tsuru_pool/tsuru_pool1"}},
+		{Action: "UPDATE", Collection: "tsuru_pool_comp_unit", Type: globomap.PayloadTypeEdge, Key: "tsuru_1_1_1_1",
+			Element: map[string]interface{}{"name": "node1", "from": "tsuru_pool/tsuru_pool1", "to": "comp_unit/globomap_node1"}},
+	}
+}
+
+func (s *S) TestFileSinkNDJSON(c *check.C) {
+	var buf bytes.Buffer
+	sink := newFileSink(&buf, nil, exportDOT)
+	payload := exportPayloads()
+	result, err := sink.Post(payload[:2])
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Failed, check.HasLen, 0)
+	_, err = sink.Post(payload[2:])
+	c.Assert(err, check.IsNil)
+	c.Assert(sink.Close(), check.IsNil)
+	c.Assert(sink.Count(), check.Equals, 4)
+
+	var exported []globomap.Payload
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var p globomap.Payload
+		err = json.Unmarshal(scanner.Bytes(), &p)
+		c.Assert(err, check.IsNil)
+		exported = append(exported, p)
+	}
+	c.Assert(exported, check.DeepEquals, payload)
+}
+
+func (s *S) TestFileSinkDOT(c *check.C) {
+	var buf, graph bytes.Buffer
+	sink := newFileSink(&buf, &graph, exportDOT)
+	_, err := sink.Post(exportPayloads())
+	c.Assert(err, check.IsNil)
+	c.Assert(graph.Len(), check.Equals, 0)
+	c.Assert(strings.Count(buf.String(), "\n"), check.Equals, 4)
+	c.Assert(sink.Close(), check.IsNil)
+	c.Assert(sink.Count(), check.Equals, 4)
+	c.Assert(graph.String(), check.Equals, `digraph tsuru {
+  "comp_unit/globomap_node1" [label="comp_unit/globomap_node1", collection="comp_unit"];
+  "tsuru_app/tsuru_myapp" [label="myapp", collection="tsuru_app"];
+  "tsuru_pool/tsuru_pool1" [label="pool1", collection="tsuru_pool"];
+  "tsuru_app/tsuru_myapp" -> "tsuru_pool/tsuru_pool1" [label="tsuru_pool_app"];
+  "tsuru_pool/tsuru_pool1" -> "comp_unit/globomap_node1" [label="tsuru_pool_comp_unit"];
+}
+`)
+}
+
+func (s *S) TestFileSinkGraphML(c *check.C) {
+	var buf, graph bytes.Buffer
+	sink := newFileSink(&buf, &graph, exportGraphML)
+	_, err := sink.Post(exportPayloads())
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Count(buf.String(), "\n"), check.Equals, 4)
+	c.Assert(sink.Close(), check.IsNil)
+	c.Assert(graph.String(), check.Equals, `<?xml version="1.0" encoding="UTF-8"?>
+<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="collection" for="all" attr.name="collection" attr.type="string"></key>
+  <key id="name" for="node" attr.name="name" attr.type="string"></key>
+  <graph id="tsuru" edgedefault="directed">
+    <node id="comp_unit/globomap_node1">
+      <data key="collection">comp_unit</data>
+    </node>
+    <node id="tsuru_app/tsuru_myapp">
+      <data key="collection">tsuru_app</data>
+      <data key="name">myapp</data>
+    </node>
+    <node id="tsuru_pool/tsuru_pool1">
+      <data key="collection">tsuru_pool</data>
+      <data key="name">pool1</data>
+    </node>
+    <edge id="tsuru_pool_app/tsuru_myapp-pool" source="tsuru_app/tsuru_myapp" target="tsuru_pool/tsuru_pool1">
+      <data key="collection">tsuru_pool_app</data>
+    </edge>
+    <edge id="tsuru_pool_comp_unit/tsuru_1_1_1_1" source="tsuru_pool/tsuru_pool1" target="comp_unit/globomap_node1">
+      <data key="collection">tsuru_pool_comp_unit</data>
+    </edge>
+  </graph>
+</graphml>
+`)
+}
+
+func (s *S) TestParseExportFormat(c *check.C) {
+	format, err := parseExportFormat("GraphML")
+	c.Assert(err, check.IsNil)
+	c.Assert(format, check.Equals, exportGraphML)
+
+	_, err = parseExportFormat("csv")
+	c.Assert(err, check.ErrorMatches, "Invalid export format: csv")
+}
+
+func (s *S) TestExportCmdRun(c *check.C) {
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/1.0/pools":
+			json.NewEncoder(w).Encode([]pool{{Name: "pool1", Teams: []string{"team1"}}})
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	loader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("unexpected post to globomap loader")
+	}))
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+	dir, err := ioutil.TempDir("", "export")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tsuru.ndjson")
+	graphPath := filepath.Join(dir, "tsuru.dot")
+
+	setup([]string{"--export", path, "--export-graph", graphPath})
+	env.cmd.Run(context.Background())
+	c.Assert(env.sink, check.Equals, env.globomap)
+
+	graph, err := ioutil.ReadFile(graphPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.HasPrefix(string(graph), "digraph tsuru {\n"), check.Equals, true)
+	c.Assert(strings.Contains(string(graph), `"tsuru_team/tsuru_team1" -> "tsuru_pool/tsuru_pool1"`), check.Equals, true)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var p globomap.Payload
+		err = json.Unmarshal(scanner.Bytes(), &p)
+		c.Assert(err, check.IsNil)
+		keys = append(keys, p.Collection+"/"+p.Key)
+	}
+	sort.Strings(keys)
+	c.Assert(keys, check.DeepEquals, []string{
+		"tsuru_pool/tsuru_pool1",
+		"tsuru_team/tsuru_team1",
+		"tsuru_team_pool/tsuru_pool1_team1",
+	})
+}
+
+func (s *S) TestFileSinkDoesNotQueueRetries(c *check.C) {
+	globomapApi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(struct{ Documents []globomap.QueryResult }{})
+	}))
+	defer globomapApi.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
+	setup([]string{"--repeat", "1m"})
+	setNodes([]node{{Pool: "pool1", Iaasid: "node1", Address: "https://1.1.1.1:2376"}})
+	var buf bytes.Buffer
+	env.sink = newFileSink(&buf, nil, exportDOT)
+
+	op := &nodeOperation{baseOperation: baseOperation{action: "UPDATE"}, nodeAddr: "https://1.1.1.1:2376"}
+	c.Assert(op.toPayload(), check.IsNil)
+	c.Assert(env.retryQueue.pending(), check.HasLen, 0)
+
+	env.sink = env.globomap
+	c.Assert(op.toPayload(), check.IsNil)
+	c.Assert(env.retryQueue.pending(), check.HasLen, 1)
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	phaseStarting = "starting"
+	phaseRunning  = "running"
+	phaseWaiting  = "waiting"
+	phaseStandBy  = "standby"
+)
+
+// Subsystems whose last error is reported by the status endpoint.
+const (
+	subsystemTsuru          = "tsuru_api"
+	subsystemGlobomapAPI    = "globomap_api"
+	subsystemGlobomapLoader = "globomap_loader"
+)
+
+// Counters of the current run, reported by the status endpoint.
+const (
+	countEvents     = "events"
+	countOperations = "operations"
+	countPosted     = "posted"
+	countFailed     = "failed"
+	countSkipped    = "skipped"
+)
+
+// runStatus tracks the progress of the repeat loop, so the platform can
+// tell whether the worker is healthy.
+type runStatus struct {
+	mu           sync.Mutex
+	now          func() time.Time
+	started      time.Time
+	phase        string
+	runStart     time.Time
+	lastStart    time.Time
+	lastEnd      time.Time
+	nextRun      time.Time
+	standBySince time.Time
+	counts       map[string]int
+	lastCount    map[string]int
+	errors       map[string]subsystemError
+}
+
+type subsystemError struct {
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type statusReport struct {
+	Phase              string                    `json:"phase"`
+	LastRun            *lastRunReport            `json:"last_run,omitempty"`
+	CurrentRunStart    *time.Time                `json:"current_run_start,omitempty"`
+	NextRun            *time.Time                `json:"next_run,omitempty"`
+	Errors             map[string]subsystemError `json:"errors"`
+	PendingNodeRetries int                       `json:"pending_node_retries"`
+}
+
+type lastRunReport struct {
+	Start    time.Time      `json:"start"`
+	End      time.Time      `json:"end"`
+	Duration float64        `json:"duration_seconds"`
+	Counts   map[string]int `json:"counts"`
+}
+
+func newRunStatus() *runStatus {
+	return &runStatus{
+		now:     time.Now,
+		started: time.Now(),
+		phase:   phaseStarting,
+		counts:  make(map[string]int),
+		errors:  make(map[string]subsystemError),
+	}
+}
+
+func (s *runStatus) startRun() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phaseRunning
+	s.runStart = s.now()
+	s.nextRun = time.Time{}
+	s.counts = make(map[string]int)
+}
+
+func (s *runStatus) endRun(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phaseWaiting
+	s.lastStart = s.runStart
+	s.lastEnd = s.now()
+	s.nextRun = next
+	s.lastCount = s.counts
+	s.counts = make(map[string]int)
+}
+
+// standBy records that another instance is the leader, so the skipped
+// run doesn't make this one unhealthy.
+func (s *runStatus) standBy(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase = phaseStandBy
+	s.standBySince = s.now()
+	s.nextRun = next
+}
+
+func (s *runStatus) count(name string, n int) {
+	s.mu.Lock()
+	s.counts[name] += n
+	s.mu.Unlock()
+}
+
+func (s *runStatus) recordError(subsystem string, err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errors[subsystem] = subsystemError{Message: err.Error(), Time: s.now()}
+	s.mu.Unlock()
+}
+
+func (s *runStatus) report() statusReport {
+	var pending int
+	if env.retryQueue != nil {
+		pending = len(env.retryQueue.pending())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := statusReport{
+		Phase:              s.phase,
+		Errors:             make(map[string]subsystemError, len(s.errors)),
+		PendingNodeRetries: pending,
+	}
+	for k, v := range s.errors {
+		r.Errors[k] = v
+	}
+	if !s.lastEnd.IsZero() {
+		counts := make(map[string]int, len(s.lastCount))
+		for k, v := range s.lastCount {
+			counts[k] = v
+		}
+		r.LastRun = &lastRunReport{
+			Start:    s.lastStart,
+			End:      s.lastEnd,
+			Duration: s.lastEnd.Sub(s.lastStart).Seconds(),
+			Counts:   counts,
+		}
+	}
+	if s.phase == phaseRunning {
+		start := s.runStart
+		r.CurrentRunStart = &start
+	}
+	if !s.nextRun.IsZero() {
+		next := s.nextRun
+		r.NextRun = &next
+	}
+	return r
+}
+
+// healthy reports an error when no run finished within the timeout, either
+// because the current one is stuck or because the loop stopped.
+func (s *runStatus) healthy(timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	since := s.started
+	if !s.lastEnd.IsZero() {
+		since = s.lastEnd
+	}
+	if s.phase == phaseRunning {
+		since = s.runStart
+	}
+	if s.phase == phaseStandBy {
+		since = s.standBySince
+	}
+	if elapsed := s.now().Sub(since); elapsed > timeout {
+		return fmt.Errorf("%s for %s, longer than %s", s.phase, elapsed, timeout)
+	}
+	return nil
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(env.status.report())
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := env.status.healthy(env.config.healthTimeout()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("WORKING"))
+}
+
+// serveAdmin exposes the metrics, health and status endpoints.
+func serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/status", statusHandler)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		env.log.WithField("error", err).Errorf("error serving admin endpoints")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func newTestRunStatus(now *time.Time) *runStatus {
+	s := newRunStatus()
+	s.now = func() time.Time { return *now }
+	s.started = *now
+	return s
+}
+
+func (s *S) TestRunStatusReport(c *check.C) {
+	setup(nil)
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	status := newTestRunStatus(&now)
+	c.Assert(status.report().Phase, check.Equals, phaseStarting)
+
+	status.startRun()
+	status.count(countEvents, 3)
+	status.recordError(subsystemTsuru, errors.New("connection refused"))
+	status.recordError(subsystemGlobomapAPI, nil)
+	report := status.report()
+	c.Assert(report.Phase, check.Equals, phaseRunning)
+	c.Assert(*report.CurrentRunStart, check.Equals, now)
+	c.Assert(report.LastRun, check.IsNil)
+
+	start := now
+	now = now.Add(time.Minute)
+	status.endRun(start.Add(time.Hour))
+	report = status.report()
+	c.Assert(report, check.DeepEquals, statusReport{
+		Phase: phaseWaiting,
+		LastRun: &lastRunReport{
+			Start:    start,
+			End:      now,
+			Duration: 60,
+			Counts:   map[string]int{countEvents: 3},
+		},
+		NextRun: func() *time.Time { t := start.Add(time.Hour); return &t }(),
+		Errors: map[string]subsystemError{
+			subsystemTsuru: {Message: "connection refused", Time: start},
+		},
+	})
+
+	status.startRun()
+	report = status.report()
+	c.Assert(report.LastRun.Counts, check.DeepEquals, map[string]int{countEvents: 3})
+	c.Assert(report.NextRun, check.IsNil)
+}
+
+func (s *S) TestRunStatusHealthy(c *check.C) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	status := newTestRunStatus(&now)
+	c.Assert(status.healthy(0), check.IsNil)
+
+	now = now.Add(2 * time.Hour)
+	c.Assert(status.healthy(3*time.Hour), check.IsNil)
+	status.startRun()
+	now = now.Add(3*time.Hour + time.Second)
+	c.Assert(status.healthy(3*time.Hour), check.ErrorMatches, "running for 3h0m1s, longer than 3h0m0s")
+
+	status.endRun(now.Add(time.Hour))
+	c.Assert(status.healthy(3*time.Hour), check.IsNil)
+	now = now.Add(4 * time.Hour)
+	c.Assert(status.healthy(3*time.Hour), check.ErrorMatches, "waiting for 4h0m0s, longer than 3h0m0s")
+}
+
+func (s *S) TestRunStatusStandBy(c *check.C) {
+	now := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	status := newTestRunStatus(&now)
+	now = now.Add(4 * time.Hour)
+	status.standBy(now.Add(time.Hour))
+	c.Assert(status.healthy(3*time.Hour), check.IsNil)
+	report := status.report()
+	c.Assert(report.Phase, check.Equals, phaseStandBy)
+	c.Assert(*report.NextRun, check.Equals, now.Add(time.Hour))
+
+	now = now.Add(4 * time.Hour)
+	c.Assert(status.healthy(3*time.Hour), check.ErrorMatches, "standby for 4h0m0s, longer than 3h0m0s")
+}
+
+func (s *S) TestHealthzHandler(c *check.C) {
+	setup([]string{"--repeat", "1h"})
+	recorder := httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Body.String(), check.Equals, "WORKING")
+
+	env.status.started = time.Now().Add(-4 * time.Hour)
+	recorder = httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	c.Assert(recorder.Code, check.Equals, http.StatusServiceUnavailable)
+}
+
+func (s *S) TestStatusHandler(c *check.C) {
+	setup([]string{"--repeat", "1h"})
+	env.status.recordError(subsystemGlobomapLoader, errors.New("bad gateway"))
+	recorder := httptest.NewRecorder()
+	statusHandler(recorder, httptest.NewRequest(http.MethodGet, "/status", nil))
+	c.Assert(recorder.Code, check.Equals, http.StatusOK)
+	c.Assert(recorder.Header().Get("Content-Type"), check.Equals, "application/json")
+	var report map[string]interface{}
+	err := json.NewDecoder(recorder.Body).Decode(&report)
+	c.Assert(err, check.IsNil)
+	c.Assert(report["phase"], check.Equals, phaseStarting)
+	c.Assert(report["pending_node_retries"], check.Equals, float64(0))
+	errs := report["errors"].(map[string]interface{})
+	c.Assert(errs[subsystemGlobomapLoader].(map[string]interface{})["message"], check.Equals, "bad gateway")
+}
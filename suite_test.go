@@ -30,6 +30,8 @@ func (s *S) SetUpTest(c *check.C) {
 	os.Setenv("TSURU_TOKEN", s.token)
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", "globomap-loader")
 	os.Setenv("GLOBOMAP_API_HOSTNAME", "globomap-api")
+	os.Setenv("GLOBOMAP_POST_BACKOFF", "1ms")
+	os.Setenv("WEBHOOK_SECRET", "secret")
 }
 
 func (s *S) TearDownSuite(c *check.C) {
@@ -37,6 +39,8 @@ func (s *S) TearDownSuite(c *check.C) {
 	os.Unsetenv("TSURU_TOKEN")
 	os.Unsetenv("GLOBOMAP_LOADER_HOSTNAME")
 	os.Unsetenv("GLOBOMAP_API_HOSTNAME")
+	os.Unsetenv("GLOBOMAP_POST_BACKOFF")
+	os.Unsetenv("WEBHOOK_SECRET")
 }
 
 func sortPayload(data []globomap.Payload) {
@@ -0,0 +1,227 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tsuru/globomap-integration/logger"
+	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
+)
+
+// Entities supported by the sync command.
+var syncEntities = []string{"app", "pool", "node", "service", "service-instance"}
+
+// syncCmd posts the same operations loadCmd would for a single entity and
+// its edges, fetching only what's needed to build them.
+type syncCmd struct {
+	entity string
+	name   string
+}
+
+func newSyncCmd(args []string) (*syncCmd, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("Usage: sync <%s> <name>", strings.Join(syncEntities, "|"))
+	}
+	for _, entity := range syncEntities {
+		if args[0] == entity {
+			return &syncCmd{entity: args[0], name: args[1]}, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid sync entity: %s", args[0])
+}
+
+func (c *syncCmd) Run(ctx context.Context) {
+	var ops []operation
+	var err error
+	switch c.entity {
+	case "app":
+		ops, err = c.appOperations()
+	case "pool":
+		ops, err = c.poolOperations()
+	case "node":
+		ops, err = c.nodeOperations()
+	case "service":
+		ops, err = c.serviceOperations()
+	case "service-instance":
+		ops, err = c.serviceInstanceOperations()
+	}
+	log := env.log.With(logger.Fields{"entity": c.entity, "target": c.name})
+	if err != nil {
+		log.WithField("error", err).Errorf("error syncing %s", c.entity)
+		return
+	}
+	if len(ops) == 0 {
+		log.Warnf("%s not found in tsuru API", c.entity)
+		return
+	}
+	log.Debugf("syncing %d operations", len(ops))
+	postUpdates(ops)
+}
+
+func (c *syncCmd) appOperations() ([]operation, error) {
+	cachedApp, units, err := env.tsuru.AppInfoWithUnits(c.name)
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	hosts, err := unitHosts()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	now := time.Now()
+	ops := appOperations("UPDATE", now, cachedApp)
+	ops = append(ops, unitOperations("UPDATE", now, units, hosts)...)
+
+	services, err := env.tsuru.ServiceList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	for _, service := range services {
+		for _, instance := range service.ServiceInstances {
+			if !containsString(instance.Apps, c.name) {
+				continue
+			}
+			ops = append(ops, &appServiceInstanceOperation{
+				baseOperation: baseOperation{action: "UPDATE", time: now},
+				appName:       c.name,
+				instanceName:  instance.Name,
+				serviceName:   instance.ServiceName,
+			})
+		}
+	}
+
+	volumes, err := env.tsuru.VolumeList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	for _, volume := range volumes {
+		for j := range volume.Binds {
+			bind := volume.Binds[j]
+			if bind.Id == nil || bind.Id.App != c.name {
+				continue
+			}
+			ops = append(ops, &appVolumeOperation{
+				baseOperation: baseOperation{action: "UPDATE", time: now},
+				appName:       c.name,
+				volumeName:    volume.Name,
+				mountpoint:    bind.Id.Mountpoint,
+				bind:          &bind,
+			})
+		}
+	}
+	return ops, nil
+}
+
+func (c *syncCmd) poolOperations() ([]operation, error) {
+	var err error
+	env.pools, err = env.tsuru.PoolList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	base := baseOperation{action: "UPDATE", time: time.Now()}
+	var ops []operation
+	for _, pool := range env.pools {
+		if pool.Name != c.name {
+			continue
+		}
+		ops = append(ops, &poolOperation{baseOperation: base, poolName: pool.Name})
+		for _, team := range pool.Teams {
+			ops = append(ops, &teamPoolOperation{baseOperation: base, poolName: pool.Name, teamName: team})
+		}
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	volumes, err := env.tsuru.VolumeList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	for _, volume := range volumes {
+		if volume.Pool == c.name {
+			ops = append(ops, &volumePoolOperation{baseOperation: base, volume: volume})
+		}
+	}
+	return ops, nil
+}
+
+// nodeOperations accepts either the node address or its IP. Names
+// without an IP only match a node by its full address.
+func (c *syncCmd) nodeOperations() ([]operation, error) {
+	nodes, err := env.tsuru.NodeList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	setNodes(nodes)
+	ip := extractIPFromAddr(c.name)
+	for _, node := range nodes {
+		if node.Addr() != c.name && (ip == "" || node.IP() != ip) {
+			continue
+		}
+		return []operation{&nodeOperation{
+			baseOperation: baseOperation{action: "UPDATE", time: time.Now()},
+			nodeAddr:      node.Addr(),
+		}}, nil
+	}
+	return nil, nil
+}
+
+func (c *syncCmd) serviceOperations() ([]operation, error) {
+	service, err := c.findService(c.name)
+	if err != nil || service == nil {
+		return nil, err
+	}
+	base := baseOperation{action: "UPDATE", time: time.Now()}
+	ops := []operation{
+		&serviceOperation{baseOperation: base, service: *service},
+		&serviceBrokerServiceOperation{baseOperation: base, serviceName: service.Service},
+	}
+	for _, instance := range service.ServiceInstances {
+		ops = append(ops, serviceInstanceOperations(base.action, base.time, instance)...)
+	}
+	return ops, nil
+}
+
+// serviceInstanceOperations takes the instance name as <service>/<instance>.
+func (c *syncCmd) serviceInstanceOperations() ([]operation, error) {
+	parts := strings.SplitN(c.name, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("service instance must be given as <service>/<instance>: %s", c.name)
+	}
+	service, err := c.findService(parts[0])
+	if err != nil || service == nil {
+		return nil, err
+	}
+	for _, instance := range service.ServiceInstances {
+		if instance.Name == parts[1] {
+			return serviceInstanceOperations("UPDATE", time.Now(), instance), nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *syncCmd) findService(name string) (*tsuru.Service, error) {
+	services, err := env.tsuru.ServiceList()
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		return nil, err
+	}
+	for i := range services {
+		if services[i].Service == name {
+			return &services[i], nil
+		}
+	}
+	return nil, nil
+}
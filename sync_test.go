@@ -0,0 +1,233 @@
+// Copyright 2017 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
+	"gopkg.in/check.v1"
+)
+
+// newSyncLoaderServer records the payloads posted to globomap loader.
+func newSyncLoaderServer(c *check.C, posted *[]globomap.Payload) *httptest.Server {
+	var m sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+		var data []globomap.Payload
+		err := json.NewDecoder(r.Body).Decode(&data)
+		c.Assert(err, check.IsNil)
+		m.Lock()
+		*posted = append(*posted, data...)
+		m.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+}
+
+func payloadKeys(data []globomap.Payload) []string {
+	sortPayload(data)
+	keys := make([]string, len(data))
+	for i := range data {
+		keys[i] = data[i].Collection + "/" + data[i].Key
+	}
+	return keys
+}
+
+func (s *S) TestSyncCmdApp(c *check.C) {
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/1.0/apps/myapp1":
+			json.NewEncoder(w).Encode(struct {
+				app
+				Units []unit `json:"units"`
+			}{
+				app{Name: "myapp1", Pool: "pool1", TeamOwner: "team1"},
+				[]unit{{Id: "unit1", Appname: "myapp1", Processname: "web", Ip: "1.1.1.1", Status: "started"}},
+			})
+		case "/1.0/services/instances":
+			json.NewEncoder(w).Encode([]tsuru.Service{
+				{Service: "mysql", ServiceInstances: []tsuru.ServiceInstance{
+					{ServiceName: "mysql", Name: "db1", Apps: []string{"myapp1"}},
+					{ServiceName: "mysql", Name: "db2", Apps: []string{"myapp2"}},
+				}},
+			})
+		case "/1.4/volumes":
+			json.NewEncoder(w).Encode([]tsuru.Volume{{
+				Name:  "vol1",
+				Pool:  "pool1",
+				Binds: []tsuru.VolumeBind{{Id: &tsuru.VolumeBindId{App: "myapp1", Mountpoint: "/data", Volume: "vol1"}}},
+			}})
+		case "/1.2/node":
+			json.NewEncoder(w).Encode(struct{ Nodes []node }{})
+		default:
+			c.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	var posted []globomap.Payload
+	loader := newSyncLoaderServer(c, &posted)
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+
+	setup([]string{"sync", "app", "myapp1"})
+	env.cmd.Run(context.Background())
+
+	c.Assert(payloadKeys(posted), check.DeepEquals, []string{
+		"tsuru_app/tsuru_myapp1",
+		"tsuru_app_service_instance/tsuru_myapp1_db1",
+		"tsuru_app_unit/tsuru_unit1",
+		"tsuru_app_volume/tsuru_myapp1_vol1_data",
+		"tsuru_pool_app/tsuru_myapp1-pool",
+		"tsuru_team_app/tsuru_myapp1-team",
+		"tsuru_unit/tsuru_unit1",
+	})
+}
+
+func (s *S) TestSyncCmdServiceInstance(c *check.C) {
+	services := []tsuru.Service{
+		{Service: "mysql", ServiceInstances: []tsuru.ServiceInstance{
+			{ServiceName: "mysql", Name: "db1", TeamOwner: "team1", Apps: []string{"myapp1", "myapp2"}},
+			{ServiceName: "mysql", Name: "db2", TeamOwner: "team1"},
+		}},
+	}
+	tsuruServer := newTsuruServer(nil, services, nil, nil, nil)
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	var posted []globomap.Payload
+	loader := newSyncLoaderServer(c, &posted)
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+
+	setup([]string{"sync", "service-instance", "mysql/db1"})
+	env.cmd.Run(context.Background())
+
+	c.Assert(payloadKeys(posted), check.DeepEquals, []string{
+		"tsuru_app_service_instance/tsuru_myapp1_db1",
+		"tsuru_app_service_instance/tsuru_myapp2_db1",
+		"tsuru_service_instance/tsuru_mysql_db1",
+		"tsuru_service_service_instance/tsuru_mysql_db1",
+		"tsuru_team_service_instance/tsuru_mysql_db1-team",
+	})
+}
+
+func (s *S) TestSyncCmdService(c *check.C) {
+	services := []tsuru.Service{
+		{Service: "mysql", ServiceInstances: []tsuru.ServiceInstance{
+			{ServiceName: "mysql", Name: "db1", TeamOwner: "team1", Apps: []string{"myapp1"}},
+			{ServiceName: "mysql", Name: "db2", TeamOwner: "team2"},
+		}},
+		{Service: "redis", ServiceInstances: []tsuru.ServiceInstance{{ServiceName: "redis", Name: "cache1"}}},
+	}
+	tsuruServer := newTsuruServer(nil, services, nil, nil, nil)
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	var posted []globomap.Payload
+	loader := newSyncLoaderServer(c, &posted)
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+
+	setup([]string{"sync", "service", "mysql"})
+	env.cmd.Run(context.Background())
+
+	c.Assert(payloadKeys(posted), check.DeepEquals, []string{
+		"tsuru_app_service_instance/tsuru_myapp1_db1",
+		"tsuru_service/tsuru_mysql",
+		"tsuru_service_instance/tsuru_mysql_db1",
+		"tsuru_service_instance/tsuru_mysql_db2",
+		"tsuru_service_service_instance/tsuru_mysql_db1",
+		"tsuru_service_service_instance/tsuru_mysql_db2",
+		"tsuru_team_service_instance/tsuru_mysql_db1-team",
+		"tsuru_team_service_instance/tsuru_mysql_db2-team",
+	})
+}
+
+func (s *S) TestSyncCmdPool(c *check.C) {
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/1.0/pools":
+			json.NewEncoder(w).Encode([]pool{{Name: "pool1", Teams: []string{"team1"}}, {Name: "pool2"}})
+		case "/1.4/volumes":
+			json.NewEncoder(w).Encode([]tsuru.Volume{{Name: "vol1", Pool: "pool1"}, {Name: "vol2", Pool: "pool2"}})
+		default:
+			c.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	var posted []globomap.Payload
+	loader := newSyncLoaderServer(c, &posted)
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+
+	setup([]string{"sync", "pool", "pool1"})
+	env.cmd.Run(context.Background())
+
+	c.Assert(payloadKeys(posted), check.DeepEquals, []string{
+		"tsuru_pool/tsuru_pool1",
+		"tsuru_team_pool/tsuru_pool1_team1",
+		"tsuru_volume_pool/tsuru_vol1-pool",
+	})
+}
+
+func (s *S) TestSyncCmdNotFound(c *check.C) {
+	tsuruServer := newTsuruServer(nil, nil, nil, nil, []node{{Pool: "pool1", Iaasid: "node1", Address: "https://1.1.1.1:2376"}})
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	loader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("unexpected post to globomap loader")
+	}))
+	defer loader.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", loader.URL)
+
+	setup([]string{"sync", "node", "2.2.2.2"})
+	env.cmd.Run(context.Background())
+	setup([]string{"sync", "service", "mysql"})
+	env.cmd.Run(context.Background())
+}
+
+func (s *S) TestSyncCmdNodeOperations(c *check.C) {
+	tsuruServer := newTsuruServer(nil, nil, nil, nil, []node{
+		{Pool: "pool1", Iaasid: "node1", Address: "https://node1.example.com:2376"},
+		{Pool: "pool1", Iaasid: "node2", Address: "https://2.2.2.2:2376"},
+	})
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	setup(nil)
+
+	ops, err := (&syncCmd{entity: "node", name: "node3"}).nodeOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 0)
+
+	ops, err = (&syncCmd{entity: "node", name: "https://node1.example.com:2376"}).nodeOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 1)
+	c.Assert(ops[0].(*nodeOperation).nodeAddr, check.Equals, "https://node1.example.com:2376")
+
+	ops, err = (&syncCmd{entity: "node", name: "2.2.2.2"}).nodeOperations()
+	c.Assert(err, check.IsNil)
+	c.Assert(ops, check.HasLen, 1)
+	c.Assert(ops[0].(*nodeOperation).nodeAddr, check.Equals, "https://2.2.2.2:2376")
+}
+
+func (s *S) TestNewSyncCmd(c *check.C) {
+	cmd, err := newSyncCmd([]string{"node", "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(cmd, check.DeepEquals, &syncCmd{entity: "node", name: "10.0.0.1"})
+
+	_, err = newSyncCmd([]string{"app"})
+	c.Assert(err, check.ErrorMatches, `Usage: sync <app\|pool\|node\|service\|service-instance> <name>`)
+	_, err = newSyncCmd([]string{"team", "team1"})
+	c.Assert(err, check.ErrorMatches, "Invalid sync entity: team")
+}
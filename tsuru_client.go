@@ -10,6 +10,8 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
@@ -22,6 +24,10 @@ const TIME_FORMAT = "2006-01-02T15:04:05-07:00"
 type tsuruClient struct {
 	Hostname string
 	Token    string
+
+	// Context, when set, cancels the requests made to tsuru API.
+	Context context.Context
+	ctxMu   sync.Mutex
 }
 
 type app tsuru.App
@@ -30,6 +36,8 @@ type pool tsuru.Pool
 
 type node tsuru.Node
 
+type unit tsuru.Unit
+
 type event struct {
 	Target struct {
 		Type  string
@@ -38,7 +46,9 @@ type event struct {
 	Kind struct {
 		Name string
 	}
+	StartTime       time.Time
 	EndTime         time.Time
+	Running         bool
 	Error           string
 	EndCustomData   bson.Raw
 	StartCustomData bson.Raw
@@ -49,6 +59,7 @@ type eventFilter struct {
 	TargetType string
 	Since      *time.Time
 	Until      *time.Time
+	Running    bool
 }
 
 func (a *app) Addresses() []string {
@@ -66,6 +77,13 @@ func (e *event) EndData(value interface{}) error {
 	return e.EndCustomData.Unmarshal(value)
 }
 
+func (u *unit) Addr() string {
+	if u.Address == nil {
+		return ""
+	}
+	return u.Address.Scheme + "://" + u.Address.Host
+}
+
 func (n *node) Name() string {
 	return n.Iaasid
 }
@@ -103,7 +121,7 @@ func (t *tsuruClient) EventList(f eventFilter) ([]event, error) {
 }
 
 func (t *tsuruClient) AppList() ([]tsuru.MiniApp, error) {
-	apps, _, err := t.apiClient().AppApi.AppList(context.Background(), make(map[string]interface{}))
+	apps, _, err := t.apiClient().AppApi.AppList(t.ctx(), make(map[string]interface{}))
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +129,7 @@ func (t *tsuruClient) AppList() ([]tsuru.MiniApp, error) {
 }
 
 func (t *tsuruClient) AppInfo(name string) (*app, error) {
-	a, _, err := t.apiClient().AppApi.AppGet(context.Background(), name)
+	a, _, err := t.apiClient().AppApi.AppGet(t.ctx(), name)
 	if err != nil {
 		return nil, err
 	}
@@ -119,8 +137,31 @@ func (t *tsuruClient) AppInfo(name string) (*app, error) {
 	return &iApp, nil
 }
 
+// AppInfoWithUnits returns the app along with its units, which are part of
+// the app info response but not of the tsuru.App model.
+func (t *tsuruClient) AppInfoWithUnits(name string) (*app, []unit, error) {
+	resp, err := t.doRequest("/1.0/apps/" + url.PathEscape(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New(resp.Status)
+	}
+
+	var data struct {
+		app
+		Units []unit `json:"units"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &data.app, data.Units, nil
+}
+
 func (t *tsuruClient) PoolList() ([]pool, error) {
-	poolList, _, err := t.apiClient().PoolApi.PoolList(context.Background())
+	poolList, _, err := t.apiClient().PoolApi.PoolList(t.ctx())
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +173,7 @@ func (t *tsuruClient) PoolList() ([]pool, error) {
 }
 
 func (t *tsuruClient) NodeList() ([]node, error) {
-	nodeList, _, err := t.apiClient().NodeApi.NodeList(context.Background())
+	nodeList, _, err := t.apiClient().NodeApi.NodeList(t.ctx())
 	if err != nil {
 		return nil, err
 	}
@@ -144,23 +185,119 @@ func (t *tsuruClient) NodeList() ([]node, error) {
 }
 
 func (t *tsuruClient) ServiceList() ([]tsuru.Service, error) {
-	services, _, err := t.apiClient().ServiceApi.InstancesList(context.Background(), map[string]interface{}{})
+	services, _, err := t.apiClient().ServiceApi.InstancesList(t.ctx(), map[string]interface{}{})
 	if err != nil {
 		return nil, err
 	}
 	return services, nil
 }
 
+func (t *tsuruClient) ServiceBrokerList() ([]tsuru.ServiceBroker, error) {
+	brokers, _, err := t.apiClient().ServiceApi.ServiceBrokerList(t.ctx())
+	if err != nil {
+		return nil, err
+	}
+	return brokers.Brokers, nil
+}
+
+func (t *tsuruClient) TeamList() ([]tsuru.Team, error) {
+	teams, _, err := t.apiClient().TeamApi.TeamsList(t.ctx())
+	if err != nil {
+		return nil, err
+	}
+	return teams, nil
+}
+
+func (t *tsuruClient) PlatformList() ([]tsuru.Platform, error) {
+	platforms, _, err := t.apiClient().PlatformApi.PlatformList(t.ctx())
+	if err != nil {
+		return nil, err
+	}
+	return platforms, nil
+}
+
+func (t *tsuruClient) VolumeList() ([]tsuru.Volume, error) {
+	volumes, _, err := t.apiClient().VolumeApi.VolumeList(t.ctx())
+	if err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+func (t *tsuruClient) WebhookCreate(webhook tsuru.Webhook) error {
+	_, err := t.apiClient().EventApi.WebhookCreate(t.ctx(), webhook)
+	return err
+}
+
+func (t *tsuruClient) RouterList() ([]tsuru.Router, error) {
+	resp, err := t.doRequest("/1.0/routers")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var routers []tsuru.Router
+	err = json.NewDecoder(resp.Body).Decode(&routers)
+	if err != nil {
+		return nil, err
+	}
+	return routers, nil
+}
+
+func (t *tsuruClient) PlanList() ([]tsuru.Plan, error) {
+	resp, err := t.doRequest("/1.0/plans")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+
+	var plans []tsuru.Plan
+	err = json.NewDecoder(resp.Body).Decode(&plans)
+	if err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
 func (t *tsuruClient) doRequest(path string) (*http.Response, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest(http.MethodGet, t.Hostname+path, nil)
 	if err != nil {
 		return nil, err
 	}
+	req = req.WithContext(t.ctx())
 	req.Header.Add("Authorization", "b "+t.Token)
 	return client.Do(req)
 }
 
+// SetContext replaces the client context while it may be in use.
+func (t *tsuruClient) SetContext(ctx context.Context) {
+	t.ctxMu.Lock()
+	defer t.ctxMu.Unlock()
+	t.Context = ctx
+}
+
+func (t *tsuruClient) ctx() context.Context {
+	t.ctxMu.Lock()
+	defer t.ctxMu.Unlock()
+	if t.Context == nil {
+		return context.Background()
+	}
+	return t.Context
+}
+
 func (t *tsuruClient) apiClient() *tsuru.APIClient {
 	cfg := tsuru.Configuration{
 		BasePath: t.Hostname,
@@ -173,7 +310,7 @@ func (t *tsuruClient) apiClient() *tsuru.APIClient {
 
 func (f *eventFilter) format() string {
 	v := url.Values{}
-	v.Set("running", "false")
+	v.Set("running", strconv.FormatBool(f.Running))
 	for _, k := range f.Kindnames {
 		v.Add("kindname", k)
 	}
@@ -302,3 +302,233 @@ func (s *S) TestServiceList(c *check.C) {
 	c.Assert(services[0].Service, check.DeepEquals, "service1")
 	c.Assert(services[1].Service, check.DeepEquals, "service2")
 }
+
+func (s *S) TestTeamList(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		c.Assert(r.URL.Path, check.Equals, "/1.0/teams")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "bearer "+s.token)
+
+		t1 := tsuru.Team{Name: "team1"}
+		t2 := tsuru.Team{Name: "team2"}
+		json.NewEncoder(w).Encode([]tsuru.Team{t1, t2})
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	teams, err := client.TeamList()
+	c.Assert(err, check.IsNil)
+	c.Assert(teams, check.HasLen, 2)
+	c.Assert(teams[0].Name, check.Equals, "team1")
+	c.Assert(teams[1].Name, check.Equals, "team2")
+}
+
+func (s *S) TestWebhookCreate(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/1.6/events/webhooks")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "bearer "+s.token)
+
+		var webhook tsuru.Webhook
+		err := json.NewDecoder(r.Body).Decode(&webhook)
+		c.Assert(err, check.IsNil)
+		c.Assert(webhook.Name, check.Equals, "hook1")
+		c.Assert(webhook.Url, check.Equals, "http://myhost")
+		if webhook.TeamOwner == "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	err := client.WebhookCreate(tsuru.Webhook{Name: "hook1", Url: "http://myhost", TeamOwner: "team1"})
+	c.Assert(err, check.IsNil)
+
+	err = client.WebhookCreate(tsuru.Webhook{Name: "hook1", Url: "http://myhost"})
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestPlatformList(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		c.Assert(r.URL.Path, check.Equals, "/1.0/platforms")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "bearer "+s.token)
+
+		p1 := tsuru.Platform{Name: "go"}
+		p2 := tsuru.Platform{Name: "python", Disabled: true}
+		json.NewEncoder(w).Encode([]tsuru.Platform{p1, p2})
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	platforms, err := client.PlatformList()
+	c.Assert(err, check.IsNil)
+	c.Assert(platforms, check.HasLen, 2)
+	c.Assert(platforms[0].Name, check.Equals, "go")
+	c.Assert(platforms[1].Disabled, check.Equals, true)
+}
+
+func (s *S) TestRouterList(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		c.Assert(r.URL.Path, check.Equals, "/1.0/routers")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "b "+s.token)
+
+		r1 := tsuru.Router{Name: "galeb", Type_: "galebv2"}
+		r2 := tsuru.Router{Name: "hipache", Type_: "hipache"}
+		json.NewEncoder(w).Encode([]tsuru.Router{r1, r2})
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	routers, err := client.RouterList()
+	c.Assert(err, check.IsNil)
+	c.Assert(routers, check.HasLen, 2)
+	c.Assert(routers[0].Name, check.Equals, "galeb")
+	c.Assert(routers[1].Type_, check.Equals, "hipache")
+}
+
+func (s *S) TestRouterListError(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	routers, err := client.RouterList()
+	c.Assert(err, check.NotNil)
+	c.Assert(routers, check.HasLen, 0)
+}
+
+func (s *S) TestVolumeList(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		c.Assert(r.URL.Path, check.Equals, "/1.4/volumes")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "bearer "+s.token)
+
+		v1 := tsuru.Volume{Name: "vol1"}
+		v2 := tsuru.Volume{Name: "vol2"}
+		json.NewEncoder(w).Encode([]tsuru.Volume{v1, v2})
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	volumes, err := client.VolumeList()
+	c.Assert(err, check.IsNil)
+	c.Assert(volumes, check.HasLen, 2)
+	c.Assert(volumes[0].Name, check.Equals, "vol1")
+	c.Assert(volumes[1].Name, check.Equals, "vol2")
+}
+
+func (s *S) TestAppInfoWithUnits(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		c.Assert(r.URL.Path, check.Equals, "/1.0/apps/test-app")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "b "+s.token)
+
+		w.Write([]byte(`{"name":"test-app","pool":"pool1","units":[{"id":"abc","processname":"web","ip":"10.0.0.1"}]}`))
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	app, units, err := client.AppInfoWithUnits("test-app")
+	c.Assert(err, check.IsNil)
+	c.Assert(app, check.NotNil)
+	c.Assert(app.Name, check.Equals, "test-app")
+	c.Assert(app.Pool, check.Equals, "pool1")
+	c.Assert(units, check.HasLen, 1)
+	c.Assert(units[0].Id, check.Equals, "abc")
+	c.Assert(units[0].Processname, check.Equals, "web")
+	c.Assert(units[0].Ip, check.Equals, "10.0.0.1")
+}
+
+func (s *S) TestAppInfoWithUnitsNotFound(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	app, units, err := client.AppInfoWithUnits("test-app")
+	c.Assert(err, check.NotNil)
+	c.Assert(app, check.IsNil)
+	c.Assert(units, check.HasLen, 0)
+}
+
+func (s *S) TestUnitAddr(c *check.C) {
+	u := unit{}
+	c.Assert(u.Addr(), check.Equals, "")
+	u.Address = &tsuru.Url{Scheme: "http", Host: "10.0.0.1:32768"}
+	c.Assert(u.Addr(), check.Equals, "http://10.0.0.1:32768")
+}
+
+func (s *S) TestPlanList(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		c.Assert(r.URL.Path, check.Equals, "/1.0/plans")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "b "+s.token)
+
+		p1 := tsuru.Plan{Name: "small", Default_: true}
+		p2 := tsuru.Plan{Name: "large"}
+		json.NewEncoder(w).Encode([]tsuru.Plan{p1, p2})
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	plans, err := client.PlanList()
+	c.Assert(err, check.IsNil)
+	c.Assert(plans, check.HasLen, 2)
+	c.Assert(plans[0].Name, check.Equals, "small")
+	c.Assert(plans[0].Default_, check.Equals, true)
+	c.Assert(plans[1].Name, check.Equals, "large")
+}
+
+func (s *S) TestServiceBrokerList(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.Method, check.Equals, http.MethodGet)
+		c.Assert(r.URL.Path, check.Equals, "/1.7/brokers")
+		c.Assert(r.Header.Get("Authorization"), check.Equals, "bearer "+s.token)
+
+		b1 := tsuru.ServiceBroker{Name: "broker1"}
+		b2 := tsuru.ServiceBroker{Name: "broker2"}
+		json.NewEncoder(w).Encode(tsuru.ServiceBrokerList{Brokers: []tsuru.ServiceBroker{b1, b2}})
+	}))
+	defer server.Close()
+	client := tsuruClient{
+		Hostname: server.URL,
+		Token:    s.token,
+	}
+
+	brokers, err := client.ServiceBrokerList()
+	c.Assert(err, check.IsNil)
+	c.Assert(brokers, check.HasLen, 2)
+	c.Assert(brokers[0].Name, check.Equals, "broker1")
+	c.Assert(brokers[1].Name, check.Equals, "broker2")
+}
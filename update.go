@@ -5,66 +5,182 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
 	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
 )
 
 type updateCmd struct{}
 
+var eventKindnames = []string{
+	"app.create", "app.update", "app.delete", "app.deploy",
+	"app.update.router.add", "app.update.router.update", "app.update.router.remove",
+	"pool.create", "pool.update", "pool.delete",
+	"pool.update.team.add", "pool.update.team.remove",
+	"node.create", "node.delete",
+	"service.create", "service.delete",
+	"service-instance.create", "service-instance.delete",
+	"team.create", "team.update", "team.delete",
+	"platform.create", "platform.update", "platform.delete",
+	"router.create", "router.update", "router.delete",
+	"volume.create", "volume.update", "volume.delete",
+	"volume.update.bind", "volume.update.unbind",
+	"plan.create", "plan.delete",
+	"service-broker.create", "service-broker.update", "service-broker.delete",
+}
+
+// healerKindname is only processed when the target is a node
+const healerKindname = "healer"
+
+var bindEventKindnames = []string{"app.update.bind", "app.update.unbind"}
+
+// eventProcessors returns the processors for the events in eventKindnames.
+// A new map is built on each call, since some processors cache data fetched
+// from tsuru.
+func eventProcessors() map[string]eventProcessorFunc {
+	return map[string]eventProcessorFunc{
+		"pool":             processPoolEvents,
+		"node":             processNodeEvents,
+		"app":              processAppEvents,
+		"service":          processorAsFunc(&serviceProcessor{}),
+		"service-instance": processorAsFunc(&serviceInstanceProcessor{}),
+		"team":             processorAsFunc(&teamProcessor{}),
+		"platform":         processorAsFunc(&platformProcessor{}),
+		"router":           processorAsFunc(&routerProcessor{}),
+		"volume":           processorAsFunc(&volumeProcessor{}),
+		"plan":             processorAsFunc(&planProcessor{}),
+		"service-broker":   processorAsFunc(&serviceBrokerProcessor{}),
+	}
+}
+
+func bindEventProcessors() map[string]eventProcessorFunc {
+	return map[string]eventProcessorFunc{
+		"app": processAppInstanceEvents,
+	}
+}
+
 type groupedEvents map[string][]event
 
-func (u *updateCmd) Run() {
+func (u *updateCmd) Run(ctx context.Context) {
+	start := time.Now()
+	env.compUnitReport.reset()
+	defer func() {
+		runDuration.set(time.Since(start).Seconds())
+		env.compUnitReport.log()
+	}()
+
 	since := time.Now().Add(-1 * *env.config.start)
+	if env.checkpoint != nil {
+		last, err := env.checkpoint.Load()
+		if err != nil {
+			env.log.WithField("error", err).Errorf("error loading checkpoint, falling back to start time")
+		} else if last != nil {
+			since = *last
+		}
+	}
+
+	env.log.Debugf("fetching events since %s", since)
 
-	if env.config.verbose {
-		fmt.Printf("Fetching events since %s\n", since)
+	// dry and diff runs only preview the events, which must still be
+	// posted by the next run
+	saveCheckpoint := env.checkpoint != nil && !env.config.dry && !env.config.diff
+	var resume time.Time
+	var resumeErr error
+	if saveCheckpoint {
+		resume, resumeErr = resumeTime(since)
 	}
 
-	events := fetchEvents([]eventFilter{
-		{Kindnames: []string{
-			"app.create", "app.update", "app.delete",
-			"pool.create", "pool.update", "pool.delete",
-			"node.create", "node.delete",
-			"service.create", "service.delete",
-			"service-instance.create", "service-instance.delete",
-		}, Since: &since},
-		{Kindnames: []string{"healer"}, TargetType: "node", Since: &since},
+	events, fetchErr := fetchEvents([]eventFilter{
+		{Kindnames: eventKindnames, Since: &since},
+		{Kindnames: []string{healerKindname}, TargetType: "node", Since: &since},
 	})
 
-	if env.config.verbose {
-		fmt.Printf("Found %d events\n", len(events))
+	env.log.Debugf("found %d events", len(events))
+	if interrupted(ctx) {
+		return
 	}
 
-	processEvents(events, map[string]eventProcessorFunc{
-		"pool":             processPoolEvents,
-		"node":             processNodeEvents,
-		"app":              processAppEvents,
-		"service":          processorAsFunc(&serviceProcessor{}),
-		"service-instance": processorAsFunc(&serviceInstanceProcessor{}),
-	})
+	postErr := processEvents(events, eventProcessors())
+	if interrupted(ctx) {
+		return
+	}
 
-	events = fetchEvents([]eventFilter{
-		{Kindnames: []string{"app.update.bind", "app.update.unbind"}, Since: &since},
+	bindEvents, bindFetchErr := fetchEvents([]eventFilter{
+		{Kindnames: bindEventKindnames, Since: &since},
 	})
 
-	if env.config.verbose {
-		fmt.Printf("Found %d bind/unbind events\n", len(events))
+	env.log.Debugf("found %d bind/unbind events", len(bindEvents))
+	if interrupted(ctx) {
+		return
 	}
 
-	processEvents(events, map[string]eventProcessorFunc{
-		"app": processAppInstanceEvents,
-	})
+	bindPostErr := processEvents(bindEvents, bindEventProcessors())
 
+	succeeded := fetchErr == nil && postErr == nil && bindFetchErr == nil && bindPostErr == nil
+	if succeeded {
+		lastSuccess.set(float64(time.Now().Unix()))
+	}
+	if !saveCheckpoint {
+		return
+	}
+	if !succeeded || resumeErr != nil {
+		env.log.Warnf("not all events were processed and posted, keeping the previous checkpoint")
+		return
+	}
+	if !resume.After(since) {
+		return
+	}
+	if err := env.checkpoint.Save(resume); err != nil {
+		env.log.WithField("error", err).Errorf("error saving checkpoint")
+	}
 }
 
-func fetchEvents(filters []eventFilter) []event {
+// interrupted reports whether the run was cancelled, in which case the
+// remaining events are left to the next run, from the previous checkpoint.
+func interrupted(ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	env.log.Warnf("update interrupted, keeping the previous checkpoint")
+	return true
+}
+
+// resumeTime returns where the next run starts fetching events: now, before
+// the finished events are fetched, or the start of the earliest event still
+// running if it's earlier, since tsuru filters events by their start time
+// and only lists the finished ones.
+func resumeTime(since time.Time) (time.Time, error) {
+	resume := time.Now()
+	kinds := append([]string{healerKindname}, eventKindnames...)
+	kinds = append(kinds, bindEventKindnames...)
+	running, err := env.tsuru.EventList(eventFilter{Kindnames: kinds, Since: &since, Running: true})
+	if err != nil {
+		env.status.recordError(subsystemTsuru, err)
+		env.log.WithField("error", err).Errorf("error fetching running events")
+		return resume, err
+	}
+	for _, e := range running {
+		if e.StartTime.Before(resume) {
+			resume = e.StartTime
+		}
+	}
+	return resume, nil
+}
+
+// fetchEvents returns the events matching any of the filters. Events from
+// filters that succeeded are returned even when another one fails, along
+// with the error.
+func fetchEvents(filters []eventFilter) ([]event, error) {
 
 	eventStream := make(chan []event, len(filters))
+	errStream := make(chan error, len(filters))
 	var wg sync.WaitGroup
 	wg.Add(len(filters))
 
@@ -73,9 +189,9 @@ func fetchEvents(filters []eventFilter) []event {
 			defer wg.Done()
 			events, err := env.tsuru.EventList(f)
 			if err != nil {
-				if env.config.verbose {
-					fmt.Printf("Error fetching events: %s\n", err)
-				}
+				env.status.recordError(subsystemTsuru, err)
+				env.log.WithField("error", err).Errorf("error fetching events")
+				errStream <- err
 			} else {
 				eventStream <- events
 			}
@@ -91,7 +207,12 @@ func fetchEvents(filters []eventFilter) []event {
 	for evs := range eventStream {
 		events = append(events, evs...)
 	}
-	return events
+	for _, e := range events {
+		eventsFetched.inc(e.Kind.Name)
+	}
+	env.status.count(countEvents, len(events))
+	close(errStream)
+	return events, <-errStream
 }
 
 type eventProcessor interface {
@@ -105,11 +226,14 @@ func processorAsFunc(p eventProcessor) eventProcessorFunc {
 type eventProcessorFunc func(target string, events []event) ([]operation, error)
 
 // processEvents groups events by target and pass each of the groups to the
-// corresponding processor
-func processEvents(events []event, processors map[string]eventProcessorFunc) {
+// corresponding processor, returning the error from posting the resulting
+// operations or, when they're posted, the last error from a processor. The
+// operations of the other targets are posted even when a processor fails.
+func processEvents(events []event, processors map[string]eventProcessorFunc) error {
 
 	group := groupByTarget(events)
 	operations := []operation{}
+	var processErr error
 	for g, p := range processors {
 		for target, evs := range group[g] {
 			sort.Slice(evs, func(i, j int) bool {
@@ -117,16 +241,19 @@ func processEvents(events []event, processors map[string]eventProcessorFunc) {
 			})
 			ops, err := p(target, evs)
 			if err != nil {
-				if env.config.verbose {
-					fmt.Printf("[%v] Error processing %s events: %v", g, target, err)
-				}
+				env.status.recordError(subsystemTsuru, err)
+				env.log.With(logger.Fields{"entity": g, "target": target, "error": err}).Errorf("error processing events")
+				processErr = err
 				continue
 			}
 			operations = append(operations, ops...)
 		}
 	}
 
-	postUpdates(operations)
+	if err := postUpdates(operations); err != nil {
+		return err
+	}
+	return processErr
 }
 
 type serviceInstanceProcessor struct {
@@ -180,7 +307,15 @@ func (p *serviceInstanceProcessor) process(target string, events []event) ([]ope
 		instance: instance,
 	}
 
-	operations = append(operations, &op, &op2)
+	op3 := teamServiceInstanceOperation{
+		baseOperation: baseOperation{
+			action: lastStatus,
+			time:   endTime,
+		},
+		instance: instance,
+	}
+
+	operations = append(operations, &op, &op2, &op3)
 
 	return operations, nil
 }
@@ -219,11 +354,312 @@ func (p *serviceProcessor) process(target string, events []event) ([]operation,
 		service: service,
 	}
 
-	operations = append(operations, &op)
+	op2 := serviceBrokerServiceOperation{
+		baseOperation: baseOperation{
+			action: lastStatus,
+			time:   endTime,
+		},
+		serviceName: target,
+	}
+
+	operations = append(operations, &op, &op2)
 
 	return operations, nil
 }
 
+type teamProcessor struct {
+	teams map[string]tsuru.Team
+}
+
+func (p *teamProcessor) process(target string, events []event) ([]operation, error) {
+	if len(events) > 0 && p.teams == nil {
+		teams, err := env.tsuru.TeamList()
+		if err != nil {
+			return nil, err
+		}
+		p.teams = make(map[string]tsuru.Team)
+		for _, t := range teams {
+			p.teams[t.Name] = t
+		}
+	}
+
+	endTime := events[len(events)-1].EndTime
+	lastStatus := eventStatus(events[len(events)-1])
+	team := p.teams[target]
+
+	// we need to make sure we set the name even if the team
+	// was deleted (and is not in the map)
+	team.Name = target
+
+	operations := []operation{&teamOperation{
+		baseOperation: baseOperation{
+			action: lastStatus,
+			time:   endTime,
+		},
+		team: team,
+	}}
+
+	if lastStatus == "DELETE" {
+		for _, collection := range []string{"tsuru_team_app", "tsuru_team_pool"} {
+			stale, err := staleEdges(collection, "_from", "tsuru_team/tsuru_"+target, nil, endTime)
+			if err != nil {
+				return nil, err
+			}
+			operations = append(operations, stale...)
+		}
+	}
+
+	return operations, nil
+}
+
+type platformProcessor struct {
+	platforms map[string]tsuru.Platform
+}
+
+func (p *platformProcessor) process(target string, events []event) ([]operation, error) {
+	if len(events) > 0 && p.platforms == nil {
+		platforms, err := env.tsuru.PlatformList()
+		if err != nil {
+			return nil, err
+		}
+		p.platforms = make(map[string]tsuru.Platform)
+		for _, pl := range platforms {
+			p.platforms[pl.Name] = pl
+		}
+	}
+
+	endTime := events[len(events)-1].EndTime
+	lastStatus := eventStatus(events[len(events)-1])
+	platform := p.platforms[target]
+
+	// we need to make sure we set the name even if the platform
+	// was deleted (and is not in the map)
+	platform.Name = target
+
+	op := &platformOperation{
+		baseOperation: baseOperation{
+			action: lastStatus,
+			time:   endTime,
+		},
+		platform: platform,
+	}
+
+	return []operation{op}, nil
+}
+
+type routerProcessor struct {
+	routers map[string]tsuru.Router
+}
+
+func (p *routerProcessor) process(target string, events []event) ([]operation, error) {
+	if len(events) > 0 && p.routers == nil {
+		routers, err := env.tsuru.RouterList()
+		if err != nil {
+			return nil, err
+		}
+		p.routers = make(map[string]tsuru.Router)
+		for _, r := range routers {
+			p.routers[r.Name] = r
+		}
+	}
+
+	endTime := events[len(events)-1].EndTime
+	lastStatus := eventStatus(events[len(events)-1])
+	router := p.routers[target]
+
+	// we need to make sure we set the name even if the router
+	// was deleted (and is not in the map)
+	router.Name = target
+
+	op := &routerOperation{
+		baseOperation: baseOperation{
+			action: lastStatus,
+			time:   endTime,
+		},
+		router: router,
+	}
+
+	return []operation{op}, nil
+}
+
+type serviceBrokerProcessor struct {
+	brokers map[string]tsuru.ServiceBroker
+}
+
+func (p *serviceBrokerProcessor) process(target string, events []event) ([]operation, error) {
+	if len(events) > 0 && p.brokers == nil {
+		brokers, err := env.tsuru.ServiceBrokerList()
+		if err != nil {
+			return nil, err
+		}
+		p.brokers = make(map[string]tsuru.ServiceBroker)
+		for _, b := range brokers {
+			p.brokers[b.Name] = b
+		}
+	}
+
+	endTime := events[len(events)-1].EndTime
+	lastStatus := eventStatus(events[len(events)-1])
+	broker := p.brokers[target]
+
+	// we need to make sure we set the name even if the broker
+	// was deleted (and is not in the map)
+	broker.Name = target
+
+	op := &serviceBrokerOperation{
+		baseOperation: baseOperation{
+			action: lastStatus,
+			time:   endTime,
+		},
+		broker: broker,
+	}
+
+	return []operation{op}, nil
+}
+
+type planProcessor struct {
+	plans map[string]tsuru.Plan
+}
+
+func (p *planProcessor) process(target string, events []event) ([]operation, error) {
+	if len(events) > 0 && p.plans == nil {
+		plans, err := env.tsuru.PlanList()
+		if err != nil {
+			return nil, err
+		}
+		p.plans = make(map[string]tsuru.Plan)
+		for _, pl := range plans {
+			p.plans[pl.Name] = pl
+		}
+	}
+
+	endTime := events[len(events)-1].EndTime
+	lastStatus := eventStatus(events[len(events)-1])
+	plan := p.plans[target]
+
+	// we need to make sure we set the name even if the plan
+	// was deleted (and is not in the map)
+	plan.Name = target
+
+	op := &planOperation{
+		baseOperation: baseOperation{
+			action: lastStatus,
+			time:   endTime,
+		},
+		plan: plan,
+	}
+
+	return []operation{op}, nil
+}
+
+type volumeProcessor struct {
+	volumes map[string]tsuru.Volume
+}
+
+func (p *volumeProcessor) process(target string, events []event) ([]operation, error) {
+	if len(events) > 0 && p.volumes == nil {
+		volumes, err := env.tsuru.VolumeList()
+		if err != nil {
+			return nil, err
+		}
+		p.volumes = make(map[string]tsuru.Volume)
+		for _, v := range volumes {
+			p.volumes[v.Name] = v
+		}
+	}
+
+	lastStatus := "UPDATE"
+	var endTime time.Time
+	// We only care about the last bind/unbind operation to this
+	// volume by each app at each mountpoint.
+	binds := make(map[volumeBindTarget]string)
+	for _, e := range events {
+		endTime = e.EndTime
+		switch e.Kind.Name {
+		case "volume.delete":
+			lastStatus = "DELETE"
+		case "volume.update.bind", "volume.update.unbind":
+			app, err := extractFormValue(e, "app")
+			if err != nil {
+				return nil, err
+			}
+			mountpoint, err := extractFormValue(e, "mountpoint")
+			if err != nil {
+				return nil, err
+			}
+			action := "UPDATE"
+			if e.Kind.Name == "volume.update.unbind" {
+				action = "DELETE"
+			}
+			binds[volumeBindTarget{app: app, mountpoint: mountpoint}] = action
+		default:
+			lastStatus = "UPDATE"
+		}
+	}
+
+	volume := p.volumes[target]
+
+	// we need to make sure we set the name even if the volume
+	// was deleted (and is not in the map)
+	volume.Name = target
+
+	operations := []operation{
+		&volumeOperation{
+			baseOperation: baseOperation{
+				action: lastStatus,
+				time:   endTime,
+			},
+			volume: volume,
+		},
+		&volumePoolOperation{
+			baseOperation: baseOperation{
+				action: lastStatus,
+				time:   endTime,
+			},
+			volume: volume,
+		},
+	}
+
+	keep := make(map[string]bool)
+	for b, action := range binds {
+		op := &appVolumeOperation{
+			baseOperation: baseOperation{
+				action: action,
+				time:   endTime,
+			},
+			appName:    b.app,
+			volumeName: target,
+			mountpoint: b.mountpoint,
+		}
+		for i := range volume.Binds {
+			id := volume.Binds[i].Id
+			if id != nil && id.App == b.app && id.Mountpoint == b.mountpoint {
+				op.bind = &volume.Binds[i]
+				break
+			}
+		}
+		keep[op.toPayload().Key] = true
+		operations = append(operations, op)
+	}
+
+	// the binds of a deleted volume are only known by the edges stored
+	// in globomap
+	if lastStatus == "DELETE" {
+		stale, err := staleEdges("tsuru_app_volume", "_to", "tsuru_volume/tsuru_"+target, keep, endTime)
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, stale...)
+	}
+
+	return operations, nil
+}
+
+type volumeBindTarget struct {
+	app        string
+	mountpoint string
+}
+
 func processPoolEvents(target string, events []event) ([]operation, error) {
 	var operations []operation
 
@@ -238,17 +674,94 @@ func processPoolEvents(target string, events []event) ([]operation, error) {
 	}
 	operations = append(operations, op)
 
-	if len(operations) > 0 {
-		var err error
-		env.pools, err = env.tsuru.PoolList()
+	var err error
+	env.pools, err = env.tsuru.PoolList()
+	if err != nil {
+		return nil, err
+	}
+
+	if lastStatus != "DELETE" {
+		if pool := op.pool(); pool != nil {
+			for _, team := range pool.Teams {
+				operations = append(operations, &teamPoolOperation{
+					baseOperation: baseOperation{
+						action: lastStatus,
+						time:   endTime,
+					},
+					poolName: target,
+					teamName: team,
+				})
+			}
+		}
+	}
+
+	// teams removed from the pool, or from a deleted pool, are only known
+	// by the edges stored in globomap
+	if removesPoolTeams(events) {
+		keep := make(map[string]bool)
+		for _, op := range operations[1:] {
+			keep[op.toPayload().Key] = true
+		}
+		stale, err := staleEdges("tsuru_team_pool", "_to", "tsuru_pool/tsuru_"+target, keep, endTime)
 		if err != nil {
 			return nil, err
 		}
+		operations = append(operations, stale...)
 	}
 
 	return operations, nil
 }
 
+func removesPoolTeams(events []event) bool {
+	for _, e := range events {
+		if e.Kind.Name == "pool.delete" || e.Kind.Name == "pool.update.team.remove" {
+			return true
+		}
+	}
+	return false
+}
+
+// staleEdges returns operations deleting the edges stored in globomap API
+// that have the given end, either "_from" or "_to", except the ones with
+// the keys to keep.
+func staleEdges(collection, end, id string, keep map[string]bool, t time.Time) ([]operation, error) {
+	keys, err := linkedEdgeKeys(collection, end, id)
+	if err != nil {
+		return nil, err
+	}
+	var operations []operation
+	for _, key := range keys {
+		if keep[key] {
+			continue
+		}
+		operations = append(operations, &staleEdgeOperation{
+			baseOperation: baseOperation{
+				action: "DELETE",
+				time:   t,
+			},
+			collection: collection,
+			key:        key,
+		})
+	}
+	return operations, nil
+}
+
+// linkedEdgeKeys returns the keys of the edges stored in globomap API that
+// have the given end, either "_from" or "_to".
+func linkedEdgeKeys(collection, end, id string) ([]string, error) {
+	query := globomap.NewQuery(collection).Edges().And(globomap.Cond(end, globomap.OpEqual, id))
+	docs, err := env.globomap.QueryAll(query)
+	if err != nil {
+		env.status.recordError(subsystemGlobomapAPI, err)
+		return nil, err
+	}
+	keys := make([]string, len(docs))
+	for i, doc := range docs {
+		keys[i] = doc.Key
+	}
+	return keys, nil
+}
+
 func processNodeEvents(target string, events []event) ([]operation, error) {
 	var operations []operation
 
@@ -259,7 +772,7 @@ func processNodeEvents(target string, events []event) ([]operation, error) {
 		if ops, err := processHealerEvent(lastEvent, target); err == nil {
 			operations = append(operations, ops...)
 		} else {
-			fmt.Printf("Error processing healing event for addr %v: %v", target, err)
+			env.log.With(logger.Fields{"entity": "node", "target": target, "error": err}).Errorf("error processing healing event")
 		}
 		return operations, nil
 	}
@@ -275,11 +788,11 @@ func processNodeEvents(target string, events []event) ([]operation, error) {
 	operations = append(operations, op)
 
 	if len(operations) > 0 {
-		var err error
-		env.nodes, err = env.tsuru.NodeList()
+		nodes, err := env.tsuru.NodeList()
 		if err != nil {
 			return nil, err
 		}
+		setNodes(nodes)
 	}
 
 	return operations, nil
@@ -317,14 +830,17 @@ func processAppEvents(target string, events []event) ([]operation, error) {
 	lastStatus := eventStatus(events[len(events)-1])
 
 	var cachedApp *app
+	var units []unit
+	var hosts map[string]node
 	if lastStatus != "DELETE" {
 		var err error
-		cachedApp, err = env.tsuru.AppInfo(target)
+		cachedApp, units, err = env.tsuru.AppInfoWithUnits(target)
 		if err != nil {
-			if env.config.verbose {
-				fmt.Printf("Failed to retrieve app %s info: %v. Skipping.", target, err)
-			}
-			return nil, nil
+			return nil, fmt.Errorf("failed to retrieve app info: %v", err)
+		}
+		hosts, err = unitHosts()
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -345,11 +861,71 @@ func processAppEvents(target string, events []event) ([]operation, error) {
 			appName:   target,
 			cachedApp: cachedApp,
 		},
+		&teamAppOperation{
+			baseOperation: baseOperation{
+				action: lastStatus,
+				time:   endTime,
+			},
+			appName:   target,
+			cachedApp: cachedApp,
+		},
+		&appPlatformOperation{
+			baseOperation: baseOperation{
+				action: lastStatus,
+				time:   endTime,
+			},
+			appName:   target,
+			cachedApp: cachedApp,
+		},
+		&appRouterOperation{
+			baseOperation: baseOperation{
+				action: lastStatus,
+				time:   endTime,
+			},
+			appName:   target,
+			cachedApp: cachedApp,
+		},
+		&appPlanOperation{
+			baseOperation: baseOperation{
+				action: lastStatus,
+				time:   endTime,
+			},
+			appName:   target,
+			cachedApp: cachedApp,
+		},
+	}
+	operations = append(operations, unitOperations(lastStatus, endTime, units, hosts)...)
+
+	stale, err := staleUnits(target, units, endTime)
+	if err != nil {
+		return nil, err
 	}
+	operations = append(operations, stale...)
 
 	return operations, nil
 }
 
+// staleUnits returns operations deleting the units of the app stored in
+// globomap that are not in the given units. Unit ids change on every
+// deploy, and a deleted app has no units left in tsuru.
+func staleUnits(appName string, units []unit, t time.Time) ([]operation, error) {
+	keys, err := linkedEdgeKeys("tsuru_app_unit", "_from", "tsuru_app/tsuru_"+appName)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]bool, len(units))
+	for _, u := range units {
+		current[u.Id] = true
+	}
+	var stale []unit
+	for _, key := range keys {
+		if id := strings.TrimPrefix(key, "tsuru_"); !current[id] {
+			stale = append(stale, unit{Id: id})
+		}
+	}
+	return unitOperations("DELETE", t, stale, nil), nil
+}
+
 func extractServiceInstance(fqdn string) (string, string, error) {
 	parts := strings.SplitN(fqdn, "/", 2)
 	if len(parts) < 2 {
@@ -358,6 +934,23 @@ func extractServiceInstance(fqdn string) (string, string, error) {
 	return parts[0], parts[1], nil
 }
 
+// extractFormValue returns the value of the given form field from the event
+// start custom data. Field names are case insensitive, like in tsuru API.
+func extractFormValue(e event, name string) (string, error) {
+	data := []map[string]interface{}{}
+	if err := e.StartCustomData.Unmarshal(&data); err != nil {
+		return "", err
+	}
+	for _, d := range data {
+		if field, _ := d["name"].(string); strings.EqualFold(field, name) {
+			if value, ok := d["value"].(string); ok {
+				return value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Unable to extract %s from data: %v", name, data)
+}
+
 func processAppInstanceEvents(app string, events []event) ([]operation, error) {
 	// We only care about the last bind/unbind operation to this
 	// service instance by this app.
@@ -5,10 +5,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -16,6 +21,7 @@ import (
 	"time"
 
 	"github.com/tsuru/globomap-integration/globomap"
+	"github.com/tsuru/globomap-integration/logger"
 	"github.com/tsuru/go-tsuruclient/pkg/tsuru"
 	"gopkg.in/check.v1"
 	"gopkg.in/mgo.v2/bson"
@@ -31,6 +37,24 @@ func newEvent(kind, value string) event {
 	return e
 }
 
+// newEdgeServer serves globomap API edge queries filtered by one of the edge
+// ends, returning the keys registered as "<collection> <end>".
+func newEdgeServer(c *check.C, edges map[string][]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		collection := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v1/edges/"), "/")
+		var conds [][]globomap.Condition
+		err := json.Unmarshal([]byte(req.FormValue("query")), &conds)
+		c.Assert(err, check.IsNil)
+		c.Assert(conds, check.HasLen, 1)
+		c.Assert(conds[0], check.HasLen, 1)
+		documents := []globomap.QueryResult{}
+		for _, key := range edges[fmt.Sprintf("%s %v", collection, conds[0][0].Value)] {
+			documents = append(documents, globomap.QueryResult{Key: key})
+		}
+		json.NewEncoder(w).Encode(struct{ Documents []globomap.QueryResult }{Documents: documents})
+	}))
+}
+
 type tsuruServer struct {
 	*httptest.Server
 	m             sync.Mutex
@@ -118,6 +142,9 @@ func (s *S) TestUpdateCmdRun(c *check.C) {
 	tsuruServer := newTsuruServer(events, services, []app{{Name: "myapp1", Pool: "pool1"}}, []pool{{Name: "pool1"}, {Name: "pool2"}}, nil)
 	defer tsuruServer.Close()
 	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edgeServer := newEdgeServer(c, nil)
+	defer edgeServer.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", edgeServer.URL)
 	requests := make(chan bool)
 	var calls int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -147,7 +174,7 @@ func (s *S) TestUpdateCmdRun(c *check.C) {
 
 		defer close(requests)
 
-		c.Assert(len(data), check.Equals, 12)
+		c.Assert(len(data), check.Equals, 17)
 		el := data[0].Element
 		c.Assert(data[0].Action, check.Equals, "UPDATE")
 		c.Assert(data[0].Collection, check.Equals, "tsuru_app")
@@ -160,68 +187,93 @@ func (s *S) TestUpdateCmdRun(c *check.C) {
 		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
 		c.Assert(data[1].Key, check.Equals, "tsuru_myapp2")
 
-		el = data[2].Element
-		c.Assert(data[2].Action, check.Equals, "UPDATE")
-		c.Assert(data[2].Collection, check.Equals, "tsuru_pool")
-		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[2].Key, check.Equals, "tsuru_pool1")
-		c.Assert(el["name"], check.Equals, "pool1")
+		c.Assert(data[2].Action, check.Equals, "DELETE")
+		c.Assert(data[2].Collection, check.Equals, "tsuru_app_plan")
+		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[2].Key, check.Equals, "tsuru_myapp2-plan")
 
 		c.Assert(data[3].Action, check.Equals, "DELETE")
-		c.Assert(data[3].Collection, check.Equals, "tsuru_pool")
-		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[3].Key, check.Equals, "tsuru_pool2")
+		c.Assert(data[3].Collection, check.Equals, "tsuru_app_platform")
+		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[3].Key, check.Equals, "tsuru_myapp2-platform")
 
-		el = data[4].Element
-		c.Assert(data[4].Action, check.Equals, "UPDATE")
-		c.Assert(data[4].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[4].Action, check.Equals, "DELETE")
+		c.Assert(data[4].Collection, check.Equals, "tsuru_app_router")
 		c.Assert(data[4].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[4].Key, check.Equals, "tsuru_myapp1-pool")
-		c.Assert(el["name"], check.Equals, "myapp1-pool")
-		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
-		c.Assert(el["to"], check.Equals, "tsuru_pool/tsuru_pool1")
+		c.Assert(data[4].Key, check.Equals, "tsuru_myapp2-router")
 
-		c.Assert(data[5].Action, check.Equals, "DELETE")
-		c.Assert(data[5].Collection, check.Equals, "tsuru_pool_app")
-		c.Assert(data[5].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[5].Key, check.Equals, "tsuru_myapp2-pool")
+		el = data[5].Element
+		c.Assert(data[5].Action, check.Equals, "UPDATE")
+		c.Assert(data[5].Collection, check.Equals, "tsuru_pool")
+		c.Assert(data[5].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[5].Key, check.Equals, "tsuru_pool1")
+		c.Assert(el["name"], check.Equals, "pool1")
 
-		c.Assert(data[6].Action, check.Equals, "UPDATE")
-		c.Assert(data[6].Collection, check.Equals, "tsuru_service")
+		c.Assert(data[6].Action, check.Equals, "DELETE")
+		c.Assert(data[6].Collection, check.Equals, "tsuru_pool")
 		c.Assert(data[6].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[6].Key, check.Equals, "tsuru_service1")
+		c.Assert(data[6].Key, check.Equals, "tsuru_pool2")
 
-		c.Assert(data[7].Action, check.Equals, "DELETE")
-		c.Assert(data[7].Collection, check.Equals, "tsuru_service")
-		c.Assert(data[7].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[7].Key, check.Equals, "tsuru_service2")
+		el = data[7].Element
+		c.Assert(data[7].Action, check.Equals, "UPDATE")
+		c.Assert(data[7].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[7].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[7].Key, check.Equals, "tsuru_myapp1-pool")
+		c.Assert(el["name"], check.Equals, "myapp1-pool")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_pool/tsuru_pool1")
 
 		c.Assert(data[8].Action, check.Equals, "DELETE")
-		c.Assert(data[8].Collection, check.Equals, "tsuru_service_instance")
-		c.Assert(data[8].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[8].Key, check.Equals, "tsuru_service1_instance1")
+		c.Assert(data[8].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[8].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[8].Key, check.Equals, "tsuru_myapp2-pool")
 
 		c.Assert(data[9].Action, check.Equals, "UPDATE")
-		c.Assert(data[9].Collection, check.Equals, "tsuru_service_instance")
+		c.Assert(data[9].Collection, check.Equals, "tsuru_service")
 		c.Assert(data[9].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[9].Key, check.Equals, "tsuru_service1_instance2")
+		c.Assert(data[9].Key, check.Equals, "tsuru_service1")
 
 		c.Assert(data[10].Action, check.Equals, "DELETE")
-		c.Assert(data[10].Collection, check.Equals, "tsuru_service_service_instance")
-		c.Assert(data[10].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[10].Key, check.Equals, "tsuru_service1_instance1")
-
-		c.Assert(data[11].Action, check.Equals, "UPDATE")
-		c.Assert(data[11].Collection, check.Equals, "tsuru_service_service_instance")
-		c.Assert(data[11].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[11].Key, check.Equals, "tsuru_service1_instance2")
+		c.Assert(data[10].Collection, check.Equals, "tsuru_service")
+		c.Assert(data[10].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[10].Key, check.Equals, "tsuru_service2")
+
+		c.Assert(data[11].Action, check.Equals, "DELETE")
+		c.Assert(data[11].Collection, check.Equals, "tsuru_service_instance")
+		c.Assert(data[11].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[11].Key, check.Equals, "tsuru_service1_instance1")
+
+		c.Assert(data[12].Action, check.Equals, "UPDATE")
+		c.Assert(data[12].Collection, check.Equals, "tsuru_service_instance")
+		c.Assert(data[12].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[12].Key, check.Equals, "tsuru_service1_instance2")
+
+		c.Assert(data[13].Action, check.Equals, "DELETE")
+		c.Assert(data[13].Collection, check.Equals, "tsuru_service_service_instance")
+		c.Assert(data[13].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[13].Key, check.Equals, "tsuru_service1_instance1")
+
+		c.Assert(data[14].Action, check.Equals, "UPDATE")
+		c.Assert(data[14].Collection, check.Equals, "tsuru_service_service_instance")
+		c.Assert(data[14].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[14].Key, check.Equals, "tsuru_service1_instance2")
+
+		c.Assert(data[15].Action, check.Equals, "DELETE")
+		c.Assert(data[15].Collection, check.Equals, "tsuru_team_app")
+		c.Assert(data[15].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[15].Key, check.Equals, "tsuru_myapp2-team")
+
+		c.Assert(data[16].Action, check.Equals, "DELETE")
+		c.Assert(data[16].Collection, check.Equals, "tsuru_team_service_instance")
+		c.Assert(data[16].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[16].Key, check.Equals, "tsuru_service1_instance1-team")
 	}))
 	defer server.Close()
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
 	setup(nil)
 
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -248,6 +300,9 @@ func (s *S) TestUpdateCmdRunWithMultipleEventsPerKind(c *check.C) {
 	tsuruServer := newTsuruServer(events, nil, apps, pools, nil)
 	defer tsuruServer.Close()
 	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edgeServer := newEdgeServer(c, nil)
+	defer edgeServer.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", edgeServer.URL)
 
 	requests := make(chan bool)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -260,7 +315,7 @@ func (s *S) TestUpdateCmdRunWithMultipleEventsPerKind(c *check.C) {
 		err := decoder.Decode(&data)
 		c.Assert(err, check.IsNil)
 		defer r.Body.Close()
-		c.Assert(data, check.HasLen, 6)
+		c.Assert(data, check.HasLen, 10)
 
 		sortPayload(data)
 		c.Assert(data[0].Action, check.Equals, "DELETE")
@@ -275,38 +330,58 @@ func (s *S) TestUpdateCmdRunWithMultipleEventsPerKind(c *check.C) {
 		c.Assert(data[1].Key, check.Equals, "tsuru_myapp2")
 		c.Assert(el["name"], check.Equals, "myapp2")
 
-		el = data[2].Element
-		c.Assert(data[2].Action, check.Equals, "UPDATE")
-		c.Assert(data[2].Collection, check.Equals, "tsuru_pool")
-		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[2].Key, check.Equals, "tsuru_pool1")
-		c.Assert(el["name"], check.Equals, "pool1")
+		c.Assert(data[2].Action, check.Equals, "DELETE")
+		c.Assert(data[2].Collection, check.Equals, "tsuru_app_plan")
+		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[2].Key, check.Equals, "tsuru_myapp1-plan")
 
 		c.Assert(data[3].Action, check.Equals, "DELETE")
-		c.Assert(data[3].Collection, check.Equals, "tsuru_pool")
-		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeCollection)
-		c.Assert(data[3].Key, check.Equals, "tsuru_pool2")
+		c.Assert(data[3].Collection, check.Equals, "tsuru_app_platform")
+		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[3].Key, check.Equals, "tsuru_myapp1-platform")
 
 		c.Assert(data[4].Action, check.Equals, "DELETE")
-		c.Assert(data[4].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[4].Collection, check.Equals, "tsuru_app_router")
 		c.Assert(data[4].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[4].Key, check.Equals, "tsuru_myapp1-pool")
+		c.Assert(data[4].Key, check.Equals, "tsuru_myapp1-router")
 
 		el = data[5].Element
 		c.Assert(data[5].Action, check.Equals, "UPDATE")
-		c.Assert(data[5].Collection, check.Equals, "tsuru_pool_app")
-		c.Assert(data[5].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[5].Key, check.Equals, "tsuru_myapp2-pool")
+		c.Assert(data[5].Collection, check.Equals, "tsuru_pool")
+		c.Assert(data[5].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[5].Key, check.Equals, "tsuru_pool1")
+		c.Assert(el["name"], check.Equals, "pool1")
+
+		c.Assert(data[6].Action, check.Equals, "DELETE")
+		c.Assert(data[6].Collection, check.Equals, "tsuru_pool")
+		c.Assert(data[6].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[6].Key, check.Equals, "tsuru_pool2")
+
+		c.Assert(data[7].Action, check.Equals, "DELETE")
+		c.Assert(data[7].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[7].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[7].Key, check.Equals, "tsuru_myapp1-pool")
+
+		el = data[8].Element
+		c.Assert(data[8].Action, check.Equals, "UPDATE")
+		c.Assert(data[8].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[8].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[8].Key, check.Equals, "tsuru_myapp2-pool")
 		c.Assert(el["name"], check.Equals, "myapp2-pool")
 		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp2")
 		c.Assert(el["to"], check.Equals, "tsuru_pool/tsuru_pool1")
+
+		c.Assert(data[9].Action, check.Equals, "DELETE")
+		c.Assert(data[9].Collection, check.Equals, "tsuru_team_app")
+		c.Assert(data[9].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[9].Key, check.Equals, "tsuru_myapp1-team")
 	}))
 	defer server.Close()
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
 	setup(nil)
 
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -332,7 +407,7 @@ func (s *S) TestUpdateCmdRunNoRequestWhenNoEventsToPost(c *check.C) {
 	setup(nil)
 
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -350,6 +425,7 @@ func (s *S) TestUpdateCmdRunAppProperties(c *check.C) {
 		Ip:          "myapp1.example.com",
 		Cname:       []string{"myapp1.alias.com"},
 		Router:      "galeb",
+		Routeropts:  map[string]string{"domain": "example.com"},
 		Owner:       "me@example.com",
 		TeamOwner:   "my-team",
 		Teams:       []string{"team1", "team2"},
@@ -358,6 +434,9 @@ func (s *S) TestUpdateCmdRunAppProperties(c *check.C) {
 	tsuruServer := newTsuruServer([]event{newEvent("app.create", "myapp1")}, nil, []app{a}, nil, nil)
 	defer tsuruServer.Close()
 	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edgeServer := newEdgeServer(c, nil)
+	defer edgeServer.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", edgeServer.URL)
 
 	requests := make(chan bool)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -370,7 +449,7 @@ func (s *S) TestUpdateCmdRunAppProperties(c *check.C) {
 		err := decoder.Decode(&data)
 		c.Assert(err, check.IsNil)
 		defer r.Body.Close()
-		c.Assert(data, check.HasLen, 2)
+		c.Assert(data, check.HasLen, 6)
 
 		sortPayload(data)
 		el := data[0].Element
@@ -389,31 +468,150 @@ func (s *S) TestUpdateCmdRunAppProperties(c *check.C) {
 		c.Assert(props["owner"], check.Equals, "me@example.com")
 		c.Assert(props["team_owner"], check.Equals, "my-team")
 		c.Assert(props["teams"], check.DeepEquals, []interface{}{"team1", "team2"})
-		c.Assert(props["plan_name"], check.Equals, "large")
-		c.Assert(props["plan_router"], check.Equals, "galeb1")
-		c.Assert(props["plan_memory"], check.Equals, "1073741824")
-		c.Assert(props["plan_swap"], check.Equals, "0")
-		c.Assert(props["plan_cpushare"], check.Equals, "1024")
+		_, ok = props["plan_name"]
+		c.Assert(ok, check.Equals, false)
 		_, ok = el["properties_metadata"]
 		c.Assert(ok, check.Equals, true)
 
 		el = data[1].Element
 		c.Assert(data[1].Action, check.Equals, "UPDATE")
-		c.Assert(data[1].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[1].Collection, check.Equals, "tsuru_app_plan")
 		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeEdge)
-		c.Assert(data[1].Key, check.Equals, "tsuru_myapp1-pool")
+		c.Assert(data[1].Key, check.Equals, "tsuru_myapp1-plan")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_plan/tsuru_large")
+
+		el = data[2].Element
+		c.Assert(data[2].Action, check.Equals, "UPDATE")
+		c.Assert(data[2].Collection, check.Equals, "tsuru_app_platform")
+		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[2].Key, check.Equals, "tsuru_myapp1-platform")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_platform/tsuru_go")
+
+		el = data[3].Element
+		c.Assert(data[3].Action, check.Equals, "UPDATE")
+		c.Assert(data[3].Collection, check.Equals, "tsuru_app_router")
+		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[3].Key, check.Equals, "tsuru_myapp1-router")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_router/tsuru_galeb")
+		props, ok = el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["domain"], check.Equals, "example.com")
+
+		el = data[4].Element
+		c.Assert(data[4].Action, check.Equals, "UPDATE")
+		c.Assert(data[4].Collection, check.Equals, "tsuru_pool_app")
+		c.Assert(data[4].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[4].Key, check.Equals, "tsuru_myapp1-pool")
 		c.Assert(el["name"], check.Equals, "myapp1-pool")
 		_, ok = el["properties"]
 		c.Assert(ok, check.Equals, false)
 		_, ok = el["properties_metadata"]
 		c.Assert(ok, check.Equals, false)
+
+		el = data[5].Element
+		c.Assert(data[5].Action, check.Equals, "UPDATE")
+		c.Assert(data[5].Collection, check.Equals, "tsuru_team_app")
+		c.Assert(data[5].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[5].Key, check.Equals, "tsuru_myapp1-team")
+		c.Assert(el["from"], check.Equals, "tsuru_team/tsuru_my-team")
+		c.Assert(el["to"], check.Equals, "tsuru_app/tsuru_myapp1")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunWithUnitEvents(c *check.C) {
+	events := []event{
+		newEvent("app.deploy", "myapp1"),
+		newEvent("app.delete", "myapp2"),
+	}
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			req.ParseForm()
+			var selEvents []event
+			for _, e := range events {
+				for _, k := range req.Form["kindname"] {
+					if e.Kind.Name == k {
+						selEvents = append(selEvents, e)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(selEvents)
+		case "/1.0/apps/myapp1":
+			json.NewEncoder(w).Encode(struct {
+				app
+				Units []unit `json:"units"`
+			}{app{Name: "myapp1"}, []unit{{Id: "unit2", Appname: "myapp1", Ip: "1.1.1.1"}}})
+		case "/1.2/node":
+			json.NewEncoder(w).Encode(struct{ Nodes []node }{Nodes: []node{{Pool: "pool1", Iaasid: "node1", Address: "https://1.1.1.1:2376"}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edges := newEdgeServer(c, map[string][]string{
+		"tsuru_app_unit tsuru_app/tsuru_myapp1": {"tsuru_unit1", "tsuru_unit2"},
+		"tsuru_app_unit tsuru_app/tsuru_myapp2": {"tsuru_unit3"},
+	})
+	defer edges.Close()
+	globomapApi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/v1/edges/") {
+			edges.Config.Handler.ServeHTTP(w, req)
+			return
+		}
+		json.NewEncoder(w).Encode(struct{ Documents []globomap.QueryResult }{
+			Documents: []globomap.QueryResult{{Id: "comp_unit/globomap_node1", Name: "node1"}},
+		})
+	}))
+	defer globomapApi.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		var data []globomap.Payload
+		err := json.NewDecoder(r.Body).Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+
+		units := make(map[string]globomap.Payload)
+		for _, p := range data {
+			switch p.Collection {
+			case "tsuru_unit", "tsuru_app_unit", "tsuru_unit_comp_unit":
+				units[p.Collection+"/"+p.Key] = p
+			}
+		}
+		c.Assert(units, check.HasLen, 9)
+		for _, collection := range []string{"tsuru_unit", "tsuru_app_unit", "tsuru_unit_comp_unit"} {
+			c.Assert(units[collection+"/tsuru_unit1"].Action, check.Equals, "DELETE")
+			c.Assert(units[collection+"/tsuru_unit2"].Action, check.Equals, "UPDATE")
+			c.Assert(units[collection+"/tsuru_unit3"].Action, check.Equals, "DELETE")
+		}
+		el := units["tsuru_unit_comp_unit/tsuru_unit2"].Element
+		c.Assert(el["from"], check.Equals, "tsuru_unit/tsuru_unit2")
+		c.Assert(el["to"], check.Equals, "comp_unit/globomap_node1")
 	}))
 	defer server.Close()
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
 	setup(nil)
 
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -446,7 +644,7 @@ func (s *S) TestUpdateCmdRunPoolProperties(c *check.C) {
 		err := decoder.Decode(&data)
 		c.Assert(err, check.IsNil)
 		defer r.Body.Close()
-		c.Assert(data, check.HasLen, 1)
+		c.Assert(data, check.HasLen, 4)
 
 		sortPayload(data)
 		el := data[0].Element
@@ -463,13 +661,76 @@ func (s *S) TestUpdateCmdRunPoolProperties(c *check.C) {
 		c.Assert(props["teams"], check.DeepEquals, []interface{}{"team1", "team2", "team3"})
 		_, ok = el["properties_metadata"]
 		c.Assert(ok, check.Equals, true)
+
+		for i, team := range []string{"team1", "team2", "team3"} {
+			el = data[i+1].Element
+			c.Assert(data[i+1].Action, check.Equals, "UPDATE")
+			c.Assert(data[i+1].Collection, check.Equals, "tsuru_team_pool")
+			c.Assert(data[i+1].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[i+1].Key, check.Equals, "tsuru_pool1_"+team)
+			c.Assert(el["from"], check.Equals, "tsuru_team/tsuru_"+team)
+			c.Assert(el["to"], check.Equals, "tsuru_pool/tsuru_pool1")
+		}
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunDeletesRemovedPoolTeams(c *check.C) {
+	tsuruServer := newTsuruServer([]event{
+		newEvent("pool.update.team.remove", "pool1"),
+		newEvent("pool.delete", "pool2"),
+	}, nil, nil, []pool{{Name: "pool1", Teams: []string{"team1"}}}, nil)
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edgeServer := newEdgeServer(c, map[string][]string{
+		"tsuru_team_pool tsuru_pool/tsuru_pool1": {"tsuru_pool1_team1", "tsuru_pool1_team2"},
+		"tsuru_team_pool tsuru_pool/tsuru_pool2": {"tsuru_pool2_team1"},
+	})
+	defer edgeServer.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", edgeServer.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		var data []globomap.Payload
+		err := json.NewDecoder(r.Body).Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+		c.Assert(data, check.HasLen, 5)
+
+		sortPayload(data)
+		c.Assert(data[0].Action, check.Equals, "UPDATE")
+		c.Assert(data[0].Key, check.Equals, "tsuru_pool1")
+		c.Assert(data[1].Action, check.Equals, "DELETE")
+		c.Assert(data[1].Key, check.Equals, "tsuru_pool2")
+		c.Assert(data[2].Action, check.Equals, "UPDATE")
+		c.Assert(data[2].Collection, check.Equals, "tsuru_team_pool")
+		c.Assert(data[2].Key, check.Equals, "tsuru_pool1_team1")
+		for _, p := range data[3:] {
+			c.Assert(p.Action, check.Equals, "DELETE")
+			c.Assert(p.Collection, check.Equals, "tsuru_team_pool")
+			c.Assert(p.Type, check.Equals, globomap.PayloadTypeEdge)
+		}
+		c.Assert(data[3].Key, check.Equals, "tsuru_pool1_team2")
+		c.Assert(data[4].Key, check.Equals, "tsuru_pool2_team1")
 	}))
 	defer server.Close()
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
 	setup(nil)
 
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -611,15 +872,18 @@ func (s *S) TestUpdateCmdRunWithNodeEvents(c *check.C) {
 	defer server.Close()
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
 	setup(nil)
+	var logs bytes.Buffer
+	env.log = logger.New(&logs, logger.Debug, logger.Text)
 
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
 	case <-time.After(5 * time.Second):
 		c.Fail()
 	}
+	c.Assert(strings.Contains(logs.String(), "comp_unit matches:\nnode1: name\nnode3: name\nnode5: name"), check.Equals, true)
 }
 
 func (s *S) TestUpdateCmdRunWithRetry(c *check.C) {
@@ -682,10 +946,11 @@ func (s *S) TestUpdateCmdRunWithRetry(c *check.C) {
 	defer server.Close()
 	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
 	setup([]string{"--repeat", "1m"})
+	defer env.retryQueue.stop()
 
 	env.config.retrySleepTime = 0
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -704,6 +969,9 @@ func (s *S) TestUpdateCmdRunIgnoresFailedEvents(c *check.C) {
 	tsuruServer := newTsuruServer(events, nil, []app{{Name: "myapp1"}}, nil, nil)
 	defer tsuruServer.Close()
 	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edgeServer := newEdgeServer(c, nil)
+	defer edgeServer.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", edgeServer.URL)
 
 	requests := make(chan bool)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -723,7 +991,97 @@ func (s *S) TestUpdateCmdRunIgnoresFailedEvents(c *check.C) {
 	setup(nil)
 
 	cmd := &updateCmd{}
-	cmd.Run()
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunWithTeamEvents(c *check.C) {
+	events := []event{
+		newEvent("team.create", "team1"),
+		newEvent("team.create", "team2"),
+		newEvent("team.delete", "team2"),
+	}
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			req.ParseForm()
+			var selEvents []event
+			for _, e := range events {
+				for _, k := range req.Form["kindname"] {
+					if e.Kind.Name == k {
+						selEvents = append(selEvents, e)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(selEvents)
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{
+				{Name: "team1", Tags: []string{"tag1"}, Permissions: []string{"app"}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edgeServer := newEdgeServer(c, map[string][]string{
+		"tsuru_team_app tsuru_team/tsuru_team2":  {"tsuru_myapp-team"},
+		"tsuru_team_pool tsuru_team/tsuru_team2": {"tsuru_pool1_team2"},
+	})
+	defer edgeServer.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", edgeServer.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+
+		decoder := json.NewDecoder(r.Body)
+		var data []globomap.Payload
+		err := decoder.Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+		c.Assert(data, check.HasLen, 4)
+
+		sortPayload(data)
+		el := data[0].Element
+		c.Assert(data[0].Action, check.Equals, "UPDATE")
+		c.Assert(data[0].Collection, check.Equals, "tsuru_team")
+		c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[0].Key, check.Equals, "tsuru_team1")
+		c.Assert(el["name"], check.Equals, "team1")
+		props, ok := el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["tags"], check.DeepEquals, []interface{}{"tag1"})
+		c.Assert(props["permissions"], check.DeepEquals, []interface{}{"app"})
+
+		c.Assert(data[1].Action, check.Equals, "DELETE")
+		c.Assert(data[1].Collection, check.Equals, "tsuru_team")
+		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[1].Key, check.Equals, "tsuru_team2")
+
+		c.Assert(data[2].Action, check.Equals, "DELETE")
+		c.Assert(data[2].Collection, check.Equals, "tsuru_team_app")
+		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[2].Key, check.Equals, "tsuru_myapp-team")
+
+		c.Assert(data[3].Action, check.Equals, "DELETE")
+		c.Assert(data[3].Collection, check.Equals, "tsuru_team_pool")
+		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[3].Key, check.Equals, "tsuru_pool1_team2")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
 
 	select {
 	case <-requests:
@@ -731,3 +1089,720 @@ func (s *S) TestUpdateCmdRunIgnoresFailedEvents(c *check.C) {
 		c.Fail()
 	}
 }
+
+func (s *S) TestUpdateCmdRunWithPlatformEvents(c *check.C) {
+	events := []event{
+		newEvent("platform.create", "python"),
+		newEvent("platform.update", "python2"),
+		newEvent("platform.delete", "python2"),
+	}
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			req.ParseForm()
+			var selEvents []event
+			for _, e := range events {
+				for _, k := range req.Form["kindname"] {
+					if e.Kind.Name == k {
+						selEvents = append(selEvents, e)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(selEvents)
+		case "/1.0/platforms":
+			json.NewEncoder(w).Encode([]tsuru.Platform{{Name: "python"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+
+		decoder := json.NewDecoder(r.Body)
+		var data []globomap.Payload
+		err := decoder.Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+		c.Assert(data, check.HasLen, 2)
+
+		sortPayload(data)
+		el := data[0].Element
+		c.Assert(data[0].Action, check.Equals, "UPDATE")
+		c.Assert(data[0].Collection, check.Equals, "tsuru_platform")
+		c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[0].Key, check.Equals, "tsuru_python")
+		c.Assert(el["name"], check.Equals, "python")
+		props, ok := el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["disabled"], check.Equals, "false")
+
+		c.Assert(data[1].Action, check.Equals, "DELETE")
+		c.Assert(data[1].Collection, check.Equals, "tsuru_platform")
+		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[1].Key, check.Equals, "tsuru_python2")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunWithRouterEvents(c *check.C) {
+	events := []event{
+		newEvent("router.create", "galeb"),
+		newEvent("router.update", "hipache"),
+		newEvent("router.delete", "hipache"),
+	}
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			req.ParseForm()
+			var selEvents []event
+			for _, e := range events {
+				for _, k := range req.Form["kindname"] {
+					if e.Kind.Name == k {
+						selEvents = append(selEvents, e)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(selEvents)
+		case "/1.0/routers":
+			json.NewEncoder(w).Encode([]tsuru.Router{
+				{Name: "galeb", Type_: "galebv2", Addres: "galeb.example.com", Opts: map[string]string{"domain": "example.com"}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+
+		decoder := json.NewDecoder(r.Body)
+		var data []globomap.Payload
+		err := decoder.Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+		c.Assert(data, check.HasLen, 2)
+
+		sortPayload(data)
+		el := data[0].Element
+		c.Assert(data[0].Action, check.Equals, "UPDATE")
+		c.Assert(data[0].Collection, check.Equals, "tsuru_router")
+		c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[0].Key, check.Equals, "tsuru_galeb")
+		c.Assert(el["name"], check.Equals, "galeb")
+		props, ok := el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["type"], check.Equals, "galebv2")
+		c.Assert(props["address"], check.Equals, "galeb.example.com")
+		c.Assert(props["opts"], check.DeepEquals, map[string]interface{}{"domain": "example.com"})
+
+		c.Assert(data[1].Action, check.Equals, "DELETE")
+		c.Assert(data[1].Collection, check.Equals, "tsuru_router")
+		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[1].Key, check.Equals, "tsuru_hipache")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunWithVolumeEvents(c *check.C) {
+	bind := func(kind, volume, app, mountpoint string) event {
+		e := newEvent(kind, volume)
+		b, err := bson.Marshal(&[]map[string]interface{}{
+			{"name": "App", "value": app},
+			{"name": "MountPoint", "value": mountpoint},
+		})
+		c.Assert(err, check.IsNil)
+		e.StartCustomData = bson.Raw{Data: b, Kind: 4}
+		return e
+	}
+	events := []event{
+		newEvent("volume.create", "vol1"),
+		bind("volume.update.bind", "vol1", "myapp1", "/data"),
+		bind("volume.update.bind", "vol1", "myapp1", "/logs"),
+		bind("volume.update.unbind", "vol1", "myapp1", "/logs"),
+		bind("volume.update.bind", "vol1", "myapp2", "/data"),
+		bind("volume.update.unbind", "vol1", "myapp2", "/data"),
+		newEvent("volume.delete", "vol2"),
+	}
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			req.ParseForm()
+			var selEvents []event
+			for _, e := range events {
+				for _, k := range req.Form["kindname"] {
+					if e.Kind.Name == k {
+						selEvents = append(selEvents, e)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(selEvents)
+		case "/1.4/volumes":
+			json.NewEncoder(w).Encode([]tsuru.Volume{{
+				Name:      "vol1",
+				Pool:      "pool1",
+				TeamOwner: "team1",
+				Plan:      &tsuru.VolumePlan{Name: "nfs"},
+				Binds: []tsuru.VolumeBind{
+					{Id: &tsuru.VolumeBindId{App: "myapp1", Mountpoint: "/data", Volume: "vol1"}, Readonly: true},
+				},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	edgeServer := newEdgeServer(c, map[string][]string{
+		"tsuru_app_volume tsuru_volume/tsuru_vol2": {"tsuru_myapp3_vol2_data"},
+	})
+	defer edgeServer.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", edgeServer.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+
+		decoder := json.NewDecoder(r.Body)
+		var data []globomap.Payload
+		err := decoder.Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+		c.Assert(data, check.HasLen, 8)
+
+		sortPayload(data)
+		el := data[0].Element
+		c.Assert(data[0].Action, check.Equals, "UPDATE")
+		c.Assert(data[0].Collection, check.Equals, "tsuru_app_volume")
+		c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[0].Key, check.Equals, "tsuru_myapp1_vol1_data")
+		c.Assert(el["from"], check.Equals, "tsuru_app/tsuru_myapp1")
+		c.Assert(el["to"], check.Equals, "tsuru_volume/tsuru_vol1")
+		props, ok := el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["mountpoint"], check.Equals, "/data")
+		c.Assert(props["readonly"], check.Equals, "true")
+
+		for i, key := range []string{"tsuru_myapp1_vol1_logs", "tsuru_myapp2_vol1_data", "tsuru_myapp3_vol2_data"} {
+			c.Assert(data[i+1].Action, check.Equals, "DELETE")
+			c.Assert(data[i+1].Collection, check.Equals, "tsuru_app_volume")
+			c.Assert(data[i+1].Type, check.Equals, globomap.PayloadTypeEdge)
+			c.Assert(data[i+1].Key, check.Equals, key)
+		}
+
+		el = data[4].Element
+		c.Assert(data[4].Action, check.Equals, "UPDATE")
+		c.Assert(data[4].Collection, check.Equals, "tsuru_volume")
+		c.Assert(data[4].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[4].Key, check.Equals, "tsuru_vol1")
+		props, ok = el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["pool"], check.Equals, "pool1")
+		c.Assert(props["team_owner"], check.Equals, "team1")
+		c.Assert(props["plan"], check.Equals, "nfs")
+
+		c.Assert(data[5].Action, check.Equals, "DELETE")
+		c.Assert(data[5].Collection, check.Equals, "tsuru_volume")
+		c.Assert(data[5].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[5].Key, check.Equals, "tsuru_vol2")
+
+		el = data[6].Element
+		c.Assert(data[6].Action, check.Equals, "UPDATE")
+		c.Assert(data[6].Collection, check.Equals, "tsuru_volume_pool")
+		c.Assert(data[6].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[6].Key, check.Equals, "tsuru_vol1-pool")
+		c.Assert(el["from"], check.Equals, "tsuru_volume/tsuru_vol1")
+		c.Assert(el["to"], check.Equals, "tsuru_pool/tsuru_pool1")
+
+		c.Assert(data[7].Action, check.Equals, "DELETE")
+		c.Assert(data[7].Collection, check.Equals, "tsuru_volume_pool")
+		c.Assert(data[7].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[7].Key, check.Equals, "tsuru_vol2-pool")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunWithPlanEvents(c *check.C) {
+	events := []event{
+		newEvent("plan.create", "large"),
+		newEvent("plan.create", "small"),
+		newEvent("plan.delete", "small"),
+	}
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			req.ParseForm()
+			var selEvents []event
+			for _, e := range events {
+				for _, k := range req.Form["kindname"] {
+					if e.Kind.Name == k {
+						selEvents = append(selEvents, e)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(selEvents)
+		case "/1.0/plans":
+			json.NewEncoder(w).Encode([]tsuru.Plan{
+				{Name: "large", Memory: 1073741824, Swap: 0, Cpushare: 1024, Router: "galeb1", Default_: true},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+
+		decoder := json.NewDecoder(r.Body)
+		var data []globomap.Payload
+		err := decoder.Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+		c.Assert(data, check.HasLen, 2)
+
+		sortPayload(data)
+		el := data[0].Element
+		c.Assert(data[0].Action, check.Equals, "UPDATE")
+		c.Assert(data[0].Collection, check.Equals, "tsuru_plan")
+		c.Assert(data[0].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[0].Key, check.Equals, "tsuru_large")
+		c.Assert(el["name"], check.Equals, "large")
+		props, ok := el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["memory"], check.Equals, "1073741824")
+		c.Assert(props["swap"], check.Equals, "0")
+		c.Assert(props["cpushare"], check.Equals, "1024")
+		c.Assert(props["router"], check.Equals, "galeb1")
+		c.Assert(props["default"], check.Equals, "true")
+
+		c.Assert(data[1].Action, check.Equals, "DELETE")
+		c.Assert(data[1].Collection, check.Equals, "tsuru_plan")
+		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[1].Key, check.Equals, "tsuru_small")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunWithServiceBrokerEvents(c *check.C) {
+	events := []event{
+		newEvent("service-broker.create", "broker1"),
+		newEvent("service-broker.delete", "broker2"),
+		newEvent("service.create", "broker1::mysql"),
+	}
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			req.ParseForm()
+			var selEvents []event
+			for _, e := range events {
+				for _, k := range req.Form["kindname"] {
+					if e.Kind.Name == k {
+						selEvents = append(selEvents, e)
+					}
+				}
+			}
+			json.NewEncoder(w).Encode(selEvents)
+		case "/1.7/brokers":
+			json.NewEncoder(w).Encode(tsuru.ServiceBrokerList{Brokers: []tsuru.ServiceBroker{{
+				Name: "broker1",
+				URL:  "https://broker.example.com",
+				Config: &tsuru.ServiceBrokerConfig{
+					AuthConfig: &tsuru.ServiceBrokerConfigAuthConfig{
+						BasicAuthConfig: &tsuru.ServiceBrokerConfigAuthConfigBasicAuthConfig{Username: "user", Password: "secret"},
+					},
+				},
+			}}})
+		case "/1.0/services/instances":
+			json.NewEncoder(w).Encode([]tsuru.Service{{Service: "broker1::mysql"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	requests := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(requests)
+		c.Assert(r.Method, check.Equals, http.MethodPost)
+		c.Assert(r.URL.Path, check.Equals, "/v1/updates")
+
+		decoder := json.NewDecoder(r.Body)
+		var data []globomap.Payload
+		err := decoder.Decode(&data)
+		c.Assert(err, check.IsNil)
+		defer r.Body.Close()
+		c.Assert(data, check.HasLen, 4)
+
+		sortPayload(data)
+		c.Assert(data[0].Action, check.Equals, "UPDATE")
+		c.Assert(data[0].Collection, check.Equals, "tsuru_service")
+		c.Assert(data[0].Key, check.Equals, "tsuru_broker1::mysql")
+
+		el := data[1].Element
+		c.Assert(data[1].Action, check.Equals, "UPDATE")
+		c.Assert(data[1].Collection, check.Equals, "tsuru_service_broker")
+		c.Assert(data[1].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[1].Key, check.Equals, "tsuru_broker1")
+		props, ok := el["properties"].(map[string]interface{})
+		c.Assert(ok, check.Equals, true)
+		c.Assert(props["url"], check.Equals, "https://broker.example.com")
+		c.Assert(props["auth_type"], check.Equals, "basic")
+		b, err := json.Marshal(el)
+		c.Assert(err, check.IsNil)
+		c.Assert(strings.Contains(string(b), "secret"), check.Equals, false)
+
+		c.Assert(data[2].Action, check.Equals, "DELETE")
+		c.Assert(data[2].Collection, check.Equals, "tsuru_service_broker")
+		c.Assert(data[2].Type, check.Equals, globomap.PayloadTypeCollection)
+		c.Assert(data[2].Key, check.Equals, "tsuru_broker2")
+
+		el = data[3].Element
+		c.Assert(data[3].Action, check.Equals, "UPDATE")
+		c.Assert(data[3].Collection, check.Equals, "tsuru_service_broker_service")
+		c.Assert(data[3].Type, check.Equals, globomap.PayloadTypeEdge)
+		c.Assert(data[3].Key, check.Equals, "tsuru_broker1::mysql")
+		c.Assert(el["from"], check.Equals, "tsuru_service_broker/tsuru_broker1")
+		c.Assert(el["to"], check.Equals, "tsuru_service/tsuru_broker1::mysql")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	setup(nil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		c.Fail()
+	}
+}
+
+func (s *S) TestUpdateCmdRunWithCheckpoint(c *check.C) {
+	checkpointTime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	e1, e2 := newEvent("team.create", "team1"), newEvent("team.create", "team2")
+	e1.EndTime = checkpointTime.Add(time.Minute)
+	e2.EndTime = checkpointTime.Add(2 * time.Minute)
+	var m sync.Mutex
+	var since []string
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			m.Lock()
+			since = append(since, req.FormValue("since"))
+			m.Unlock()
+			if req.FormValue("running") == "true" || req.FormValue("kindname") == "app.update.bind" {
+				json.NewEncoder(w).Encode(nil)
+				return
+			}
+			json.NewEncoder(w).Encode([]event{e1, e2})
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}, {Name: "team2"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	var posts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	os.Setenv("CHECKPOINT_FILE", filepath.Join(c.MkDir(), "state.json"))
+	defer os.Unsetenv("CHECKPOINT_FILE")
+	setup(nil)
+	err := env.checkpoint.Save(checkpointTime)
+	c.Assert(err, check.IsNil)
+
+	before := time.Now()
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	c.Assert(posts, check.Equals, 1)
+	expectedSince := checkpointTime.In(time.Local).Format(TIME_FORMAT)
+	c.Assert(since, check.DeepEquals, []string{expectedSince, expectedSince, expectedSince, expectedSince})
+	last, err := env.checkpoint.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last.Before(before), check.Equals, false)
+	c.Assert(last.After(time.Now()), check.Equals, false)
+}
+
+func (s *S) TestUpdateCmdRunCheckpointsEarliestRunningEvent(c *check.C) {
+	checkpointTime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	finished := newEvent("team.create", "team1")
+	finished.StartTime = checkpointTime.Add(2 * time.Minute)
+	finished.EndTime = checkpointTime.Add(3 * time.Minute)
+	deploy := newEvent("app.deploy", "myapp1")
+	deploy.StartTime = checkpointTime.Add(time.Minute)
+	deploy.Running = true
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			if req.FormValue("running") == "true" {
+				json.NewEncoder(w).Encode([]event{deploy})
+				return
+			}
+			if req.FormValue("kindname") == "app.update.bind" {
+				json.NewEncoder(w).Encode(nil)
+				return
+			}
+			json.NewEncoder(w).Encode([]event{finished})
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	os.Setenv("CHECKPOINT_FILE", filepath.Join(c.MkDir(), "state.json"))
+	defer os.Unsetenv("CHECKPOINT_FILE")
+	setup(nil)
+	err := env.checkpoint.Save(checkpointTime)
+	c.Assert(err, check.IsNil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	last, err := env.checkpoint.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last.Equal(deploy.StartTime), check.Equals, true)
+}
+
+func (s *S) TestUpdateCmdRunStopsWhenContextIsCancelled(c *check.C) {
+	checkpointTime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	e := newEvent("team.create", "team1")
+	e.EndTime = checkpointTime.Add(time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			cancel()
+			json.NewEncoder(w).Encode([]event{e})
+		default:
+			c.Errorf("unexpected request to %s", req.URL.Path)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	os.Setenv("CHECKPOINT_FILE", filepath.Join(c.MkDir(), "state.json"))
+	defer os.Unsetenv("CHECKPOINT_FILE")
+	setup(nil)
+	env.tsuru.Context = ctx
+	env.globomap.Context = ctx
+	err := env.checkpoint.Save(checkpointTime)
+	c.Assert(err, check.IsNil)
+
+	cmd := &updateCmd{}
+	cmd.Run(ctx)
+
+	last, err := env.checkpoint.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last.Equal(checkpointTime), check.Equals, true)
+}
+
+func (s *S) TestUpdateCmdRunKeepsCheckpointWhenPostFails(c *check.C) {
+	checkpointTime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	e := newEvent("team.create", "team1")
+	e.EndTime = checkpointTime.Add(time.Minute)
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			json.NewEncoder(w).Encode([]event{e})
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	os.Setenv("CHECKPOINT_FILE", filepath.Join(c.MkDir(), "state.json"))
+	defer os.Unsetenv("CHECKPOINT_FILE")
+	setup(nil)
+	err := env.checkpoint.Save(checkpointTime)
+	c.Assert(err, check.IsNil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	last, err := env.checkpoint.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last.Equal(checkpointTime), check.Equals, true)
+}
+
+func (s *S) TestUpdateCmdRunKeepsCheckpointWhenProcessingFails(c *check.C) {
+	checkpointTime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	e1, e2 := newEvent("team.create", "team1"), newEvent("platform.create", "python")
+	e1.EndTime = checkpointTime.Add(time.Minute)
+	e2.EndTime = checkpointTime.Add(2 * time.Minute)
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			if req.FormValue("kindname") == "app.update.bind" {
+				json.NewEncoder(w).Encode(nil)
+				return
+			}
+			json.NewEncoder(w).Encode([]event{e1, e2})
+		case "/1.0/platforms":
+			json.NewEncoder(w).Encode([]tsuru.Platform{{Name: "python"}})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+
+	var posted []globomap.Payload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&posted)
+		c.Assert(err, check.IsNil)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"jobid": "1", "message": "ok"})
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	os.Setenv("CHECKPOINT_FILE", filepath.Join(c.MkDir(), "state.json"))
+	defer os.Unsetenv("CHECKPOINT_FILE")
+	setup(nil)
+	err := env.checkpoint.Save(checkpointTime)
+	c.Assert(err, check.IsNil)
+
+	cmd := &updateCmd{}
+	cmd.Run(context.Background())
+
+	c.Assert(posted, check.HasLen, 1)
+	c.Assert(posted[0].Key, check.Equals, "tsuru_python")
+	last, err := env.checkpoint.Load()
+	c.Assert(err, check.IsNil)
+	c.Assert(last.Equal(checkpointTime), check.Equals, true)
+}
+
+func (s *S) TestUpdateCmdRunKeepsCheckpointInPreviewModes(c *check.C) {
+	checkpointTime := time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC)
+	e := newEvent("team.create", "team1")
+	e.EndTime = checkpointTime.Add(time.Minute)
+	tsuruServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/events":
+			json.NewEncoder(w).Encode([]event{e})
+		case "/1.0/teams":
+			json.NewEncoder(w).Encode([]tsuru.Team{{Name: "team1"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer tsuruServer.Close()
+	os.Setenv("TSURU_HOST", tsuruServer.URL)
+	globomapApi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer globomapApi.Close()
+	os.Setenv("GLOBOMAP_API_HOSTNAME", globomapApi.URL)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("No request should have been done")
+	}))
+	defer server.Close()
+	os.Setenv("GLOBOMAP_LOADER_HOSTNAME", server.URL)
+	os.Setenv("CHECKPOINT_FILE", filepath.Join(c.MkDir(), "state.json"))
+	defer os.Unsetenv("CHECKPOINT_FILE")
+
+	for _, args := range [][]string{{"--dry"}, {"--diff"}} {
+		setup(args)
+		env.globomap.DiffOutput = ioutil.Discard
+		err := env.checkpoint.Save(checkpointTime)
+		c.Assert(err, check.IsNil)
+
+		cmd := &updateCmd{}
+		cmd.Run(context.Background())
+
+		last, err := env.checkpoint.Load()
+		c.Assert(err, check.IsNil)
+		c.Assert(last.Equal(checkpointTime), check.Equals, true, check.Commentf("%v", args))
+	}
+}